@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c4po/terrastate/internal/backup"
+	"github.com/c4po/terrastate/internal/config"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/migrate"
+	"github.com/c4po/terrastate/internal/storage/replication"
+	"github.com/c4po/terrastate/internal/tfimport"
+)
+
+// runCommand runs the maintenance command name and returns the exit code.
+// Commands read the configuration from the file in TERRASTATE_CONFIG and the
+// environment, as the server does.
+func runCommand(name string, args []string) int {
+	commands := map[string]func(*config.Config, []string) error{
+		"reconcile": reconcileCommand,
+		"migrate":   migrateCommand,
+		"import":    importCommand,
+		"backup":    backupCommand,
+		"restore":   restoreCommand,
+	}
+	if name == "config" {
+		return configCommand(args)
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		fmt.Fprintln(os.Stderr, "commands: backup, config, import, migrate, reconcile, restore")
+		return 2
+	}
+
+	cfg, err := config.Load(name, nil)
+	if err == nil {
+		err = initializeLogging(cfg.Logging)
+	}
+	if err == nil {
+		err = command(cfg, args)
+	}
+
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// configCommand checks a configuration. "config validate" takes the same
+// flags as the server and reports every problem of the configuration they
+// and the environment and file make up.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: config validate [-config <file>] [flags]")
+		return 2
+	}
+
+	cfg, err := config.Load("config validate", args[1:])
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("configuration is valid")
+	return 0
+}
+
+// closeStorage closes s if it needs closing, which persists in-memory
+// snapshots
+func closeStorage(s storage.StateStorage) {
+	if closer, ok := s.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to close storage: %v\n", err)
+		}
+	}
+}
+
+// reconcileCommand fixes drift between the configured storage and its replica
+// by copying divergent states and workspace metadata from the primary
+func reconcileCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	replica := flags.String("replica", cfg.Replication.Replica, "secondary storage, such as disk:/backup or s3://bucket/prefix")
+	workspace := flags.String("workspace", "", "only reconcile this workspace")
+	dryRun := flags.Bool("dry-run", false, "only report the differences")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *replica == "" {
+		return fmt.Errorf("no replica given; set -replica or replication.replica")
+	}
+
+	primary, err := initializeStorage(cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to initialize storage: %w", err)
+	}
+	defer closeStorage(primary)
+	secondary, err := openStorage(*replica, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to open replica: %w", err)
+	}
+	defer closeStorage(secondary)
+
+	divergences, err := replication.Reconcile(context.Background(), primary, secondary, *workspace, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, d := range divergences {
+		name := d.Workspace
+		if d.ID != "" {
+			name += "/" + d.ID
+		}
+		fmt.Printf("%s %s: %s\n", d.Kind, name, d.Reason)
+	}
+
+	if *dryRun {
+		fmt.Printf("%d differences found\n", len(divergences))
+	} else {
+		fmt.Printf("%d differences fixed\n", len(divergences))
+	}
+	return nil
+}
+
+// migrateCommand copies everything from one storage backend to another. It
+// always prints the plan first and stops there with -dry-run.
+func migrateCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fromSpec := flags.String("from", "", "source storage, such as disk:/data")
+	toSpec := flags.String("to", "", "destination storage, such as s3://bucket/prefix")
+	workspace := flags.String("workspace", "", "only migrate this workspace")
+	dryRun := flags.Bool("dry-run", false, "only print the plan")
+	overwrite := flags.Bool("overwrite", false, "replace states that already exist on the destination")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *fromSpec == "" || *toSpec == "" {
+		return fmt.Errorf("both -from and -to are required")
+	}
+
+	from, err := openStorage(*fromSpec, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer closeStorage(from)
+	to, err := openStorage(*toSpec, cfg.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer closeStorage(to)
+
+	ctx := context.Background()
+	var workspaces []string
+	if *workspace != "" {
+		workspaces = []string{*workspace}
+	}
+	plan, err := migrate.NewPlan(ctx, from, to, workspaces...)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrating %d workspaces from %s to %s\n", len(plan.Workspaces), *fromSpec, *toSpec)
+	for _, item := range plan.States {
+		fmt.Printf("  %s (%d bytes, %d previous versions)\n", item, item.Size, item.Versions)
+	}
+	for _, ws := range plan.Metadata {
+		fmt.Printf("  metadata of %s\n", ws)
+	}
+	for _, name := range plan.Locked {
+		fmt.Printf("  %s is locked\n", name)
+	}
+	for _, name := range plan.Conflicts {
+		fmt.Printf("  %s already exists on the destination\n", name)
+	}
+	if err := plan.Err(*overwrite); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Println("Dry run, nothing copied")
+		return nil
+	}
+
+	err = migrate.Run(ctx, from, to, plan, func(item migrate.Item) {
+		fmt.Printf("Copied %s\n", item)
+	})
+	if err != nil {
+		return err
+	}
+
+	mismatches, err := migrate.Verify(ctx, to, plan)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("checksum mismatch on the destination: %v", mismatches)
+	}
+	fmt.Printf("Migrated and verified %d states\n", len(plan.States))
+	return nil
+}
+
+// importCommand imports states from a Terraform S3 or local backend layout,
+// given as dir:<path> or s3://<bucket>[/<prefix>], into the configured
+// storage or the one given with -to
+func importCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	sourceSpec := flags.String("source", "", "state files to import, such as dir:/srv/terraform or s3://bucket/prefix")
+	toSpec := flags.String("to", "", "destination storage instead of the configured one")
+	keyPrefix := flags.String("workspace-key-prefix", tfimport.DefaultWorkspaceKeyPrefix, "workspace_key_prefix of the S3 backend")
+	dryRun := flags.Bool("dry-run", false, "only print what would be imported")
+	overwrite := flags.Bool("overwrite", false, "import over states with another lineage")
+	var rules []tfimport.Rule
+	flags.Func("map", "mapping rule <pattern>=<template> from <workspace>/<key> to <workspace>/<id>; may be repeated", func(value string) error {
+		rule, err := tfimport.ParseRule(value)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+		return nil
+	})
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	src, err := openImportSource(*sourceSpec, cfg.Storage.S3)
+	if err != nil {
+		return err
+	}
+
+	var dst storage.StateStorage
+	if *toSpec != "" {
+		dst, err = openStorage(*toSpec, cfg.Storage)
+	} else {
+		dst, err = initializeStorage(cfg.Storage)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open destination: %w", err)
+	}
+	defer closeStorage(dst)
+
+	ctx := context.Background()
+	entries, err := tfimport.Scan(ctx, src, dst, tfimport.Options{
+		WorkspaceKeyPrefix: *keyPrefix,
+		Rules:              rules,
+		Overwrite:          *overwrite,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		line := fmt.Sprintf("%s -> %s/%s (serial %d, lineage %s): %s", entry.Path, entry.Workspace, entry.ID, entry.Serial, entry.Lineage, entry.Status)
+		if entry.Reason != "" {
+			line += " (" + entry.Reason + ")"
+		}
+		fmt.Println(line)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, %d states found\n", len(entries))
+		return nil
+	}
+
+	imported, err := tfimport.Import(ctx, src, dst, entries)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d of %d states\n", imported, len(entries))
+	return nil
+}
+
+// openImportSource opens the state files at spec. S3 sources are reached with
+// the endpoint and region of the configured S3 storage.
+func openImportSource(spec string, s3cfg config.S3Config) (tfimport.Source, error) {
+	if dir, ok := strings.CutPrefix(spec, "dir:"); ok && dir != "" {
+		return tfimport.NewDirSource(dir), nil
+	}
+	if strings.HasPrefix(spec, "s3://") {
+		u, err := url.Parse(spec)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid source %q", spec)
+		}
+		client, err := newS3Client(s3cfg)
+		if err != nil {
+			return nil, err
+		}
+		return tfimport.NewS3Source(client, u.Host, strings.Trim(u.Path, "/")), nil
+	}
+	return nil, fmt.Errorf("invalid source %q: expected dir:<path> or s3://<bucket>[/<prefix>]", spec)
+}
+
+// openCommandStorage opens the storage given with -storage, or the
+// configured one
+func openCommandStorage(spec string, cfg *config.Config) (storage.StateStorage, error) {
+	if spec != "" {
+		return openStorage(spec, cfg.Storage)
+	}
+	return initializeStorage(cfg.Storage)
+}
+
+// backupCommand writes an archive of the storage to a file or stdout. Tokens
+// only live in the server, so use the admin API to back them up.
+func backupCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	spec := flags.String("storage", "", "storage to back up instead of the configured one")
+	output := flags.String("o", "-", "archive file, or - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openCommandStorage(*spec, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer closeStorage(s)
+
+	write := func(ctx context.Context, w io.Writer) error {
+		manifest, err := backup.Write(ctx, w, s, nil)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Archived %d entries\n", len(manifest.Entries))
+		}
+		return err
+	}
+	if *output == "-" {
+		return write(context.Background(), os.Stdout)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(*output), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(context.Background(), f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), *output)
+}
+
+// restoreCommand verifies an archive and restores it into the storage
+func restoreCommand(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	spec := flags.String("storage", "", "storage to restore into instead of the configured one")
+	locks := flags.Bool("locks", false, "also restore the locks held at backup time")
+	verifyOnly := flags.Bool("verify", false, "only verify the archive")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [flags] <archive>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if *verifyOnly {
+		manifest, err := backup.Verify(f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Archive of %s is intact, %d entries\n", manifest.CreatedAt.Format(time.RFC3339), len(manifest.Entries))
+		return nil
+	}
+
+	s, err := openCommandStorage(*spec, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open storage: %w", err)
+	}
+	defer closeStorage(s)
+
+	result, err := backup.Restore(context.Background(), f, s, backup.RestoreOptions{Locks: *locks})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d states, %d previous versions, %d workspace metadata and %d locks\n",
+		result.States, result.Versions, result.Meta, result.Locks)
+	if len(result.Tokens) > 0 {
+		fmt.Printf("The archive holds %d tokens; restore through the admin API to bring them back\n", len(result.Tokens))
+	}
+	return nil
+}
@@ -2,18 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/c4po/terrastate/internal/api/handlers"
+	"github.com/c4po/terrastate/internal/audit"
+	"github.com/c4po/terrastate/internal/backup"
+	"github.com/c4po/terrastate/internal/config"
+	"github.com/c4po/terrastate/internal/logging"
+	"github.com/c4po/terrastate/internal/metrics"
+	"github.com/c4po/terrastate/internal/ratelimit"
 	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/cache"
+	"github.com/c4po/terrastate/internal/storage/compress"
 	"github.com/c4po/terrastate/internal/storage/disk"
-	s3storage "github.com/c4po/terrastate/internal/storage/s3"
+	gitstorage "github.com/c4po/terrastate/internal/storage/git"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	"github.com/c4po/terrastate/internal/storage/replication"
+	"github.com/c4po/terrastate/internal/tracing"
 	"github.com/gorilla/mux"
 )
 
@@ -23,40 +40,157 @@ var (
 	BuildTime string = "unknown"
 )
 
-func initializeStorage() (storage.StateStorage, error) {
-	storageType := os.Getenv("STORAGE_TYPE")
+// initializeStorage opens the configured storage backend, compressing states
+// as configured
+func initializeStorage(cfg config.StorageConfig) (storage.StateStorage, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	backend, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Compression != string(compress.None) {
+		slog.Info("Compressing states", "algorithm", cfg.Compression)
+	}
+	return compress.NewCompressingStorage(backend, compress.Algorithm(cfg.Compression))
+}
 
-	switch storageType {
-	case "s3":
-		log.Println("Using S3 storage")
-		bucketName := os.Getenv("S3_BUCKET_NAME")
-		if bucketName == "" {
-			log.Fatal("S3_BUCKET_NAME environment variable is required for S3 storage")
-		}
+// newBackend connects to the configured storage backend
+func newBackend(cfg config.StorageConfig) (storage.StateStorage, error) {
+	switch cfg.Type {
+	case config.StorageS3:
+		slog.Info("Using S3 storage", "bucket", cfg.S3.Bucket, "prefix", cfg.S3.Prefix)
+		return newS3Storage(cfg.S3)
 
-		cfg, err := config.LoadDefaultConfig(context.TODO())
-		if err != nil {
-			return nil, err
-		}
+	case config.StorageGCS:
+		slog.Info("Using GCS storage", "bucket", cfg.GCS.Bucket, "prefix", cfg.GCS.Prefix)
+		return newGCSStorage(cfg.GCS.Bucket, cfg.GCS.Prefix)
+
+	case config.StorageAzure:
+		slog.Info("Using Azure Blob storage", "container", cfg.Azure.Container, "prefix", cfg.Azure.Prefix)
+		return newAzureStorage(cfg.Azure.ConnectionString, cfg.Azure.Container, cfg.Azure.Prefix)
+
+	case config.StorageEtcd:
+		slog.Info("Using etcd storage", "endpoints", cfg.Etcd.Endpoints, "prefix", cfg.Etcd.Prefix)
+		return newEtcdStorage(cfg.Etcd.Endpoints, cfg.Etcd.Prefix)
 
-		s3Client := s3.NewFromConfig(cfg)
-		log.Println("S3 client initialized, connecting to bucket", bucketName)
-		return s3storage.NewS3Storage(s3Client, bucketName), nil
+	case config.StorageGit:
+		slog.Info("Using git storage", "path", cfg.Git.Path)
+		if cfg.Git.Remote != "" {
+			slog.Info("Pushing state commits", "remote", cfg.Git.Remote)
+		}
+		return gitstorage.NewGitStorage(cfg.Git.Path, cfg.Git.Remote)
 
-	case "local":
-		log.Println("Using local storage")
-		basePath := os.Getenv("STORAGE_PATH")
-		if basePath == "" {
-			basePath = "data"
+	case config.StorageMemory:
+		slog.Info("Using memory storage")
+		if cfg.Memory.SnapshotPath == "" {
+			return memory.NewMemoryStorage(), nil
 		}
-		return disk.NewDiskStorage(basePath), nil
+		slog.Info("Memory storage snapshot file", "path", cfg.Memory.SnapshotPath)
+		return memory.NewMemoryStorageWithSnapshot(cfg.Memory.SnapshotPath)
 
 	default:
-		log.Fatalf("Unsupported storage type: %s", storageType)
-		return nil, nil
+		slog.Info("Using local storage", "path", cfg.Local.Path)
+		return disk.NewDiskStorage(cfg.Local.Path), nil
 	}
 }
 
+// initializeReplication wraps primary to copy every write to the configured
+// replica, given as for openStorage. Without a replica primary is returned as
+// is.
+func initializeReplication(primary storage.StateStorage, cfg *config.Config) (storage.StateStorage, error) {
+	spec := cfg.Replication.Replica
+	if spec == "" {
+		return primary, nil
+	}
+
+	secondary, err := openStorage(spec, cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	scheme, _, _ := strings.Cut(spec, ":")
+	secondary = metrics.NewInstrumentedStorage(tracing.NewTracedStorage(secondary, "replica-"+scheme), "replica-"+scheme)
+	mode := replication.Mode(cfg.Replication.Mode)
+	slog.Info("Replicating writes", "replica", spec, "mode", mode)
+	replicating, err := replication.NewReplicatingStorage(primary, secondary, mode, cfg.Replication.QueuePath, time.Duration(cfg.Replication.RetryInterval))
+	if err != nil {
+		return nil, err
+	}
+	metrics.RegisterReplication(replicating)
+	return replicating, nil
+}
+
+// initializeCache wraps inner with a state cache of cfg.MaxBytes, kept in
+// cfg.Path if set and in memory otherwise. Without a size inner is returned
+// as is.
+func initializeCache(inner storage.StateStorage, cfg config.CacheConfig) (storage.StateStorage, error) {
+	if cfg.MaxBytes == 0 {
+		return inner, nil
+	}
+
+	if cfg.Path == "" {
+		slog.Info("Caching states in memory", "max_bytes", cfg.MaxBytes)
+	} else {
+		slog.Info("Caching states on disk", "max_bytes", cfg.MaxBytes, "path", cfg.Path)
+	}
+	if !storage.ConditionalReads(inner) {
+		slog.Warn("The storage backend can't tell whether a cached state is current, so every read will miss the cache; only the s3, gcs and etcd backends can use it")
+	}
+	cached, err := cache.NewCachingStorage(inner, cfg.Path, cfg.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	metrics.RegisterCache(cached)
+	return cached, nil
+}
+
+// startBackupSchedule writes an archive into cfg.Dir every cfg.Interval,
+// keeping the newest cfg.Keep archives. Without a directory nothing is
+// scheduled.
+func startBackupSchedule(ctx context.Context, s storage.StateStorage, cfg config.BackupConfig) {
+	if cfg.Dir == "" {
+		return
+	}
+
+	interval := time.Duration(cfg.Interval)
+	slog.Info("Scheduling backups", "dir", cfg.Dir, "interval", interval, "keep", cfg.Keep)
+	go backup.Schedule(ctx, cfg.Dir, interval, cfg.Keep, func(ctx context.Context, w io.Writer) error {
+		_, err := backup.Write(ctx, w, s, handlers.ListTokens())
+		return err
+	})
+}
+
+// initializeTracing exports spans over OTLP when an endpoint is configured.
+// The returned function flushes the spans still buffered.
+func initializeTracing(cfg config.TracingConfig) (func(context.Context) error, error) {
+	if !cfg.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	slog.Info("Exporting traces over OTLP", "protocol", cfg.Protocol, "sample_ratio", cfg.SampleRatio)
+	return tracing.Setup(context.Background(), tracing.Config{
+		ServiceVersion: Version,
+		Endpoint:       cfg.Endpoint,
+		Protocol:       cfg.Protocol,
+		SampleRatio:    cfg.SampleRatio,
+	})
+}
+
+// initializeAudit opens the audit trail, appending to the configured file
+// when set and writing to stdout otherwise
+func initializeAudit(cfg config.AuditConfig) (*audit.Logger, error) {
+	if cfg.Path == "" {
+		return audit.NewLogger(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewLogger(f), nil
+}
+
 func versionHandler(w http.ResponseWriter, r *http.Request) {
 	versionInfo := map[string]string{
 		"version":    Version,
@@ -67,66 +201,222 @@ func versionHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(versionInfo)
 }
 
-// Logging Middleware to log each HTTP request method and details
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		startTime := time.Now()
-
-		// Log Request Details
-		log.Printf("[DEBUG] %s %s %s", r.Method, r.RequestURI, r.RemoteAddr)
+// initializeRateLimits sets up the token buckets of each class of routes.
+// Authenticated clients are limited per token and the others per IP.
+func initializeRateLimits(cfg config.RateLimitConfig) (*ratelimit.Limiter, error) {
+	return ratelimit.New(map[string]ratelimit.Rate{
+		ratelimit.Reads:  {PerSecond: cfg.ReadRate, Burst: cfg.ReadBurst},
+		ratelimit.Writes: {PerSecond: cfg.WriteRate, Burst: cfg.WriteBurst},
+		ratelimit.Locks:  {PerSecond: cfg.LockRate, Burst: cfg.LockBurst},
+		ratelimit.Login:  {PerSecond: cfg.LoginRate, Burst: cfg.LoginBurst},
+	}, cfg.TrustedProxies, handlers.RequestIdentity)
+}
 
-		// Call the next handler
-		next.ServeHTTP(w, r)
+// initializeLogging makes structured logging the default, at the configured
+// level and format. Messages from the standard log package go through it too.
+func initializeLogging(cfg config.LoggingConfig) error {
+	level, err := cfg.LogLevel()
+	if err != nil {
+		return err
+	}
+	logger, err := logging.NewLogger(os.Stderr, level, cfg.Format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
 
-		// Log Response Time
-		duration := time.Since(startTime)
-		log.Printf("[DEBUG] Completed in %v", duration)
-	})
+// fatal logs msg with err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	cfg, err := config.Load("terrastate", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Failed to load configuration", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		fatal("Invalid configuration", err)
+	}
+	if err := initializeLogging(cfg.Logging); err != nil {
+		fatal("Failed to initialize logging", err)
+	}
+
+	shutdownTracing, err := initializeTracing(cfg.Tracing)
+	if err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
+
 	// Initialize storage backend
-	storage, err := initializeStorage()
+	storage, err := initializeStorage(cfg.Storage)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage: %v", err)
+		fatal("Failed to initialize storage", err)
+	}
+	if compressing, ok := storage.(*compress.CompressingStorage); ok && compressing.Algorithm() != compress.None {
+		metrics.RegisterCompression(compressing)
+	}
+	storage = tracing.NewTracedStorage(storage, cfg.Storage.Type)
+	storage = metrics.NewInstrumentedStorage(storage, cfg.Storage.Type)
+	if storage, err = initializeReplication(storage, cfg); err != nil {
+		fatal("Failed to initialize replication", err)
+	}
+	if storage, err = initializeCache(storage, cfg.Cache); err != nil {
+		fatal("Failed to initialize state cache", err)
 	}
 
+	auditLog, err := initializeAudit(cfg.Audit)
+	if err != nil {
+		fatal("Failed to open audit log", err)
+	}
+
+	for _, token := range cfg.Auth.AdminTokens {
+		handlers.RegisterToken(token, "admin", handlers.ScopeAdmin, handlers.ScopeState)
+	}
+
+	// Signals end the backup schedule and start the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	startBackupSchedule(ctx, storage, cfg.Backup)
+
+	metrics.RegisterStateCollector(storage, func() int { return len(handlers.ListTokens()) })
+
 	// Initialize handlers
-	stateHandler := handlers.NewStateHandler(storage)
+	stateHandler := handlers.NewStateHandler(storage, auditLog, cfg.State.ProtectedWorkspaces, time.Duration(cfg.State.LockTTL))
+	adminHandler := handlers.NewAdminHandler(storage, auditLog)
 	discoveryHandler := handlers.NewDiscoveryHandler()
 	loginHandler := handlers.NewLoginHandler()
 
+	healthHandler := handlers.NewHealthHandler(storage, time.Duration(cfg.Server.ReadinessCacheTTL))
+
+	limiter, err := initializeRateLimits(cfg.RateLimit)
+	if err != nil {
+		fatal("Failed to initialize rate limits", err)
+	}
+	metrics.RegisterRateLimits(limiter)
+
 	// Setup router
 	r := mux.NewRouter()
+	maxRequest := cfg.Limits.MaxRequestBytes
 
-	// Logging middleware
-	r.Use(loggingMiddleware)
+	// Trace spans, request IDs and request logging
+	r.Use(tracing.Middleware)
+	r.Use(logging.Middleware)
+	r.Use(metrics.Middleware)
+	// Names reserved by the backends never reach them
+	r.Use(handlers.ValidateNames)
 
 	// Discovery endpoint
 	r.HandleFunc("/.well-known/terraform.json", discoveryHandler.GetDiscovery).Methods("GET")
 
-	r.HandleFunc("/login", loginHandler.TerraformLogin).Methods("GET")
-	r.HandleFunc("/app/settings/tokens", loginHandler.Tokens).Methods("GET")
-	r.HandleFunc("/app/settings/tokens/create", loginHandler.CreateToken).Methods("POST")
+	r.HandleFunc("/login", limiter.Limit(ratelimit.Login, loginHandler.TerraformLogin)).Methods("GET")
+	r.HandleFunc("/app/settings/tokens", limiter.Limit(ratelimit.Login, loginHandler.Tokens)).Methods("GET")
+	r.HandleFunc("/app/settings/tokens/create", limiter.Limit(ratelimit.Login, handlers.LimitBody(maxRequest, loginHandler.CreateToken))).Methods("POST")
 
-	// State endpoints
-	r.HandleFunc("/state/{workspace}/{id}", stateHandler.GetState).Methods("GET")
-	r.HandleFunc("/state/{workspace}/{id}", stateHandler.PutState).Methods("PUT")
-	r.HandleFunc("/state/{workspace}/{id}", stateHandler.DeleteState).Methods("DELETE")
-	r.HandleFunc("/state/{workspace}", stateHandler.ListStates).Methods("GET")
+	// State endpoints, with gzip bodies for clients that ask for them
+	r.HandleFunc("/state/{workspace}/{id}", limiter.Limit(ratelimit.Reads, handlers.Gzip(stateHandler.GetState))).Methods("GET")
+	r.HandleFunc("/state/{workspace}/{id}", limiter.Limit(ratelimit.Writes, handlers.Gzip(handlers.LimitBody(cfg.Limits.MaxStateBytes, stateHandler.PutState)))).Methods("PUT")
+	r.HandleFunc("/state/{workspace}/{id}", limiter.Limit(ratelimit.Writes, stateHandler.DeleteState)).Methods("DELETE")
+	r.HandleFunc("/state/{workspace}", limiter.Limit(ratelimit.Reads, handlers.Gzip(stateHandler.ListStates))).Methods("GET")
+	r.HandleFunc("/state/{workspace}/{id}/versions", limiter.Limit(ratelimit.Reads, handlers.Gzip(stateHandler.ListStateVersions))).Methods("GET")
+	r.HandleFunc("/state/{workspace}/{id}/versions/{version}", limiter.Limit(ratelimit.Reads, handlers.Gzip(stateHandler.GetStateVersion))).Methods("GET")
 
 	// Lock endpoints
-	r.HandleFunc("/lock/{workspace}/{id}", stateHandler.Lock).Methods("POST")
-	r.HandleFunc("/lock/{workspace}/{id}", stateHandler.Unlock).Methods("DELETE")
+	r.HandleFunc("/lock/{workspace}/{id}", limiter.Limit(ratelimit.Locks, handlers.LimitBody(maxRequest, stateHandler.Lock))).Methods("POST")
+	r.HandleFunc("/lock/{workspace}/{id}", limiter.Limit(ratelimit.Locks, handlers.LimitBody(maxRequest, stateHandler.Unlock))).Methods("DELETE")
+	r.HandleFunc("/lock/{workspace}/{id}", limiter.Limit(ratelimit.Reads, stateHandler.GetLock)).Methods("GET")
+	r.HandleFunc("/lock/{workspace}/{id}/renew", limiter.Limit(ratelimit.Locks, handlers.LimitBody(maxRequest, stateHandler.RenewLock))).Methods("POST")
+	r.HandleFunc("/locks", limiter.Limit(ratelimit.Reads, stateHandler.ListLocks)).Methods("GET")
+
+	// Admin endpoints
+	r.HandleFunc("/admin/workspaces/{workspace}", adminHandler.GetWorkspace).Methods("GET")
+	r.HandleFunc("/admin/workspaces/{workspace}", limiter.Limit(ratelimit.Writes, handlers.LimitBody(maxRequest, adminHandler.PutWorkspace))).Methods("PUT")
+	r.HandleFunc("/admin/locks/{workspace}/{id}", limiter.Limit(ratelimit.Locks, handlers.LimitBody(maxRequest, stateHandler.ForceUnlock))).Methods("DELETE")
+	r.HandleFunc("/admin/cache", adminHandler.GetCacheStats).Methods("GET")
+	r.HandleFunc("/admin/replication", adminHandler.GetReplication).Methods("GET")
+	r.HandleFunc("/admin/backup", adminHandler.GetBackup).Methods("GET")
+	r.HandleFunc("/admin/restore", limiter.Limit(ratelimit.Writes, handlers.LimitBody(cfg.Limits.MaxArchiveBytes, adminHandler.PostRestore))).Methods("POST")
+
+	// Probes
+	r.HandleFunc("/healthz", healthHandler.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", healthHandler.Readyz).Methods("GET")
 
 	// Version endpoint
 	r.HandleFunc("/version", versionHandler).Methods("GET")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	// Prometheus metrics
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
+
+	limits := cfg.Limits
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: time.Duration(limits.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(limits.ReadTimeout),
+		WriteTimeout:      time.Duration(limits.WriteTimeout),
+		IdleTimeout:       time.Duration(limits.IdleTimeout),
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
 	}
 
-	log.Printf("Starting server on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	go func() {
+		var err error
+		if cfg.TLS.CertFile != "" {
+			minVersion, _ := cfg.TLS.TLSVersion()
+			server.TLSConfig = &tls.Config{MinVersion: minVersion}
+			slog.Info("Starting server", "port", cfg.Server.Port, "tls", true)
+			err = server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			slog.Info("Starting server", "port", cfg.Server.Port)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", err)
+		}
+	}()
+
+	// On a signal, fail readiness and wait the shutdown delay for load
+	// balancers to notice, then stop accepting connections and give in-flight
+	// requests up to the shutdown timeout to finish. The storage is closed and
+	// the audit trail and traces flushed once no request can use them anymore.
+	<-ctx.Done()
+	// A second signal kills the server right away
+	stop()
+	shutdownDelay, shutdownTimeout := time.Duration(cfg.Server.ShutdownDelay), time.Duration(cfg.Server.ShutdownTimeout)
+	slog.Info("Shutting down", "delay", shutdownDelay, "timeout", shutdownTimeout)
+	healthHandler.Drain()
+	time.Sleep(shutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Error("Requests still running at the shutdown deadline, closing their connections", "error", err)
+		server.Close()
+	}
+
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Failed to close storage", "error", err)
+		}
+	}
+	if err := auditLog.Flush(); err != nil {
+		slog.Error("Failed to flush audit log", "error", err)
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	slog.Info("Server stopped")
 }
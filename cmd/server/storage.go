@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	gcstorage "cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/c4po/terrastate/internal/config"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/azure"
+	"github.com/c4po/terrastate/internal/storage/compress"
+	"github.com/c4po/terrastate/internal/storage/disk"
+	etcdstorage "github.com/c4po/terrastate/internal/storage/etcd"
+	"github.com/c4po/terrastate/internal/storage/gcs"
+	gitstorage "github.com/c4po/terrastate/internal/storage/git"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	s3storage "github.com/c4po/terrastate/internal/storage/s3"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+)
+
+// newS3Client connects to AWS, or to the S3 compatible store at cfg.Endpoint,
+// with the credentials from the AWS environment
+func newS3Client(cfg config.S3Config) (*s3.Client, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Trace every S3 request as a child of the storage call making it
+	otelaws.AppendMiddlewares(&awsCfg.APIOptions)
+
+	return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	}), nil
+}
+
+func newS3Storage(cfg config.S3Config) (storage.StateStorage, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("S3 client initialized", "bucket", cfg.Bucket, "endpoint", cfg.Endpoint, "region", client.Options().Region)
+	return s3storage.NewS3StorageWithOptions(client, cfg.Bucket, cfg.Prefix, s3storage.Options{
+		ServerSideEncryption: types.ServerSideEncryption(cfg.SSE),
+		KMSKeyID:             cfg.KMSKeyID,
+		StorageClass:         types.StorageClass(cfg.StorageClass),
+		ACL:                  types.ObjectCannedACL(cfg.ACL),
+		Tags:                 cfg.TagMap(),
+		TagStates:            cfg.TagStates,
+	}), nil
+}
+
+func newGCSStorage(bucketName, prefix string) (storage.StateStorage, error) {
+	client, err := gcstorage.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("GCS client initialized", "bucket", bucketName)
+	return gcs.NewGCSStorage(client, bucketName, prefix), nil
+}
+
+func newAzureStorage(connectionString, containerName, prefix string) (storage.StateStorage, error) {
+	if connectionString == "" {
+		return nil, fmt.Errorf("an Azure Storage connection string is required for Azure storage")
+	}
+
+	client, err := container.NewClientFromConnectionString(connectionString, containerName, nil)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Azure client initialized", "container", containerName)
+	return azure.NewAzureStorage(client, prefix), nil
+}
+
+func newEtcdStorage(endpoints []string, prefix string) (storage.StateStorage, error) {
+	if prefix == "" {
+		prefix = "terrastate"
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("etcd client initialized", "endpoints", endpoints)
+	return etcdstorage.NewEtcdStorage(client, prefix), nil
+}
+
+// openStorage opens the backend described by spec, which is one of
+//
+//	disk:<path>                      (or local:<path>)
+//	memory:[<snapshot path>]
+//	git:<repository path>
+//	s3://<bucket>[/<prefix>]
+//	gcs://<bucket>[/<prefix>]
+//	azure://<container>[/<prefix>]
+//	etcd://<endpoint>[,<endpoint>...][/<prefix>]
+//
+// Credentials come from the same environment as for the main backend, and the
+// Azure connection string, the S3 endpoint and object settings and the
+// compression of states from its configuration.
+func openStorage(spec string, cfg config.StorageConfig) (storage.StateStorage, error) {
+	backend, err := openBackend(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return compress.NewCompressingStorage(backend, compress.Algorithm(cfg.Compression))
+}
+
+// openBackend connects to the storage backend described by spec
+func openBackend(spec string, cfg config.StorageConfig) (storage.StateStorage, error) {
+	scheme, location, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid storage %q: expected <type>:<location>", spec)
+	}
+
+	switch scheme {
+	case "disk", "local":
+		if location == "" {
+			return nil, fmt.Errorf("invalid storage %q: missing path", spec)
+		}
+		return disk.NewDiskStorage(location), nil
+
+	case "memory":
+		if location == "" {
+			return memory.NewMemoryStorage(), nil
+		}
+		return memory.NewMemoryStorageWithSnapshot(location)
+
+	case "git":
+		if location == "" {
+			return nil, fmt.Errorf("invalid storage %q: missing path", spec)
+		}
+		return gitstorage.NewGitStorage(location, "")
+
+	case "s3", "gcs", "azure", "etcd":
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage %q: %w", spec, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid storage %q: missing bucket", spec)
+		}
+		prefix := strings.Trim(u.Path, "/")
+
+		switch scheme {
+		case "s3":
+			s3cfg := cfg.S3
+			s3cfg.Bucket, s3cfg.Prefix = u.Host, prefix
+			return newS3Storage(s3cfg)
+		case "gcs":
+			return newGCSStorage(u.Host, prefix)
+		case "azure":
+			return newAzureStorage(cfg.Azure.ConnectionString, u.Host, prefix)
+		default:
+			return newEtcdStorage(strings.Split(u.Host, ","), prefix)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported storage type %q", scheme)
+	}
+}
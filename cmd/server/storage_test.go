@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/backup"
+	"github.com/c4po/terrastate/internal/config"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/migrate"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+// TestCommandsThroughOpenStorage backs up and migrates states of backends
+// opened like the commands open them, wrapped for compression, with and
+// without history
+func TestCommandsThroughOpenStorage(t *testing.T) {
+	// Specs are formatted with a new directory for every store
+	specs := []string{"disk:%s", "memory:%.0s"}
+	if _, err := exec.LookPath("git"); err == nil {
+		specs = append(specs, "git:%s")
+	}
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		for _, spec := range specs {
+			backend, _, _ := strings.Cut(spec, ":")
+			t.Run(compression+"/"+backend, func(t *testing.T) {
+				ctx := context.Background()
+				cfg := config.Default().Storage
+				cfg.Compression = compression
+				open := func() storage.StateStorage {
+					s, err := openStorage(fmt.Sprintf(spec, filepath.Join(t.TempDir(), "store")), cfg)
+					if err != nil {
+						t.Fatalf("openStorage: %v", err)
+					}
+					return s
+				}
+
+				from := open()
+				storagetest.PutSerials(t, from, "ws", "a", 3)
+
+				var archive bytes.Buffer
+				if _, err := backup.Write(ctx, &archive, from, nil); err != nil {
+					t.Fatalf("backup: %v", err)
+				}
+				restored := open()
+				if _, err := backup.Restore(ctx, bytes.NewReader(archive.Bytes()), restored, backup.RestoreOptions{}); err != nil {
+					t.Fatalf("restore: %v", err)
+				}
+
+				to := open()
+				plan, err := migrate.NewPlan(ctx, from, to)
+				if err != nil {
+					t.Fatalf("migrate plan: %v", err)
+				}
+				if err := migrate.Run(ctx, from, to, plan, nil); err != nil {
+					t.Fatalf("migrate: %v", err)
+				}
+
+				for name, s := range map[string]storage.StateStorage{"restored": restored, "migrated": to} {
+					state, err := s.GetState(ctx, "ws", "a")
+					if err != nil || string(state.State) != `{"serial":3}` {
+						t.Errorf("%s state = %v, %v, want serial 3", name, state, err)
+					}
+				}
+			})
+		}
+	}
+}
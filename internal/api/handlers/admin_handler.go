@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/c4po/terrastate/internal/audit"
+	"github.com/c4po/terrastate/internal/backup"
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/cache"
+	"github.com/c4po/terrastate/internal/storage/replication"
+	"github.com/gorilla/mux"
+)
+
+type AdminHandler struct {
+	storage storage.StateStorage
+	audit   *audit.Logger
+}
+
+func NewAdminHandler(storage storage.StateStorage, auditLog *audit.Logger) *AdminHandler {
+	return &AdminHandler{storage: storage, audit: auditLog}
+}
+
+// requireAdmin rejects requests that do not carry an admin token
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !hasScope(r, ScopeAdmin) {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *AdminHandler) GetWorkspace(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	workspace := mux.Vars(r)["workspace"]
+
+	meta, err := h.storage.GetWorkspaceMeta(r.Context(), workspace)
+	if errors.Is(err, storage.ErrNotFound) {
+		meta = &models.WorkspaceMeta{Workspace: workspace}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta)
+}
+
+func (h *AdminHandler) PutWorkspace(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	workspace := mux.Vars(r)["workspace"]
+
+	var meta models.WorkspaceMeta
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	meta.Workspace = workspace
+	meta.UpdatedAt = time.Now().UTC()
+
+	if err := h.storage.PutWorkspaceMeta(r.Context(), &meta); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionProtection,
+		Workspace:  workspace,
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Details:    fmt.Sprintf("protected=%t", meta.Protected),
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetCacheStats reports the hit and miss counts and size of the state cache
+func (h *AdminHandler) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	cached, ok := storage.As[*cache.CachingStorage](h.storage)
+	if !ok {
+		http.Error(w, "state cache is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cached.Stats())
+}
+
+// GetReplication reports the replication lag and queued copies. With
+// ?divergence=true it also compares primary and secondary, limited to one
+// workspace with ?workspace=.
+func (h *AdminHandler) GetReplication(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	replicating, ok := storage.As[*replication.ReplicatingStorage](h.storage)
+	if !ok {
+		http.Error(w, "replication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	status := replicating.Status()
+	if r.URL.Query().Get("divergence") == "true" {
+		divergence, err := replicating.Diff(r.Context(), r.URL.Query().Get("workspace"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status.Divergence = divergence
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// GetBackup streams an archive of every state, version, lock, workspace
+// metadata and token. A failure midway aborts the response, which leaves the
+// archive without its manifest so it can't be restored by mistake.
+func (h *AdminHandler) GetBackup(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	// Archives of large backends take longer than the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backup.ArchiveName(time.Now())))
+	manifest, err := backup.Write(r.Context(), w, h.storage, ListTokens())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Backup failed", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionBackup,
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Details:    fmt.Sprintf("%d entries", len(manifest.Entries)),
+	})
+}
+
+// PostRestore restores an archive sent as the request body, overwriting the
+// states it contains. It must be confirmed with the header
+// X-Terrastate-Confirm: restore. Locks are only restored with ?locks=true.
+func (h *AdminHandler) PostRestore(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Header.Get(ConfirmHeader) != "restore" {
+		http.Error(w, fmt.Sprintf("restoring a backup requires the header %s: restore", ConfirmHeader), http.StatusForbidden)
+		return
+	}
+
+	// Archives of large backends take longer than the server's read timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	// The archive is read twice, to verify it before anything is written
+	f, err := os.CreateTemp("", "terrastate-restore-*")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r.Body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	opts := backup.RestoreOptions{Locks: r.URL.Query().Get("locks") == "true"}
+	result, err := backup.Restore(r.Context(), f, h.storage, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	for _, token := range result.Tokens {
+		RestoreToken(token)
+	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionRestore,
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Details:    fmt.Sprintf("%d states, %d versions, %d tokens", result.States, result.Versions, len(result.Tokens)),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -1,22 +1,114 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+)
+
+// Token scopes
+const (
+	ScopeState = "state"
+	ScopeAdmin = "admin"
 )
 
 var (
-	tokens = make(map[string]bool)
+	tokensMu sync.RWMutex
+	tokens   = make(map[string]*models.Token)
 )
 
+// RegisterToken makes token valid for the given subject and scopes
+func RegisterToken(token, subject string, scopes ...string) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	tokens[token] = &models.Token{
+		Token:     token,
+		Subject:   subject,
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+}
+
+// ListTokens returns copies of every registered token
+func ListTokens() []models.Token {
+	tokensMu.RLock()
+	defer tokensMu.RUnlock()
+	list := make([]models.Token, 0, len(tokens))
+	for _, token := range tokens {
+		list = append(list, *token)
+	}
+	slices.SortFunc(list, func(a, b models.Token) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return list
+}
+
+// RestoreToken registers a token as it was saved, keeping its creation time
+func RestoreToken(token models.Token) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	tokens[token.Token] = &token
+}
+
+func lookupToken(token string) *models.Token {
+	tokensMu.RLock()
+	defer tokensMu.RUnlock()
+	return tokens[token]
+}
+
+// requestToken returns the token presented with the request, accepting a raw
+// token, a bearer token, or the password of HTTP basic auth as used by the
+// Terraform http backend.
+func requestToken(r *http.Request) *models.Token {
+	if _, password, ok := r.BasicAuth(); ok {
+		return lookupToken(password)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil
+	}
+	return lookupToken(strings.TrimPrefix(header, "Bearer "))
+}
+
+// hasScope reports whether the request carries a valid token with scope
+func hasScope(r *http.Request, scope string) bool {
+	token := requestToken(r)
+	return token != nil && slices.Contains(token.Scopes, scope)
+}
+
+// actor returns a description of who made the request for audit records
+func actor(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return token.Subject
+	}
+	return "anonymous"
+}
+
+// RequestIdentity identifies the valid token of the request for rate limits,
+// without exposing it, and is empty for anonymous requests
+func RequestIdentity(r *http.Request) string {
+	token := requestToken(r)
+	if token == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token.Token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token == "" {
+		if r.Header.Get("Authorization") == "" {
 			http.Error(w, "No token provided", http.StatusUnauthorized)
 			return
 		}
 
-		if !tokens[token] {
+		if requestToken(r) == nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
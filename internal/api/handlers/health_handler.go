@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// checkTimeout bounds a single readiness check
+const checkTimeout = 5 * time.Second
+
+// CheckResult is the outcome of one readiness check. /readyz is served
+// without authentication, so why a check failed is only logged.
+type CheckResult struct {
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Readiness is the body of /readyz
+type Readiness struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// HealthHandler serves the liveness and readiness probes. Readiness checks
+// reach the storage backend, so their result is reused for cacheTTL to keep
+// frequent probes from loading the backend.
+type HealthHandler struct {
+	checks   map[string]func(context.Context) error
+	cacheTTL time.Duration
+	draining atomic.Bool
+
+	mu   sync.Mutex
+	last *Readiness
+}
+
+// NewHealthHandler checks the storage backend with its Ping method, or by
+// listing the workspaces if it has none
+func NewHealthHandler(s storage.StateStorage, cacheTTL time.Duration) *HealthHandler {
+	check := func(ctx context.Context) error {
+		_, err := s.ListWorkspaces(ctx)
+		return err
+	}
+	if pinger, ok := storage.As[storage.Pinger](s); ok {
+		check = pinger.Ping
+	}
+	return &HealthHandler{
+		checks:   map[string]func(context.Context) error{"storage": check},
+		cacheTTL: cacheTTL,
+	}
+}
+
+// Healthz reports that the server is up and serving requests
+func (h *HealthHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Drain makes readiness fail from now on, so that load balancers stop
+// sending requests to a server that is shutting down
+func (h *HealthHandler) Drain() {
+	h.draining.Store(true)
+}
+
+// Readyz reports whether the server can serve states, with the result of
+// every check. It answers 503 if any check failed or the server is draining.
+func (h *HealthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	readiness := &Readiness{Status: "draining", CheckedAt: time.Now().UTC()}
+	if !h.draining.Load() {
+		readiness = h.readiness(r.Context())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if readiness.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
+
+// readiness returns the cached result if it is recent enough and runs the
+// checks otherwise. Concurrent probes wait for the same run.
+func (h *HealthHandler) readiness(ctx context.Context) *Readiness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.last != nil && time.Since(h.last.CheckedAt) < h.cacheTTL {
+		return h.last
+	}
+
+	// A probe that gives up must not cut the checks short for the ones
+	// waiting on it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkTimeout)
+	defer cancel()
+
+	readiness := &Readiness{
+		Status:    "ok",
+		CheckedAt: time.Now().UTC(),
+		Checks:    make(map[string]CheckResult, len(h.checks)),
+	}
+	for name, check := range h.checks {
+		start := time.Now()
+		err := check(ctx)
+		result := CheckResult{Status: "ok", DurationMS: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			slog.ErrorContext(ctx, "Readiness check failed", "check", name, "error", err)
+			result.Status = "failed"
+			readiness.Status = "unavailable"
+		}
+		readiness.Checks[name] = result
+	}
+
+	h.last = readiness
+	return readiness
+}
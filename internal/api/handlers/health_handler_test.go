@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+)
+
+// unreachableStorage fails every workspace listing with an error naming the
+// backend's address
+type unreachableStorage struct {
+	storage.StateStorage
+}
+
+func (s *unreachableStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	return nil, errors.New("dial tcp 10.0.0.12:2379: connection refused")
+}
+
+func TestReadyzHidesErrors(t *testing.T) {
+	h := NewHealthHandler(&unreachableStorage{memory.NewMemoryStorage()}, 0)
+	w := httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz = %d, want 503", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "10.0.0.12") {
+		t.Errorf("Readyz body %s shows the backend error", w.Body)
+	}
+	var readiness Readiness
+	if err := json.Unmarshal(w.Body.Bytes(), &readiness); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if readiness.Status != "unavailable" || readiness.Checks["storage"].Status != "failed" {
+		t.Errorf("Readyz = %+v, want the storage check failed", readiness)
+	}
+}
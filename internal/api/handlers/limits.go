@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// stateHeaderPeek is how much of an uploaded state is looked at to find its
+// serial and lineage, which Terraform writes at the top of the document
+const stateHeaderPeek = 64 << 10
+
+// LimitBody refuses request bodies of more than maxBytes with 413. A zero
+// maxBytes leaves the body unlimited.
+func LimitBody(maxBytes int64, next http.HandlerFunc) http.HandlerFunc {
+	if maxBytes <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			http.Error(w, fmt.Sprintf("request body is larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next(w, r)
+	}
+}
+
+// isTooLarge reports whether err comes from reading past the body limit
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// writeBodyError answers a request whose body could not be read or decoded
+func writeBodyError(w http.ResponseWriter, err error) {
+	if isTooLarge(err) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// peekStateHeader reads the serial and lineage of the state document at the
+// start of body without consuming it. body must buffer stateHeaderPeek bytes.
+// ok is false if the body isn't a JSON object or the fields aren't found in
+// the buffered part.
+func peekStateHeader(body *bufio.Reader) (header stateHeader, ok bool, err error) {
+	prefix, err := body.Peek(stateHeaderPeek)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return header, false, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(prefix))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return header, false, nil
+	}
+	var haveSerial, haveLineage bool
+	for !haveSerial || !haveLineage {
+		if !dec.More() {
+			// At the end of the document absent fields are zero; at the end of
+			// the buffered part they are unknown
+			tok, err := dec.Token()
+			return header, err == nil && tok == json.Delim('}'), nil
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return header, false, nil
+		}
+		var value any = &json.RawMessage{}
+		switch tok {
+		case "serial":
+			value, haveSerial = &header.Serial, true
+		case "lineage":
+			value, haveLineage = &header.Lineage, true
+		}
+		if err := dec.Decode(value); err != nil {
+			return header, false, nil
+		}
+	}
+	return header, true, nil
+}
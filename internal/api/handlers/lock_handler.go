@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/c4po/terrastate/internal/audit"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// ListLocks reports every held lock. The optional workspace query parameter
+// limits the listing to one workspace, and min_age and max_age (durations
+// such as 30m) to locks of a given age. Locks whose lease ran out are
+// released instead of listed.
+func (h *StateHandler) ListLocks(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	minAge, err := parseAge(query.Get("min_age"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxAge, err := parseAge(query.Get("max_age"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	locks, err := h.storage.ListLocks(r.Context(), query.Get("workspace"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	statuses := []lockStatus{}
+	for i := range locks {
+		lock := &locks[i]
+		if lock.Expired(now) {
+			// A lock taken since by another client shows up in the next listing
+			if err := h.expireLock(r, lock.Workspace, lock.StateID, lock); err != nil && !errors.Is(err, storage.ErrLocked) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			continue
+		}
+
+		age := now.Sub(lock.Created)
+		if age < minAge || (maxAge > 0 && age > maxAge) {
+			continue
+		}
+		statuses = append(statuses, newLockStatus(lock, now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// ForceUnlock lets an admin release a lock held by someone else. The request
+// body must state a reason, which is kept in the audit trail.
+func (h *StateHandler) ForceUnlock(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	workspace, id := vars["workspace"], vars["id"]
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" {
+		http.Error(w, "a reason is required to force-unlock a state", http.StatusBadRequest)
+		return
+	}
+
+	current, err := h.storage.GetLock(r.Context(), workspace, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "state is not locked", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !h.authorizeOverride(w, r, workspace, "force-unlocking a state") {
+		return
+	}
+
+	if !h.unlockIfMatch(w, r, workspace, id, current) {
+		return
+	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionForceUnlock,
+		Workspace:  workspace,
+		ID:         id,
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Details: fmt.Sprintf("lock %s held by %s for %s: %s",
+			current.ID, current.Who, current.Operation, request.Reason),
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseAge parses an optional age filter
+func parseAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q: must be a non-negative duration", value)
+	}
+	return age, nil
+}
@@ -3,10 +3,14 @@ package handlers
 import (
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/c4po/terrastate/internal/logging"
 	"github.com/c4po/terrastate/internal/models"
 	"github.com/c4po/terrastate/internal/templates"
 	"github.com/c4po/terrastate/internal/utils"
@@ -14,10 +18,54 @@ import (
 
 type LoginHandler struct{}
 
+// Login codes expire after codeTTL, and at most maxPendingCodes are kept so
+// that repeated logins can't exhaust memory
+const (
+	codeTTL         = 15 * time.Minute
+	maxPendingCodes = 10000
+)
+
 var (
+	pendingMu     sync.Mutex
 	pendingTokens = make(map[string]*models.TokenRequest)
 )
 
+// addPendingCode records a new login code, dropping the expired ones first.
+// If too many codes are pending it returns false and how long until the
+// oldest one expires.
+func addPendingCode(code string) (time.Duration, bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	now := time.Now()
+	if len(pendingTokens) >= maxPendingCodes {
+		oldest := now
+		for c, request := range pendingTokens {
+			if now.Sub(request.CreatedAt) > codeTTL {
+				delete(pendingTokens, c)
+			} else if request.CreatedAt.Before(oldest) {
+				oldest = request.CreatedAt
+			}
+		}
+		if len(pendingTokens) >= maxPendingCodes {
+			return oldest.Add(codeTTL).Sub(now), false
+		}
+	}
+	pendingTokens[code] = &models.TokenRequest{
+		Code:      code,
+		CreatedAt: now,
+	}
+	return 0, true
+}
+
+// takePendingCode removes code and returns its request if it existed
+func takePendingCode(code string) (*models.TokenRequest, bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	request, exists := pendingTokens[code]
+	delete(pendingTokens, code)
+	return request, exists
+}
+
 func NewLoginHandler() *LoginHandler {
 	return &LoginHandler{}
 }
@@ -29,12 +77,13 @@ func (h *LoginHandler) TerraformLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Generated code: %s", code)
-
-	pendingTokens[code] = &models.TokenRequest{
-		Code:      code,
-		CreatedAt: time.Now(),
+	if retryAfter, ok := addPendingCode(code); !ok {
+		slog.WarnContext(r.Context(), "Too many pending login codes")
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1)))
+		http.Error(w, "Too many pending logins", http.StatusTooManyRequests)
+		return
 	}
+	slog.InfoContext(r.Context(), "Generated login code", "code", logging.Secret(code))
 
 	redirectURL := fmt.Sprintf("https://%s/app/settings/tokens?source=terraform-login&code=%s",
 		r.Host, code)
@@ -67,7 +116,7 @@ func (h *LoginHandler) Tokens(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *LoginHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Creating token")
+	slog.DebugContext(r.Context(), "Creating token")
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -79,14 +128,13 @@ func (h *LoginHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	request, exists := pendingTokens[code]
+	request, exists := takePendingCode(code)
 	if !exists {
 		http.Error(w, "Invalid code", http.StatusBadRequest)
 		return
 	}
 
-	if time.Since(request.CreatedAt) > 15*time.Minute {
-		delete(pendingTokens, code)
+	if time.Since(request.CreatedAt) > codeTTL {
 		http.Error(w, "Code has expired", http.StatusBadRequest)
 		return
 	}
@@ -97,8 +145,7 @@ func (h *LoginHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokens[token] = true
-	delete(pendingTokens, code)
+	RegisterToken(token, "terraform-login", ScopeState)
 
 	data := struct {
 		Code  string
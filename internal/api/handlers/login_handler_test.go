@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+)
+
+func TestLoginRetryAfterOldestCode(t *testing.T) {
+	pendingMu.Lock()
+	saved := pendingTokens
+	pendingTokens = make(map[string]*models.TokenRequest, maxPendingCodes)
+	now := time.Now()
+	for i := range maxPendingCodes {
+		// The oldest code expires in five minutes
+		created := now.Add(-codeTTL + 5*time.Minute + time.Duration(i)*time.Millisecond)
+		pendingTokens[strconv.Itoa(i)] = &models.TokenRequest{CreatedAt: created}
+	}
+	pendingMu.Unlock()
+	t.Cleanup(func() {
+		pendingMu.Lock()
+		pendingTokens = saved
+		pendingMu.Unlock()
+	})
+
+	w := httptest.NewRecorder()
+	NewLoginHandler().TerraformLogin(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After = %s, want 300", got)
+	}
+
+	// Once expired codes make room, logins go through again
+	pendingMu.Lock()
+	pendingTokens["0"].CreatedAt = now.Add(-codeTTL - time.Second)
+	pendingMu.Unlock()
+	w = httptest.NewRecorder()
+	NewLoginHandler().TerraformLogin(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("status = %d, want 307", w.Code)
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+// ValidateNames refuses requests whose workspace or state name, in the path
+// or in the workspace query parameter, is reserved by the storage backends,
+// so that no backend ever sees one
+func ValidateNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, name := range []string{vars["workspace"], vars["id"], r.URL.Query().Get("workspace")} {
+			if name == "" {
+				continue
+			}
+			if err := storage.ValidateName(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
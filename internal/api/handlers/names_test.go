@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidateNames(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(ValidateNames)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r.HandleFunc("/state/{workspace}/{id}", ok)
+	r.HandleFunc("/locks", ok)
+
+	for _, tc := range []struct {
+		method, target string
+		want           int
+	}{
+		{"PUT", "/state/prod/network", http.StatusOK},
+		{"PUT", "/state/.git/config", http.StatusBadRequest},
+		{"PUT", "/state/prod/.workspace.json", http.StatusBadRequest},
+		{"GET", "/state/.locks/x", http.StatusBadRequest},
+		{"GET", "/state/prod/.terrastate-health", http.StatusBadRequest},
+		{"GET", "/locks", http.StatusOK},
+		{"GET", "/locks?workspace=prod", http.StatusOK},
+		{"GET", "/locks?workspace=.git", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader("{}")))
+		if w.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// ConfirmHeader carries the workspace name, typed out by the operator, to
+// confirm an override on a protected workspace
+const ConfirmHeader = "X-Terrastate-Confirm"
+
+// isProtected reports whether workspace is protected. Workspace metadata
+// takes precedence; workspaces without metadata fall back to the default
+// name patterns.
+func (h *StateHandler) isProtected(ctx context.Context, workspace string) (bool, error) {
+	meta, err := h.storage.GetWorkspaceMeta(ctx, workspace)
+	if err == nil {
+		return meta.Protected, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+
+	for _, pattern := range h.protectedPatterns {
+		if ok, _ := path.Match(pattern, workspace); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorizeOverride checks that an operation bypassing a safety check is
+// allowed. On protected workspaces it requires an admin token and the
+// confirmation header; otherwise it writes the refusal and returns false.
+func (h *StateHandler) authorizeOverride(w http.ResponseWriter, r *http.Request, workspace, operation string) bool {
+	protected, err := h.isProtected(r.Context(), workspace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !protected {
+		return true
+	}
+
+	if !hasScope(r, ScopeAdmin) {
+		http.Error(w, fmt.Sprintf("workspace %q is protected: %s requires an admin token", workspace, operation), http.StatusForbidden)
+		return false
+	}
+	if r.Header.Get(ConfirmHeader) != workspace {
+		http.Error(w, fmt.Sprintf("workspace %q is protected: %s requires the header %s: %s", workspace, operation, ConfirmHeader, workspace), http.StatusForbidden)
+		return false
+	}
+	return true
+}
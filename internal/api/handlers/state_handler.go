@@ -1,21 +1,46 @@
 package handlers
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"github.com/c4po/terrastate/internal/audit"
 	"github.com/c4po/terrastate/internal/models"
 	"github.com/c4po/terrastate/internal/storage"
 	"github.com/gorilla/mux"
 )
 
 type StateHandler struct {
-	storage storage.StateStorage
+	storage           storage.StateStorage
+	audit             *audit.Logger
+	protectedPatterns []string
+	lockTTL           time.Duration
 }
 
-func NewStateHandler(storage storage.StateStorage) *StateHandler {
-	return &StateHandler{storage: storage}
+// NewStateHandler creates a state handler. Workspaces without metadata whose
+// name matches one of protectedPatterns are treated as protected. Locks taken
+// without an explicit ttl get a lease of lockTTL, or none if it is zero.
+func NewStateHandler(storage storage.StateStorage, auditLog *audit.Logger, protectedPatterns []string, lockTTL time.Duration) *StateHandler {
+	return &StateHandler{
+		storage:           storage,
+		audit:             auditLog,
+		protectedPatterns: protectedPatterns,
+		lockTTL:           lockTTL,
+	}
+}
+
+// stateHeader holds the fields of a Terraform state document that the
+// handler inspects
+type stateHeader struct {
+	Serial  int64  `json:"serial"`
+	Lineage string `json:"lineage"`
 }
 
 func (h *StateHandler) GetState(w http.ResponseWriter, r *http.Request) {
@@ -25,13 +50,18 @@ func (h *StateHandler) GetState(w http.ResponseWriter, r *http.Request) {
 
 	state, err := h.storage.GetState(r.Context(), workspace, id)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeStorageError(w, err)
 		return
 	}
 
 	json.NewEncoder(w).Encode(state)
 }
 
+// PutState stores the uploaded state. Backends that can write a stream get
+// the body as it arrives; for the others it is read whole first. Only the
+// top of the document is parsed, for the serial check. A streamed write
+// can't be made conditional, so backends that take conditional writes always
+// get the whole state.
 func (h *StateHandler) PutState(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	state := &models.State{
@@ -39,26 +69,141 @@ func (h *StateHandler) PutState(w http.ResponseWriter, r *http.Request) {
 		Workspace: vars["workspace"],
 	}
 
-	body, err := io.ReadAll(r.Body)
+	body := bufio.NewReaderSize(r.Body, stateHeaderPeek)
+	incoming, parsed, err := peekStateHeader(body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, err)
 		return
 	}
-	state.State = body
+	stream := storage.Streams(h.storage) && !storage.ConditionalWrites(h.storage)
+	if !stream {
+		if state.State, err = io.ReadAll(body); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+	}
 
-	if err := h.storage.PutState(r.Context(), state); err != nil {
+	current, stored, err := h.currentState(r.Context(), state.Workspace, state.ID, stream)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if parsed {
+		state.Serial = incoming.Serial
+		if stored != nil && !h.checkSerial(w, r, state, *stored, incoming) {
+			return
+		}
+	}
+
+	ctx := storage.WithActor(r.Context(), actor(r))
+	if stream {
+		err = h.storage.(storage.StreamWriter).PutStateFrom(ctx, state, body)
+	} else {
+		err = h.putState(ctx, state, current)
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
+// currentState returns the stored state and its serial and lineage, which
+// are nil if it has none. With headerOnly, backends that can stream the state
+// only have its start read, and the returned state has no body.
+func (h *StateHandler) currentState(ctx context.Context, workspace, id string, headerOnly bool) (*models.State, *stateHeader, error) {
+	reader, ok := h.storage.(storage.StreamReader)
+	if !headerOnly || !ok {
+		current, err := h.storage.GetState(ctx, workspace, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		var stored stateHeader
+		if err := json.Unmarshal(current.State, &stored); err != nil {
+			return current, nil, nil
+		}
+		return current, &stored, nil
+	}
+
+	current, body, err := reader.GetStateReader(ctx, workspace, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	stored, ok, err := peekStateHeader(bufio.NewReaderSize(body, stateHeaderPeek))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read stored state: %w", err)
+	}
+	if !ok {
+		return current, nil, nil
+	}
+	return current, &stored, nil
+}
+
+// putState writes state. Backends that support conditional writes only
+// accept it if the stored copy is still current, so that concurrent writers
+// can't silently overwrite each other.
+func (h *StateHandler) putState(ctx context.Context, state, current *models.State) error {
+	writer, ok := h.storage.(storage.ConditionalWriter)
+	if !ok {
+		return h.storage.PutState(ctx, state)
+	}
+
+	revision := ""
+	if current != nil {
+		revision = current.Revision
+	}
+	return writer.PutStateIfMatch(ctx, state, revision)
+}
+
+// checkSerial refuses uploads that would move a state back from the stored
+// serial to an older one of the same lineage unless the client asked to force
+// it with ?force=true.
+func (h *StateHandler) checkSerial(w http.ResponseWriter, r *http.Request, state *models.State, stored, incoming stateHeader) bool {
+	if stored.Lineage != incoming.Lineage || incoming.Serial >= stored.Serial {
+		return true
+	}
+
+	if r.URL.Query().Get("force") != "true" {
+		http.Error(w, fmt.Sprintf("serial %d is older than the stored serial %d; retry with force=true to override",
+			incoming.Serial, stored.Serial), http.StatusConflict)
+		return false
+	}
+	if !h.authorizeOverride(w, r, state.Workspace, "overriding a serial regression") {
+		return false
+	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionSerialRegressed,
+		Workspace:  state.Workspace,
+		ID:         state.ID,
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+		Details:    fmt.Sprintf("serial %d -> %d", stored.Serial, incoming.Serial),
+	})
+	return true
+}
+
 func (h *StateHandler) DeleteState(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if err := h.storage.DeleteState(r.Context(), vars["workspace"], vars["id"]); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !h.authorizeOverride(w, r, vars["workspace"], "deleting a state") {
+		return
+	}
+
+	ctx := storage.WithActor(r.Context(), actor(r))
+	if err := h.storage.DeleteState(ctx, vars["workspace"], vars["id"]); err != nil {
+		writeStorageError(w, err)
 		return
 	}
+
+	h.audit.Record(audit.Event{
+		Action:     audit.ActionDeleteState,
+		Workspace:  vars["workspace"],
+		ID:         vars["id"],
+		Actor:      actor(r),
+		RemoteAddr: r.RemoteAddr,
+	})
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -72,29 +217,334 @@ func (h *StateHandler) ListStates(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(states)
 }
 
+// ListStateVersions lists the previous versions of a state on backends that
+// keep history
+func (h *StateHandler) ListStateVersions(w http.ResponseWriter, r *http.Request) {
+	history, ok := storage.History(h.storage)
+	if !ok {
+		http.Error(w, "storage backend does not keep state history", http.StatusNotImplemented)
+		return
+	}
+
+	vars := mux.Vars(r)
+	versions, err := history.ListStateVersions(r.Context(), vars["workspace"], vars["id"])
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(versions)
+}
+
+func (h *StateHandler) GetStateVersion(w http.ResponseWriter, r *http.Request) {
+	history, ok := storage.History(h.storage)
+	if !ok {
+		http.Error(w, "storage backend does not keep state history", http.StatusNotImplemented)
+		return
+	}
+
+	vars := mux.Vars(r)
+	state, err := history.GetStateVersion(r.Context(), vars["workspace"], vars["id"], vars["version"])
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(state)
+}
+
+// Lock acquires the lock on a state. The lease length can be set with a ttl
+// query parameter such as ?ttl=15m on the lock address. If another client
+// holds the lock the request fails with 423 and the held lock as body.
 func (h *StateHandler) Lock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	workspace, id := vars["workspace"], vars["id"]
+
 	var lock models.StateLock
 	if err := json.NewDecoder(r.Body).Decode(&lock); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	ttl, err := h.requestTTL(r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	lock.TTLSeconds = int64(ttl / time.Second)
+	if lock.Created.IsZero() {
+		lock.Created = time.Now().UTC()
+	}
 
-	lock.Path = vars["workspace"] + "/" + vars["id"]
-	if err := h.storage.Lock(r.Context(), &lock); err != nil {
+	current, err := h.currentLock(r, workspace, id)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if current != nil && current.ID != lock.ID {
+		writeLockConflict(w, current)
+		return
+	}
+
+	if err := h.storage.Lock(r.Context(), workspace, id, &lock); err != nil {
+		if !errors.Is(err, storage.ErrLocked) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Lost the race against another client
+		if current, err := h.storage.GetLock(r.Context(), workspace, id); err == nil {
+			writeLockConflict(w, current)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *StateHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+// GetLock reports the lock held on a state and its remaining lease
+func (h *StateHandler) GetLock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lock, err := h.currentLock(r, vars["workspace"], vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if lock == nil {
+		http.Error(w, "state is not locked", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLockStatus(lock, time.Now()))
+}
+
+// RenewLock restarts the lease of a held lock. Long running applies call it
+// periodically with the lock ID in the body; a ttl query parameter changes
+// the lease length.
+func (h *StateHandler) RenewLock(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	if err := h.storage.Unlock(r.Context(), vars["workspace"], vars["id"]); err != nil {
+	workspace, id := vars["workspace"], vars["id"]
+
+	var request models.StateLock
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	current, err := h.currentLock(r, workspace, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if current == nil {
+		http.Error(w, "state is not locked", http.StatusNotFound)
+		return
+	}
+	if current.ID != request.ID {
+		writeLockConflict(w, current)
+		return
+	}
+
+	if r.URL.Query().Has("ttl") {
+		ttl, err := h.requestTTL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current.TTLSeconds = int64(ttl / time.Second)
+	}
+	current.Renewed = time.Now().UTC()
+
+	if err := h.storage.RenewLock(r.Context(), workspace, id, current); err != nil {
+		if errors.Is(err, storage.ErrLocked) || errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newLockStatus(current, time.Now()))
+}
+
+// requestTTL returns the lease length asked for by the ttl query parameter,
+// or the default lease length
+func (h *StateHandler) requestTTL(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("ttl")
+	if value == "" {
+		return h.lockTTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < time.Second {
+		return 0, fmt.Errorf("invalid ttl %q: must be a duration of at least 1s", value)
+	}
+	return ttl, nil
+}
+
+// currentLock returns the lock held on a state, or nil if there is none. A
+// lock whose lease ran out is released and recorded in the audit trail.
+func (h *StateHandler) currentLock(r *http.Request, workspace, id string) (*models.StateLock, error) {
+	lock, err := h.storage.GetLock(r.Context(), workspace, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !lock.Expired(time.Now()) {
+		return lock, nil
+	}
+	err = h.expireLock(r, workspace, id, lock)
+	if errors.Is(err, storage.ErrLocked) {
+		// Another request released it first and took a new lock
+		return h.currentLock(r, workspace, id)
+	}
+	return nil, err
+}
+
+// expireLock releases a lock whose lease ran out and records it in the audit
+// trail. The lock is only released if it is still the one that was read, and
+// ErrLocked is returned if another client has taken a new lock since.
+func (h *StateHandler) expireLock(r *http.Request, workspace, id string, lock *models.StateLock) error {
+	if err := h.storage.UnlockIfMatch(r.Context(), workspace, id, lock); err != nil {
+		// Another request released it first
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		if errors.Is(err, storage.ErrLocked) {
+			return err
+		}
+		return fmt.Errorf("failed to release expired lock: %w", err)
+	}
+	h.audit.Record(audit.Event{
+		Action:    audit.ActionLockExpired,
+		Workspace: workspace,
+		ID:        id,
+		Actor:     "terrastate",
+		Details: fmt.Sprintf("lock %s held by %s for %s expired at %s",
+			lock.ID, lock.Who, lock.Operation, lock.Expires().Format(time.RFC3339)),
+	})
+	return nil
+}
+
+// lockStatus is a lock as reported to clients, with its age and remaining lease
+type lockStatus struct {
+	models.StateLock
+	AgeSeconds       int64      `json:"age_seconds"`
+	Expires          *time.Time `json:"expires,omitempty"`
+	RemainingSeconds *int64     `json:"remaining_seconds,omitempty"`
+}
+
+func newLockStatus(lock *models.StateLock, now time.Time) lockStatus {
+	status := lockStatus{
+		StateLock:  *lock,
+		AgeSeconds: int64(now.Sub(lock.Created) / time.Second),
+	}
+	if expires := lock.Expires(); !expires.IsZero() {
+		remaining := int64(max(expires.Sub(now), 0) / time.Second)
+		status.Expires = &expires
+		status.RemainingSeconds = &remaining
+	}
+	return status
+}
+
+// writeLockConflict answers a lock request for a state locked by someone
+// else, returning the held lock the way the Terraform http backend expects
+func writeLockConflict(w http.ResponseWriter, current *models.StateLock) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	json.NewEncoder(w).Encode(current)
+}
+
+// Unlock releases a lock. The body carries the lock being released; an
+// empty body, as sent by terraform force-unlock, releases whatever lock is
+// held and is treated as a forced unlock.
+func (h *StateHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	workspace, id := vars["workspace"], vars["id"]
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	var request models.StateLock
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	current, err := h.storage.GetLock(r.Context(), workspace, id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if request.ID != "" && request.ID != current.ID {
+		writeLockConflict(w, current)
+		return
+	}
+	forced := request.ID == ""
+	if forced && !h.authorizeOverride(w, r, workspace, "force-unlocking a state") {
+		return
+	}
+
+	if !h.unlockIfMatch(w, r, workspace, id, current) {
+		return
+	}
+
+	if forced {
+		h.audit.Record(audit.Event{
+			Action:     audit.ActionForceUnlock,
+			Workspace:  workspace,
+			ID:         id,
+			Actor:      actor(r),
+			RemoteAddr: r.RemoteAddr,
+			Details:    fmt.Sprintf("lock %s held by %s for %s", current.ID, current.Who, current.Operation),
+		})
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// Implement other handler methods...
+// unlockIfMatch releases current, the lock read by the request, and answers
+// the request if that fails. If the lock changed hands in between, the new
+// lock is left alone and reported as a conflict.
+func (h *StateHandler) unlockIfMatch(w http.ResponseWriter, r *http.Request, workspace, id string, current *models.StateLock) bool {
+	err := h.storage.UnlockIfMatch(r.Context(), workspace, id, current)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, storage.ErrLocked) {
+		if held, err := h.storage.GetLock(r.Context(), workspace, id); err == nil {
+			writeLockConflict(w, held)
+			return false
+		}
+	}
+	writeStorageError(w, err)
+	return false
+}
+
+// writeStorageError answers a request that failed in the storage backend,
+// mapping the storage errors to their HTTP status
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch {
+	case isTooLarge(err):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum):
+		// A corrupt gzip upload found while streaming it
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, storage.ErrLocked):
+		http.Error(w, err.Error(), http.StatusLocked)
+	case errors.Is(err, storage.ErrConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/disk"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	"github.com/gorilla/mux"
+)
+
+// handoverStorage hands the lock over to another client right after the
+// first GetLock has read it, as if that client released and retook it in
+// between
+type handoverStorage struct {
+	storage.StateStorage
+	once sync.Once
+}
+
+func (s *handoverStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	lock, err := s.StateStorage.GetLock(ctx, workspace, id)
+	s.once.Do(func() {
+		s.StateStorage.Unlock(ctx, workspace, id)
+		s.StateStorage.Lock(ctx, workspace, id, &models.StateLock{ID: "other", Created: time.Now()})
+	})
+	return lock, err
+}
+
+func newLockRouter(t *testing.T, lock *models.StateLock) *mux.Router {
+	backend := memory.NewMemoryStorage()
+	if err := backend.Lock(context.Background(), "ws", "app", lock); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	h := NewStateHandler(&handoverStorage{StateStorage: backend}, nil, nil, 0)
+	r := mux.NewRouter()
+	r.HandleFunc("/lock/{workspace}/{id}", h.Lock).Methods("POST")
+	r.HandleFunc("/lock/{workspace}/{id}", h.Unlock).Methods("DELETE")
+	return r
+}
+
+// assertHeldBy fails unless the response reports the lock held by id
+func assertHeldBy(t *testing.T, w *httptest.ResponseRecorder, id string) {
+	t.Helper()
+	var held models.StateLock
+	if w.Code != http.StatusLocked || json.Unmarshal(w.Body.Bytes(), &held) != nil || held.ID != id {
+		t.Errorf("response = %d %s, want 423 with the lock of %s", w.Code, w.Body, id)
+	}
+}
+
+func TestExpiredLockTakenOver(t *testing.T) {
+	expired := &models.StateLock{ID: "expired", Created: time.Now().Add(-time.Hour), TTLSeconds: 60}
+	r := newLockRouter(t, expired)
+
+	// The lock read as expired was replaced before it could be released, so
+	// the new holder keeps it
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/lock/ws/app", strings.NewReader(`{"ID":"mine"}`)))
+	assertHeldBy(t, w, "other")
+}
+
+func TestUnlockTakenOver(t *testing.T) {
+	for _, body := range []string{`{"ID":"held"}`, ""} {
+		r := newLockRouter(t, &models.StateLock{ID: "held", Created: time.Now()})
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("DELETE", "/lock/ws/app", strings.NewReader(body)))
+		assertHeldBy(t, w, "other")
+	}
+}
+
+// streamingStorage is a disk backend that fails the test if a state is read
+// whole
+type streamingStorage struct {
+	*disk.DiskStorage
+	t *testing.T
+}
+
+func (s *streamingStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	s.t.Errorf("GetState(%s, %s) on a backend that streams states", workspace, id)
+	return s.DiskStorage.GetState(ctx, workspace, id)
+}
+
+// conditionalStorage is a disk backend that records the revisions of
+// conditional writes and fails the test on streamed ones
+type conditionalStorage struct {
+	*disk.DiskStorage
+	t         *testing.T
+	revisions []string
+}
+
+func (s *conditionalStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	s.revisions = append(s.revisions, revision)
+	return s.DiskStorage.PutState(ctx, state)
+}
+
+func (s *conditionalStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	s.t.Errorf("PutStateFrom(%s, %s) on a backend that takes conditional writes", state.Workspace, state.ID)
+	return s.DiskStorage.PutStateFrom(ctx, state, body)
+}
+
+// largeState is a state document larger than what is read of it for the
+// serial check
+func largeState(serial int) string {
+	resources := bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 2*stateHeaderPeek/52)
+	return fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"l","resources":[%s{}]}`, serial, resources)
+}
+
+func putStateRequest(t *testing.T, backend storage.StateStorage, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	h := NewStateHandler(backend, nil, nil, 0)
+	r := mux.NewRouter()
+	r.HandleFunc("/state/{workspace}/{id}", h.PutState).Methods("PUT")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/state/ws/app", strings.NewReader(body)))
+	return w
+}
+
+func TestStreamedPutChecksSerial(t *testing.T) {
+	backend := &streamingStorage{DiskStorage: disk.NewDiskStorage(t.TempDir()), t: t}
+	if w := putStateRequest(t, backend, largeState(2)); w.Code != http.StatusOK {
+		t.Fatalf("PUT serial 2 = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := putStateRequest(t, backend, largeState(1)); w.Code != http.StatusConflict {
+		t.Errorf("PUT serial 1 over serial 2 = %d %s, want 409", w.Code, w.Body)
+	}
+	if w := putStateRequest(t, backend, largeState(3)); w.Code != http.StatusOK {
+		t.Errorf("PUT serial 3 over serial 2 = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestConditionalPutNotStreamed(t *testing.T) {
+	backend := &conditionalStorage{DiskStorage: disk.NewDiskStorage(t.TempDir()), t: t}
+	for serial := 1; serial <= 2; serial++ {
+		if w := putStateRequest(t, backend, largeState(serial)); w.Code != http.StatusOK {
+			t.Fatalf("PUT serial %d = %d %s, want 200", serial, w.Code, w.Body)
+		}
+	}
+	if len(backend.revisions) != 2 {
+		t.Errorf("%d conditional writes, want 2", len(backend.revisions))
+	}
+}
@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event actions recorded by the server
+const (
+	ActionDeleteState     = "delete_state"
+	ActionForceUnlock     = "force_unlock"
+	ActionLockExpired     = "lock_expired"
+	ActionSerialRegressed = "serial_regression"
+	ActionProtection      = "workspace_protection"
+	ActionBackup          = "backup"
+	ActionRestore         = "restore"
+)
+
+// Event is a single entry in the audit trail
+type Event struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Workspace  string    `json:"workspace"`
+	ID         string    `json:"id,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Details    string    `json:"details,omitempty"`
+}
+
+// Logger appends audit events as JSON lines to a writer
+type Logger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewLogger(w io.Writer) *Logger {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &Logger{w: w, enc: enc}
+}
+
+// Flush commits the recorded events to stable storage when the trail is a
+// file, so that they survive the machine going down right after shutdown
+func (l *Logger) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.w.(*os.File)
+	if !ok {
+		return nil
+	}
+	// Pipes and terminals such as stdout can't be synced
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return f.Sync()
+}
+
+// Record writes the event to the trail. Failures are logged rather than
+// returned so that auditing never blocks the operation being audited.
+func (l *Logger) Record(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(event); err != nil {
+		slog.Error("Failed to write audit event", "action", event.Action, "workspace", event.Workspace, "id", event.ID, "error", err)
+	}
+}
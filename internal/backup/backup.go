@@ -0,0 +1,382 @@
+// Package backup writes and restores archives of everything a storage
+// backend holds.
+//
+// An archive is a tar file with these entries, in this order:
+//
+//	meta/<workspace>.json                   workspace metadata
+//	history/<workspace>/<id>/<n>-<version>  previous versions, oldest first
+//	states/<workspace>/<id>                 current states
+//	locks/<workspace>/<id>.json             lock metadata
+//	tokens.json                             API tokens, if given
+//	manifest.json                           checksums of all of the above
+//
+// The manifest comes last so that archives can be streamed while they are
+// written. Restoring reads the archive twice: first to check every entry
+// against the manifest, then to write it, so a damaged archive changes
+// nothing.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/migrate"
+)
+
+// ManifestName is the name of the manifest entry
+const ManifestName = "manifest.json"
+
+// Entry kinds
+const (
+	KindState   = "state"
+	KindVersion = "version"
+	KindLock    = "lock"
+	KindMeta    = "meta"
+	KindTokens  = "tokens"
+)
+
+// Manifest describes the entries of an archive
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Entries   []Entry   `json:"entries"`
+}
+
+// Entry is a file in an archive
+type Entry struct {
+	Path      string `json:"path"`
+	Kind      string `json:"kind"`
+	Workspace string `json:"workspace,omitempty"`
+	ID        string `json:"id,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// writer adds entries to a tar stream and records them in the manifest
+type writer struct {
+	tw       *tar.Writer
+	manifest Manifest
+}
+
+func (w *writer) add(entry Entry, data []byte) error {
+	sum := sha256.Sum256(data)
+	entry.Size = int64(len(data))
+	entry.SHA256 = hex.EncodeToString(sum[:])
+
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    entry.Path,
+		Mode:    0644,
+		Size:    entry.Size,
+		ModTime: w.manifest.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return err
+	}
+	w.manifest.Entries = append(w.manifest.Entries, entry)
+	return nil
+}
+
+// Write streams an archive of s and tokens to out. Tokens may be nil.
+func Write(ctx context.Context, out io.Writer, s storage.StateStorage, tokens []models.Token) (*Manifest, error) {
+	w := &writer{
+		tw:       tar.NewWriter(out),
+		manifest: Manifest{Version: 1, CreatedAt: time.Now().UTC()},
+	}
+
+	workspaces, err := s.ListWorkspaces(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list workspaces: %w", err)
+	}
+	for _, workspace := range workspaces {
+		if err := w.addWorkspace(ctx, s, workspace); err != nil {
+			return nil, err
+		}
+	}
+
+	locks, err := s.ListLocks(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks: %w", err)
+	}
+	for _, lock := range locks {
+		data, err := json.Marshal(lock)
+		if err != nil {
+			return nil, err
+		}
+		entry := Entry{
+			Path:      path.Join("locks", lock.Workspace, lock.StateID+".json"),
+			Kind:      KindLock,
+			Workspace: lock.Workspace,
+			ID:        lock.StateID,
+		}
+		if err := w.add(entry, data); err != nil {
+			return nil, err
+		}
+	}
+
+	if tokens != nil {
+		data, err := json.Marshal(tokens)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.add(Entry{Path: "tokens.json", Kind: KindTokens}, data); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = w.tw.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(data)), ModTime: w.manifest.CreatedAt})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.tw.Close(); err != nil {
+		return nil, err
+	}
+	return &w.manifest, nil
+}
+
+func (w *writer) addWorkspace(ctx context.Context, s storage.StateStorage, workspace string) error {
+	meta, err := s.GetWorkspaceMeta(ctx, workspace)
+	if err == nil {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		entry := Entry{Path: path.Join("meta", workspace+".json"), Kind: KindMeta, Workspace: workspace}
+		if err := w.add(entry, data); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("failed to read metadata of %s: %w", workspace, err)
+	}
+
+	states, err := s.ListStates(ctx, workspace)
+	if err != nil {
+		return fmt.Errorf("failed to list states of %s: %w", workspace, err)
+	}
+	history, _ := storage.History(s)
+	for _, listed := range states {
+		versions, err := migrate.PreviousVersions(ctx, s, workspace, listed.ID)
+		if err != nil {
+			return err
+		}
+		for i, version := range versions {
+			state, err := history.GetStateVersion(ctx, workspace, listed.ID, version.Version)
+			if err != nil {
+				return fmt.Errorf("failed to read %s/%s version %s: %w", workspace, listed.ID, version.Version, err)
+			}
+			entry := Entry{
+				Path:      path.Join("history", workspace, listed.ID, fmt.Sprintf("%04d-%s", i, version.Version)),
+				Kind:      KindVersion,
+				Workspace: workspace,
+				ID:        listed.ID,
+				Version:   version.Version,
+			}
+			if err := w.add(entry, state.State); err != nil {
+				return err
+			}
+		}
+
+		state, err := s.GetState(ctx, workspace, listed.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s/%s: %w", workspace, listed.ID, err)
+		}
+		entry := Entry{Path: path.Join("states", workspace, listed.ID), Kind: KindState, Workspace: workspace, ID: listed.ID}
+		if err := w.add(entry, state.State); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreOptions select what Restore writes besides states and metadata
+type RestoreOptions struct {
+	// Locks restores the locks held when the archive was written
+	Locks bool
+}
+
+// RestoreResult counts what Restore wrote
+type RestoreResult struct {
+	States   int            `json:"states"`
+	Versions int            `json:"versions"`
+	Meta     int            `json:"meta"`
+	Locks    int            `json:"locks"`
+	Tokens   []models.Token `json:"-"`
+}
+
+// Verify checks every entry of the archive against its manifest
+func Verify(archive io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(archive)
+	sums := make(map[string]string)
+	var manifest *Manifest
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if header.Name == ManifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("failed to decode manifest: %w", err)
+			}
+			continue
+		}
+		hash := sha256.New()
+		if _, err := io.Copy(hash, tr); err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		sums[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("archive has no manifest")
+	}
+	for _, entry := range manifest.Entries {
+		sum, ok := sums[entry.Path]
+		if !ok {
+			return nil, fmt.Errorf("archive is missing %s", entry.Path)
+		}
+		if sum != entry.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", entry.Path)
+		}
+		delete(sums, entry.Path)
+	}
+	for name := range sums {
+		return nil, fmt.Errorf("archive entry %s is not in the manifest", name)
+	}
+	return manifest, nil
+}
+
+// Restore verifies the archive and then writes its states, history,
+// metadata and, if asked for, locks to s. Existing states are overwritten.
+// Previous versions are only written if s keeps history. Tokens are
+// returned for the caller to register.
+func Restore(ctx context.Context, archive io.ReadSeeker, s storage.StateStorage, opts RestoreOptions) (*RestoreResult, error) {
+	manifest, err := Verify(archive)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]Entry, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		entries[entry.Path] = entry
+	}
+	_, keepHistory := storage.History(s)
+
+	result := &RestoreResult{}
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		entry, ok := entries[header.Name]
+		if !ok {
+			continue
+		}
+		var data bytes.Buffer
+		if _, err := io.Copy(&data, tr); err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if err := restoreEntry(ctx, s, entry, data.Bytes(), opts, keepHistory, result); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %w", entry.Path, err)
+		}
+	}
+	return result, nil
+}
+
+func restoreEntry(ctx context.Context, s storage.StateStorage, entry Entry, data []byte, opts RestoreOptions, keepHistory bool, result *RestoreResult) error {
+	switch entry.Kind {
+	case KindState, KindVersion:
+		if entry.Kind == KindVersion && !keepHistory {
+			return nil
+		}
+		err := s.PutState(ctx, &models.State{ID: entry.ID, Workspace: entry.Workspace, State: data})
+		if err != nil {
+			return err
+		}
+		if entry.Kind == KindState {
+			result.States++
+		} else {
+			result.Versions++
+		}
+
+	case KindMeta:
+		var meta models.WorkspaceMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		if err := s.PutWorkspaceMeta(ctx, &meta); err != nil {
+			return err
+		}
+		result.Meta++
+
+	case KindLock:
+		if !opts.Locks {
+			return nil
+		}
+		var lock models.StateLock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return err
+		}
+		if err := s.Lock(ctx, entry.Workspace, entry.ID, &lock); err != nil {
+			return err
+		}
+		result.Locks++
+
+	case KindTokens:
+		if err := json.Unmarshal(data, &result.Tokens); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unknown entry kind %q", entry.Kind)
+	}
+	return nil
+}
+
+// ArchiveName returns the file name of an archive written at t; names sort
+// in time order
+func ArchiveName(t time.Time) string {
+	return "terrastate-" + t.UTC().Format("20060102T150405Z") + ".tar"
+}
+
+// isArchiveName reports whether name was made by ArchiveName
+func isArchiveName(name string) bool {
+	return strings.HasPrefix(name, "terrastate-") && strings.HasSuffix(name, ".tar")
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/c4po/terrastate/internal/metrics"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/cache"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	"github.com/c4po/terrastate/internal/storage/replication"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+	"github.com/c4po/terrastate/internal/storage/storagetest/gittest"
+	"github.com/c4po/terrastate/internal/tracing"
+)
+
+// decorate wraps backend in the decorators the server puts around it
+func decorate(t *testing.T, backend storage.StateStorage) storage.StateStorage {
+	s := storage.StateStorage(tracing.NewTracedStorage(backend, "test"))
+	s = metrics.NewInstrumentedStorage(s, "test")
+	replicating, err := replication.NewReplicatingStorage(s, memory.NewMemoryStorage(), replication.ModeSync, "", time.Minute)
+	if err != nil {
+		t.Fatalf("NewReplicatingStorage: %v", err)
+	}
+	t.Cleanup(func() { replicating.Close() })
+	cached, err := cache.NewCachingStorage(replicating, "", 1<<20)
+	if err != nil {
+		t.Fatalf("NewCachingStorage: %v", err)
+	}
+	return cached
+}
+
+// roundTrip backs up from and restores the archive into to, returning the
+// number of states and previous versions in the archive
+func roundTrip(t *testing.T, from, to storage.StateStorage) (states, versions int) {
+	ctx := context.Background()
+	var archive bytes.Buffer
+	manifest, err := Write(ctx, &archive, from, nil)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	for _, entry := range manifest.Entries {
+		switch entry.Kind {
+		case KindState:
+			states++
+		case KindVersion:
+			versions++
+		}
+	}
+	if _, err := Restore(ctx, bytes.NewReader(archive.Bytes()), to, RestoreOptions{}); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	state, err := to.GetState(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetState after Restore: %v", err)
+	}
+	if string(state.State) != `{"serial":3}` {
+		t.Errorf("GetState after Restore = %s, want serial 3", state.State)
+	}
+	return states, versions
+}
+
+func TestBackupThroughDecorators(t *testing.T) {
+	from := decorate(t, memory.NewMemoryStorage())
+	storagetest.PutSerials(t, from, "ws", "app", 3)
+
+	states, versions := roundTrip(t, from, decorate(t, memory.NewMemoryStorage()))
+	if states != 1 || versions != 0 {
+		t.Errorf("archive of a backend without history has %d states and %d versions, want 1 and 0", states, versions)
+	}
+}
+
+func TestBackupHistoryThroughDecorators(t *testing.T) {
+	from := decorate(t, gittest.NewStorage(t))
+	storagetest.PutSerials(t, from, "ws", "app", 3)
+
+	to := gittest.NewStorage(t)
+	states, versions := roundTrip(t, from, decorate(t, to))
+	if states != 1 || versions != 2 {
+		t.Errorf("archive of a backend with history has %d states and %d versions, want 1 and 2", states, versions)
+	}
+	restored, err := to.ListStateVersions(context.Background(), "ws", "app")
+	if err != nil || len(restored) != 3 {
+		t.Errorf("ListStateVersions after Restore = %+v, %v, want 3 versions", restored, err)
+	}
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Schedule writes an archive with write into dir every interval until ctx is
+// done, keeping the newest keep archives
+func Schedule(ctx context.Context, dir string, interval time.Duration, keep int, write func(context.Context, io.Writer) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		name, err := WriteFile(ctx, dir, write)
+		if err != nil {
+			slog.Error("Scheduled backup failed", "error", err)
+			continue
+		}
+		slog.Info("Wrote backup", "path", name)
+		if err := Rotate(dir, keep); err != nil {
+			slog.Error("Failed to rotate backups", "dir", dir, "error", err)
+		}
+	}
+}
+
+// WriteFile writes an archive into dir under a name from ArchiveName and
+// returns its path. The archive only appears under that name once complete.
+func WriteFile(ctx context.Context, dir string, write func(context.Context, io.Writer) error) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(ctx, f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write backup file: %w", err)
+	}
+
+	name := filepath.Join(dir, ArchiveName(time.Now()))
+	if err := os.Rename(f.Name(), name); err != nil {
+		return "", fmt.Errorf("failed to write backup file: %w", err)
+	}
+	return name, nil
+}
+
+// Rotate removes all but the newest keep archives in dir
+func Rotate(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var archives []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isArchiveName(entry.Name()) {
+			archives = append(archives, entry.Name())
+		}
+	}
+	sort.Strings(archives)
+
+	for len(archives) > keep {
+		if err := os.Remove(filepath.Join(dir, archives[0])); err != nil {
+			return err
+		}
+		archives = archives[1:]
+	}
+	return nil
+}
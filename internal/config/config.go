@@ -0,0 +1,427 @@
+// Package config defines the server configuration. It is read from a YAML or
+// TOML file, then overridden by environment variables, then by command line
+// flags, and validated before use.
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the whole server configuration. Every setting has a key in the
+// file, an environment variable and a flag, named in its struct tags.
+type Config struct {
+	Server      ServerConfig      `yaml:"server" toml:"server"`
+	Storage     StorageConfig     `yaml:"storage" toml:"storage"`
+	Replication ReplicationConfig `yaml:"replication" toml:"replication"`
+	Cache       CacheConfig       `yaml:"cache" toml:"cache"`
+	Backup      BackupConfig      `yaml:"backup" toml:"backup"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	State       StateConfig       `yaml:"state" toml:"state"`
+	Audit       AuditConfig       `yaml:"audit" toml:"audit"`
+	TLS         TLSConfig         `yaml:"tls" toml:"tls"`
+	Logging     LoggingConfig     `yaml:"logging" toml:"logging"`
+	Tracing     TracingConfig     `yaml:"tracing" toml:"tracing"`
+	Limits      LimitsConfig      `yaml:"limits" toml:"limits"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+type ServerConfig struct {
+	Port              int      `yaml:"port" toml:"port" env:"PORT" help:"port to listen on"`
+	ShutdownDelay     Duration `yaml:"shutdown_delay" toml:"shutdown_delay" env:"SHUTDOWN_DELAY" help:"time between failing readiness and closing the listener on shutdown"`
+	ShutdownTimeout   Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"time given to in-flight requests to finish on shutdown"`
+	ReadinessCacheTTL Duration `yaml:"readiness_cache_ttl" toml:"readiness_cache_ttl" env:"READINESS_CACHE_TTL" help:"how long a readiness check result is reused"`
+}
+
+// Storage types
+const (
+	StorageS3     = "s3"
+	StorageGCS    = "gcs"
+	StorageAzure  = "azure"
+	StorageEtcd   = "etcd"
+	StorageGit    = "git"
+	StorageMemory = "memory"
+	StorageLocal  = "local"
+)
+
+type StorageConfig struct {
+	Type        string             `yaml:"type" toml:"type" env:"STORAGE_TYPE" help:"storage backend: s3, gcs, azure, etcd, git, memory or local"`
+	Compression string             `yaml:"compression" toml:"compression" env:"STORAGE_COMPRESSION" help:"compression of stored states: none, gzip or zstd; compressed states are read whatever the setting"`
+	S3          S3Config           `yaml:"s3" toml:"s3"`
+	GCS         GCSConfig          `yaml:"gcs" toml:"gcs"`
+	Azure       AzureConfig        `yaml:"azure" toml:"azure"`
+	Etcd        EtcdConfig         `yaml:"etcd" toml:"etcd"`
+	Git         GitConfig          `yaml:"git" toml:"git"`
+	Memory      MemoryConfig       `yaml:"memory" toml:"memory"`
+	Local       LocalStorageConfig `yaml:"local" toml:"local"`
+}
+
+type S3Config struct {
+	Bucket       string   `yaml:"bucket" toml:"bucket" env:"S3_BUCKET_NAME" help:"S3 bucket holding the states"`
+	Prefix       string   `yaml:"prefix" toml:"prefix" env:"S3_PREFIX" help:"key prefix inside the S3 bucket"`
+	Endpoint     string   `yaml:"endpoint" toml:"endpoint" env:"S3_ENDPOINT" help:"URL of an S3 compatible store such as MinIO; AWS if empty"`
+	Region       string   `yaml:"region" toml:"region" env:"S3_REGION" help:"region of the bucket; taken from the AWS configuration if empty"`
+	UsePathStyle bool     `yaml:"use_path_style" toml:"use_path_style" env:"S3_USE_PATH_STYLE" help:"address the bucket in the URL path instead of the host name"`
+	SSE          string   `yaml:"sse" toml:"sse" env:"S3_SSE" help:"server-side encryption: AES256 for SSE-S3 or aws:kms for SSE-KMS"`
+	KMSKeyID     string   `yaml:"kms_key_id" toml:"kms_key_id" env:"S3_SSE_KMS_KEY_ID" help:"KMS key of SSE-KMS; the AWS managed key if empty"`
+	StorageClass string   `yaml:"storage_class" toml:"storage_class" env:"S3_STORAGE_CLASS" help:"storage class of new state objects, such as STANDARD_IA; archival classes can't be read back directly and are refused"`
+	ACL          string   `yaml:"acl" toml:"acl" env:"S3_ACL" help:"canned ACL of new objects, such as bucket-owner-full-control"`
+	Tags         []string `yaml:"tags" toml:"tags" env:"S3_TAGS" help:"comma separated key=value tags set on every object"`
+	TagStates    bool     `yaml:"tag_states" toml:"tag_states" env:"S3_TAG_STATES" help:"tag state objects with their workspace, ID and serial"`
+}
+
+// TagMap returns the tags as a map
+func (s S3Config) TagMap() map[string]string {
+	tags := make(map[string]string, len(s.Tags))
+	for _, tag := range s.Tags {
+		key, value, _ := strings.Cut(tag, "=")
+		tags[key] = value
+	}
+	return tags
+}
+
+type GCSConfig struct {
+	Bucket string `yaml:"bucket" toml:"bucket" env:"GCS_BUCKET_NAME" help:"GCS bucket holding the states"`
+	Prefix string `yaml:"prefix" toml:"prefix" env:"GCS_PREFIX" help:"object prefix inside the GCS bucket"`
+}
+
+type AzureConfig struct {
+	ConnectionString string `yaml:"connection_string" toml:"connection_string" env:"AZURE_STORAGE_CONNECTION_STRING" help:"Azure Storage connection string"`
+	Container        string `yaml:"container" toml:"container" env:"AZURE_CONTAINER_NAME" help:"Azure Blob container holding the states"`
+	Prefix           string `yaml:"prefix" toml:"prefix" env:"AZURE_PREFIX" help:"blob name prefix inside the container"`
+}
+
+type EtcdConfig struct {
+	Endpoints []string `yaml:"endpoints" toml:"endpoints" env:"ETCD_ENDPOINTS" help:"comma separated etcd endpoints"`
+	Prefix    string   `yaml:"prefix" toml:"prefix" env:"ETCD_PREFIX" help:"key prefix in etcd"`
+}
+
+type GitConfig struct {
+	Path   string `yaml:"path" toml:"path" env:"GIT_REPO_PATH" help:"git repository holding the states"`
+	Remote string `yaml:"remote" toml:"remote" env:"GIT_REMOTE" help:"remote to push state commits to"`
+}
+
+type MemoryConfig struct {
+	SnapshotPath string `yaml:"snapshot_path" toml:"snapshot_path" env:"MEMORY_SNAPSHOT_PATH" help:"file the memory storage is saved to and loaded from"`
+}
+
+type LocalStorageConfig struct {
+	Path string `yaml:"path" toml:"path" env:"STORAGE_PATH" help:"directory holding the states"`
+}
+
+type ReplicationConfig struct {
+	Replica       string   `yaml:"replica" toml:"replica" env:"REPLICA_STORAGE" help:"storage writes are copied to, such as disk:/backup or s3://bucket/prefix"`
+	Mode          string   `yaml:"mode" toml:"mode" env:"REPLICATION_MODE" help:"sync or async"`
+	QueuePath     string   `yaml:"queue_path" toml:"queue_path" env:"REPLICATION_QUEUE_PATH" help:"file keeping the copies still to make"`
+	RetryInterval Duration `yaml:"retry_interval" toml:"retry_interval" env:"REPLICATION_RETRY_INTERVAL" help:"time between retries of failed copies"`
+}
+
+type CacheConfig struct {
+	MaxBytes int64  `yaml:"max_bytes" toml:"max_bytes" env:"CACHE_MAX_BYTES" help:"size of the state cache, which only serves the s3, gcs and etcd backends; 0 disables it"`
+	Path     string `yaml:"path" toml:"path" env:"CACHE_PATH" help:"directory of the state cache; it is kept in memory if empty"`
+}
+
+type BackupConfig struct {
+	Dir      string   `yaml:"dir" toml:"dir" env:"BACKUP_DIR" help:"directory of scheduled backups; none are made if empty"`
+	Interval Duration `yaml:"interval" toml:"interval" env:"BACKUP_INTERVAL" help:"time between scheduled backups"`
+	Keep     int      `yaml:"keep" toml:"keep" env:"BACKUP_KEEP" help:"number of scheduled backups kept"`
+}
+
+type AuthConfig struct {
+	AdminTokens []string `yaml:"admin_tokens" toml:"admin_tokens" env:"ADMIN_TOKENS" help:"comma separated tokens with admin access"`
+}
+
+type StateConfig struct {
+	ProtectedWorkspaces []string `yaml:"protected_workspaces" toml:"protected_workspaces" env:"PROTECTED_WORKSPACES" help:"comma separated workspaces whose states can't be deleted"`
+	LockTTL             Duration `yaml:"lock_ttl" toml:"lock_ttl" env:"LOCK_TTL" help:"time after which an unrenewed lock expires; 0 keeps locks forever"`
+}
+
+type AuditConfig struct {
+	Path string `yaml:"path" toml:"path" env:"AUDIT_LOG_PATH" help:"file the audit trail is appended to; stdout if empty"`
+}
+
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file" toml:"cert_file" env:"TLS_CERT_FILE" help:"PEM certificate; the server serves plain HTTP if empty"`
+	KeyFile    string `yaml:"key_file" toml:"key_file" env:"TLS_KEY_FILE" help:"PEM private key of the certificate"`
+	MinVersion string `yaml:"min_version" toml:"min_version" env:"TLS_MIN_VERSION" help:"lowest TLS version accepted: 1.2 or 1.3"`
+}
+
+type LoggingConfig struct {
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT" help:"text or json"`
+}
+
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT" help:"OTLP URL spans are exported to"`
+	Protocol    string  `yaml:"protocol" toml:"protocol" env:"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL,OTEL_EXPORTER_OTLP_PROTOCOL" help:"OTLP protocol: grpc or http/protobuf"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" help:"share of new traces recorded, from 0 to 1"`
+}
+
+type LimitsConfig struct {
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"HTTP_READ_HEADER_TIMEOUT" help:"time allowed to read request headers"`
+	ReadTimeout       Duration `yaml:"read_timeout" toml:"read_timeout" env:"HTTP_READ_TIMEOUT" help:"time allowed to read a whole request"`
+	WriteTimeout      Duration `yaml:"write_timeout" toml:"write_timeout" env:"HTTP_WRITE_TIMEOUT" help:"time allowed to write a response"`
+	IdleTimeout       Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT" help:"time an idle keep-alive connection is kept open"`
+	MaxHeaderBytes    int      `yaml:"max_header_bytes" toml:"max_header_bytes" env:"HTTP_MAX_HEADER_BYTES" help:"largest request headers accepted"`
+	MaxStateBytes     int64    `yaml:"max_state_bytes" toml:"max_state_bytes" env:"MAX_STATE_BYTES" help:"largest state upload accepted; 0 for no limit"`
+	MaxArchiveBytes   int64    `yaml:"max_archive_bytes" toml:"max_archive_bytes" env:"MAX_ARCHIVE_BYTES" help:"largest backup archive accepted for restore; 0 for no limit"`
+	MaxRequestBytes   int64    `yaml:"max_request_bytes" toml:"max_request_bytes" env:"MAX_REQUEST_BYTES" help:"largest body of the other requests, such as locks; 0 for no limit"`
+}
+
+// RateLimitConfig sets the token buckets of each client, identified by its
+// token or else its IP, per class of routes. A zero rate disables the limit,
+// which is the default for every class but logins.
+type RateLimitConfig struct {
+	ReadRate       float64  `yaml:"read_rate" toml:"read_rate" env:"RATE_LIMIT_READ_RATE" help:"state and lock reads per second allowed to each client; 0 for no limit"`
+	ReadBurst      int      `yaml:"read_burst" toml:"read_burst" env:"RATE_LIMIT_READ_BURST" help:"state and lock reads allowed at once above the rate"`
+	WriteRate      float64  `yaml:"write_rate" toml:"write_rate" env:"RATE_LIMIT_WRITE_RATE" help:"state writes and deletes per second allowed to each client; 0 for no limit"`
+	WriteBurst     int      `yaml:"write_burst" toml:"write_burst" env:"RATE_LIMIT_WRITE_BURST" help:"state writes and deletes allowed at once above the rate"`
+	LockRate       float64  `yaml:"lock_rate" toml:"lock_rate" env:"RATE_LIMIT_LOCK_RATE" help:"lock, unlock and renew calls per second allowed to each client; 0 for no limit"`
+	LockBurst      int      `yaml:"lock_burst" toml:"lock_burst" env:"RATE_LIMIT_LOCK_BURST" help:"lock, unlock and renew calls allowed at once above the rate"`
+	LoginRate      float64  `yaml:"login_rate" toml:"login_rate" env:"RATE_LIMIT_LOGIN_RATE" help:"login and token requests per second allowed to each IP; 0 for no limit"`
+	LoginBurst     int      `yaml:"login_burst" toml:"login_burst" env:"RATE_LIMIT_LOGIN_BURST" help:"login and token requests allowed at once above the rate"`
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"TRUSTED_PROXIES" help:"comma separated IPs or CIDR prefixes of proxies whose X-Forwarded-For is believed"`
+}
+
+// Default returns the configuration used for everything that isn't set
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              8080,
+			ShutdownTimeout:   Duration(30 * time.Second),
+			ReadinessCacheTTL: Duration(5 * time.Second),
+		},
+		Storage: StorageConfig{
+			Compression: "none",
+			Etcd:        EtcdConfig{Prefix: "terrastate"},
+			Local:       LocalStorageConfig{Path: "data"},
+		},
+		Replication: ReplicationConfig{
+			Mode:          "async",
+			RetryInterval: Duration(30 * time.Second),
+		},
+		Backup: BackupConfig{
+			Interval: Duration(24 * time.Hour),
+			Keep:     7,
+		},
+		TLS: TLSConfig{MinVersion: "1.2"},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: TracingConfig{SampleRatio: 1},
+		Limits: LimitsConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(5 * time.Minute),
+			WriteTimeout:      Duration(5 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			MaxHeaderBytes:    1 << 20,
+			MaxStateBytes:     256 << 20,
+			MaxRequestBytes:   1 << 20,
+		},
+		// Rate limits are opt-in, except for logins so that one client can't
+		// fill up the pending login codes; the bursts apply once a rate is set
+		RateLimit: RateLimitConfig{
+			LoginRate:  0.1,
+			ReadBurst:  100,
+			WriteBurst: 20,
+			LockBurst:  20,
+			LoginBurst: 10,
+		},
+	}
+}
+
+// Enabled reports whether spans are exported, which is the case when an
+// endpoint is configured here or in OTEL_EXPORTER_OTLP_ENDPOINT
+func (t TracingConfig) Enabled() bool {
+	return t.Endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != ""
+}
+
+// LogLevel returns the parsed logging level
+func (l LoggingConfig) LogLevel() (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", l.Level)
+	}
+	return level, nil
+}
+
+// TLSVersion returns the crypto/tls constant of MinVersion
+func (t TLSConfig) TLSVersion() (uint16, error) {
+	switch t.MinVersion {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q, expected 1.2 or 1.3", t.MinVersion)
+}
+
+// Validate checks every setting and returns all the problems found
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port: %d is not a valid port", c.Server.Port)
+	check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay: must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout: must be positive")
+	check(c.Server.ReadinessCacheTTL >= 0, "server.readiness_cache_ttl: must not be negative")
+
+	if err := c.Storage.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Replication.Replica != "" {
+		check(c.Replication.Mode == "sync" || c.Replication.Mode == "async", "replication.mode: %q is not sync or async", c.Replication.Mode)
+		check(c.Replication.RetryInterval > 0, "replication.retry_interval: must be positive")
+	}
+	check(c.Cache.MaxBytes >= 0, "cache.max_bytes: must not be negative")
+	if c.Backup.Dir != "" {
+		check(c.Backup.Interval > 0, "backup.interval: must be positive")
+		check(c.Backup.Keep >= 1, "backup.keep: must be at least 1")
+	}
+	check(c.State.LockTTL >= 0, "state.lock_ttl: must not be negative")
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls: cert_file and key_file must be set together")
+	for key, path := range map[string]string{"tls.cert_file": c.TLS.CertFile, "tls.key_file": c.TLS.KeyFile} {
+		if path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, "%s: %v", key, err)
+		}
+	}
+	if _, err := c.TLS.TLSVersion(); err != nil {
+		errs = append(errs, fmt.Errorf("tls.min_version: %w", err))
+	}
+
+	if _, err := c.Logging.LogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %w", err))
+	}
+	check(c.Logging.Format == "text" || c.Logging.Format == "json", "logging.format: %q is not text or json", c.Logging.Format)
+
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio: %v is not between 0 and 1", c.Tracing.SampleRatio)
+	check(c.Tracing.Protocol == "" || c.Tracing.Protocol == "grpc" || c.Tracing.Protocol == "http/protobuf",
+		"tracing.protocol: %q is not grpc or http/protobuf", c.Tracing.Protocol)
+
+	l := c.Limits
+	check(l.ReadHeaderTimeout >= 0 && l.ReadTimeout >= 0 && l.WriteTimeout >= 0 && l.IdleTimeout >= 0,
+		"limits: timeouts must not be negative")
+	check(l.MaxHeaderBytes > 0, "limits.max_header_bytes: must be positive")
+	check(l.MaxStateBytes >= 0 && l.MaxArchiveBytes >= 0 && l.MaxRequestBytes >= 0, "limits: body limits must not be negative")
+
+	rl := c.RateLimit
+	for _, class := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{{"read", rl.ReadRate, rl.ReadBurst}, {"write", rl.WriteRate, rl.WriteBurst}, {"lock", rl.LockRate, rl.LockBurst}, {"login", rl.LoginRate, rl.LoginBurst}} {
+		check(class.rate >= 0, "rate_limit.%s_rate: must not be negative", class.name)
+		check(class.rate == 0 || class.burst >= 1, "rate_limit.%s_burst: must be at least 1", class.name)
+	}
+	for _, proxy := range rl.TrustedProxies {
+		_, prefixErr := netip.ParsePrefix(proxy)
+		_, addrErr := netip.ParseAddr(proxy)
+		check(prefixErr == nil || addrErr == nil, "rate_limit.trusted_proxies: %q is not an IP or CIDR prefix", proxy)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the settings of the configured storage backend
+func (s StorageConfig) Validate() error {
+	var errs []error
+	check := func(ok bool, msg string) {
+		if !ok {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+
+	switch s.Compression {
+	case "none", "gzip", "zstd":
+	default:
+		errs = append(errs, fmt.Errorf("storage.compression: %q is not none, gzip or zstd", s.Compression))
+	}
+
+	switch s.Type {
+	case StorageS3:
+		check(s.S3.Bucket != "", "storage.s3.bucket: required for S3 storage")
+		if err := s.S3.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	case StorageGCS:
+		check(s.GCS.Bucket != "", "storage.gcs.bucket: required for GCS storage")
+	case StorageAzure:
+		check(s.Azure.ConnectionString != "", "storage.azure.connection_string: required for Azure storage")
+		check(s.Azure.Container != "", "storage.azure.container: required for Azure storage")
+	case StorageEtcd:
+		check(len(s.Etcd.Endpoints) > 0, "storage.etcd.endpoints: required for etcd storage")
+	case StorageGit:
+		check(s.Git.Path != "", "storage.git.path: required for git storage")
+	case StorageMemory:
+	case StorageLocal:
+		check(s.Local.Path != "", "storage.local.path: required for local storage")
+	case "":
+		errs = append(errs, errors.New("storage.type: required"))
+	default:
+		errs = append(errs, fmt.Errorf("storage.type: unsupported storage type %q", s.Type))
+	}
+	return errors.Join(errs...)
+}
+
+func (s S3Config) validate() error {
+	var errs []error
+	if s.Endpoint != "" {
+		if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("storage.s3.endpoint: %q is not a URL", s.Endpoint))
+		}
+	}
+	switch s.SSE {
+	case "", "AES256":
+		if s.KMSKeyID != "" {
+			errs = append(errs, errors.New("storage.s3.kms_key_id: requires sse aws:kms"))
+		}
+	case "aws:kms", "aws:kms:dsse":
+	default:
+		errs = append(errs, fmt.Errorf("storage.s3.sse: %q is not AES256, aws:kms or aws:kms:dsse", s.SSE))
+	}
+	switch s.StorageClass {
+	case "GLACIER", "DEEP_ARCHIVE":
+		errs = append(errs, fmt.Errorf("storage.s3.storage_class: %s objects must be restored before they can be read", s.StorageClass))
+	}
+	for _, tag := range s.Tags {
+		if key, _, ok := strings.Cut(tag, "="); !ok || key == "" {
+			errs = append(errs, fmt.Errorf("storage.s3.tags: %q is not key=value", tag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Duration is a time.Duration written as a string such as 30s or 5m
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
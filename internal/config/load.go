@@ -0,0 +1,184 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// setting is a single configuration value along with its names
+type setting struct {
+	key   string
+	env   []string
+	help  string
+	value reflect.Value
+}
+
+// settings lists the leaf fields of the struct v, keyed by their dotted
+// file keys
+func settings(v reflect.Value, prefix string) []setting {
+	var list []setting
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + field.Tag.Get("yaml")
+		if field.Type.Kind() == reflect.Struct {
+			list = append(list, settings(v.Field(i), key+".")...)
+			continue
+		}
+		list = append(list, setting{
+			key:   key,
+			env:   strings.Split(field.Tag.Get("env"), ","),
+			help:  field.Tag.Get("help"),
+			value: v.Field(i),
+		})
+	}
+	return list
+}
+
+// set parses text into the setting, splitting lists on commas
+func (s setting) set(text string) error {
+	if u, ok := s.value.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(text))
+	}
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(text)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+	return nil
+}
+
+// flagValue collects a flag to apply once the file and environment are read
+type flagValue struct {
+	key   string
+	flags map[string]string
+}
+
+func (f *flagValue) String() string { return "" }
+
+func (f *flagValue) Set(text string) error {
+	f.flags[f.key] = text
+	return nil
+}
+
+// Load builds the configuration from the defaults, then the file given with
+// -config or TERRASTATE_CONFIG, then the environment, then the flags in args.
+// Every setting has a flag named after its file key, such as -storage.type.
+// The result is not validated.
+func Load(name string, args []string) (*Config, error) {
+	cfg := Default()
+	list := settings(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("TERRASTATE_CONFIG"), "YAML or TOML configuration file (env TERRASTATE_CONFIG)")
+	flags := make(map[string]string)
+	for _, s := range list {
+		fs.Var(&flagValue{key: s.key, flags: flags}, s.key, fmt.Sprintf("%s (env %s)", s.help, strings.Join(s.env, ", ")))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *path != "" {
+		if err := LoadFile(*path, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range list {
+		for _, env := range s.env {
+			value, ok := os.LookupEnv(env)
+			if !ok || value == "" {
+				continue
+			}
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %w", env, value, err)
+			}
+			break
+		}
+	}
+
+	for _, s := range list {
+		if value, ok := flags[s.key]; ok {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("invalid -%s %q: %w", s.key, value, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// LoadFile reads the YAML or TOML file at path, chosen by its extension, into
+// cfg. Keys that aren't part of the configuration are errors, so that typos
+// don't go unnoticed.
+func LoadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("%s: unknown keys %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("%s: unsupported configuration format %q, expected .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
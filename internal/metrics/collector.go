@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/c4po/terrastate/internal/ratelimit"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/cache"
+	"github.com/c4po/terrastate/internal/storage/compress"
+	"github.com/c4po/terrastate/internal/storage/replication"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeTimeout bounds the storage calls made while collecting gauges
+const scrapeTimeout = 10 * time.Second
+
+var (
+	locksHeldDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "locks_held"),
+		"State locks currently held.", nil, nil)
+	oldestLockDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "oldest_lock_age_seconds"),
+		"Age of the oldest state lock currently held, or 0 without locks.", nil, nil)
+	activeTokensDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "active_tokens"),
+		"API tokens currently registered.", nil, nil)
+	scrapeErrorDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "lock_scrape_error"),
+		"1 if the locks could not be listed during the last scrape.", nil, nil)
+)
+
+// stateCollector reads the locks held and the tokens registered at scrape
+// time, so the gauges can't drift from what the backend holds
+type stateCollector struct {
+	storage    storage.StateStorage
+	tokenCount func() int
+}
+
+// RegisterStateCollector reports the locks held in s and the number of
+// tokens given by tokenCount at every scrape
+func RegisterStateCollector(s storage.StateStorage, tokenCount func() int) {
+	Registry.MustRegister(&stateCollector{storage: s, tokenCount: tokenCount})
+}
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- locksHeldDesc
+	ch <- oldestLockDesc
+	ch <- activeTokensDesc
+	ch <- scrapeErrorDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(activeTokensDesc, prometheus.GaugeValue, float64(c.tokenCount()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+	locks, err := c.storage.ListLocks(ctx, "")
+	if err != nil {
+		slog.Error("Failed to list locks for metrics", "error", err)
+		ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeErrorDesc, prometheus.GaugeValue, 0)
+
+	var oldest time.Duration
+	for _, lock := range locks {
+		if lock.Created.IsZero() {
+			continue
+		}
+		if age := time.Since(lock.Created); age > oldest {
+			oldest = age
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(locksHeldDesc, prometheus.GaugeValue, float64(len(locks)))
+	ch <- prometheus.MustNewConstMetric(oldestLockDesc, prometheus.GaugeValue, oldest.Seconds())
+}
+
+// RegisterCache reports the hits, misses and size of the state cache
+func RegisterCache(c *cache.CachingStorage) {
+	Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_hits_total",
+			Help:      "State reads answered from the cache.",
+		}, func() float64 { return float64(c.Stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_misses_total",
+			Help:      "State reads the cache had to fetch from the backend.",
+		}, func() float64 { return float64(c.Stats().Misses) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_bytes",
+			Help:      "Size of the states held in the cache.",
+		}, func() float64 { return float64(c.Stats().Bytes) }),
+	)
+}
+
+// RegisterCompression reports how much compression shrinks stored states
+func RegisterCompression(c *compress.CompressingStorage) {
+	Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_input_bytes_total",
+			Help:      "Size of the states written, before compression.",
+		}, func() float64 { return float64(c.Stats().Written) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "compression_output_bytes_total",
+			Help:      "Size of the compressed states stored for them.",
+		}, func() float64 { return float64(c.Stats().Stored) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "compression_ratio",
+			Help:        "Size of the states written divided by the size stored for them, since the start.",
+			ConstLabels: prometheus.Labels{"algorithm": string(c.Algorithm())},
+		}, func() float64 {
+			stats := c.Stats()
+			if stats.Stored == 0 {
+				return 0
+			}
+			return float64(stats.Written) / float64(stats.Stored)
+		}),
+	)
+}
+
+// RegisterRateLimits reports the requests refused by the rate limits of each
+// class of routes
+func RegisterRateLimits(l *ratelimit.Limiter) {
+	for _, class := range l.Classes() {
+		Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "rate_limited_requests_total",
+			Help:        "Requests refused with 429 because their client went over the rate limit.",
+			ConstLabels: prometheus.Labels{"class": class},
+		}, func() float64 { return float64(l.Limited(class)) }))
+	}
+}
+
+// RegisterReplication reports the copies waiting for the secondary and how
+// far behind it is
+func RegisterReplication(r *replication.ReplicatingStorage) {
+	Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_pending",
+			Help:      "Writes not yet copied to the secondary storage.",
+		}, func() float64 { return float64(r.Status().Pending) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "replication_lag_seconds",
+			Help:      "Age of the oldest write not yet copied to the secondary storage.",
+		}, func() float64 { return r.Status().LagSeconds }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "replication_failures_total",
+			Help:      "Copies to the secondary storage that failed.",
+		}, func() float64 { return float64(r.Status().Failures) }),
+	)
+}
@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage call latency by backend and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "method"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_errors_total",
+		Help:      "Failed storage calls by backend and method. Missing states, held locks, conflicts and unmodified states are not counted.",
+	}, []string{"backend", "method"})
+
+	stateSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "state_size_bytes",
+		Help:      "Size of the states last read or written, by workspace and state.",
+	}, []string{"workspace", "id"})
+)
+
+func init() {
+	Registry.MustRegister(storageDuration, storageErrors, stateSize)
+}
+
+// InstrumentedStorage wraps a StateStorage and records the duration and
+// failures of every call, labelled with the backend name
+type InstrumentedStorage struct {
+	storage.StateStorage
+
+	backend string
+}
+
+// NewInstrumentedStorage wraps inner, labelling its metrics with backend
+func NewInstrumentedStorage(inner storage.StateStorage, backend string) *InstrumentedStorage {
+	return &InstrumentedStorage{StateStorage: inner, backend: backend}
+}
+
+// Unwrap returns the wrapped storage
+func (s *InstrumentedStorage) Unwrap() storage.StateStorage {
+	return s.StateStorage
+}
+
+// observe records a call to method that started at start and returned err.
+// Every call is also logged at debug level, with the request ID of ctx.
+func (s *InstrumentedStorage) observe(ctx context.Context, method string, start time.Time, err error) {
+	duration := time.Since(start)
+	storageDuration.WithLabelValues(s.backend, method).Observe(duration.Seconds())
+	if isFailure(err) {
+		storageErrors.WithLabelValues(s.backend, method).Inc()
+		slog.WarnContext(ctx, "Storage call failed", "backend", s.backend, "method", method, "duration_ms", float64(duration.Microseconds())/1000, "error", err)
+		return
+	}
+	if err != nil {
+		slog.DebugContext(ctx, "Storage call", "backend", s.backend, "method", method, "duration_ms", float64(duration.Microseconds())/1000, "result", err)
+		return
+	}
+	slog.DebugContext(ctx, "Storage call", "backend", s.backend, "method", method, "duration_ms", float64(duration.Microseconds())/1000)
+}
+
+// isFailure tells apart errors that point at a broken backend from the
+// expected outcomes callers handle
+func isFailure(err error) bool {
+	switch {
+	case err == nil,
+		errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrLocked),
+		errors.Is(err, storage.ErrConflict),
+		errors.Is(err, storage.ErrNotModified),
+		errors.Is(err, storage.ErrNotSupported):
+		return false
+	}
+	return true
+}
+
+func recordSize(state *models.State) {
+	if state != nil {
+		stateSize.WithLabelValues(state.Workspace, state.ID).Set(float64(len(state.State)))
+	}
+}
+
+func (s *InstrumentedStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	start := time.Now()
+	state, err := s.StateStorage.GetState(ctx, workspace, id)
+	s.observe(ctx, "GetState", start, err)
+	if err == nil {
+		recordSize(state)
+	}
+	return state, err
+}
+
+// GetStateReader streams the state if the backend can and otherwise reads it
+// whole with GetState
+func (s *InstrumentedStorage) GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error) {
+	reader, ok := s.StateStorage.(storage.StreamReader)
+	if !ok {
+		state, err := s.GetState(ctx, workspace, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return state, storage.TakeBody(state), nil
+	}
+	start := time.Now()
+	state, body, err := reader.GetStateReader(ctx, workspace, id)
+	s.observe(ctx, "GetStateReader", start, err)
+	return state, body, err
+}
+
+func (s *InstrumentedStorage) PutState(ctx context.Context, state *models.State) error {
+	start := time.Now()
+	err := s.StateStorage.PutState(ctx, state)
+	s.observe(ctx, "PutState", start, err)
+	if err == nil {
+		recordSize(state)
+	}
+	return err
+}
+
+// PutStateFrom streams the state if the backend can and otherwise reads it
+// whole and writes it with PutState
+func (s *InstrumentedStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	writer, ok := s.StateStorage.(storage.StreamWriter)
+	if !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("failed to read state: %w", err)
+		}
+		state.State = data
+		return s.PutState(ctx, state)
+	}
+	start := time.Now()
+	counter := &storage.CountingReader{R: body}
+	err := writer.PutStateFrom(ctx, state, counter)
+	s.observe(ctx, "PutStateFrom", start, err)
+	if err == nil {
+		stateSize.WithLabelValues(state.Workspace, state.ID).Set(float64(counter.N))
+	}
+	return err
+}
+
+func (s *InstrumentedStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	start := time.Now()
+	err := s.StateStorage.DeleteState(ctx, workspace, id)
+	s.observe(ctx, "DeleteState", start, err)
+	if err == nil {
+		stateSize.DeleteLabelValues(workspace, id)
+	}
+	return err
+}
+
+func (s *InstrumentedStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	start := time.Now()
+	states, err := s.StateStorage.ListStates(ctx, workspace)
+	s.observe(ctx, "ListStates", start, err)
+	return states, err
+}
+
+func (s *InstrumentedStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	workspaces, err := s.StateStorage.ListWorkspaces(ctx)
+	s.observe(ctx, "ListWorkspaces", start, err)
+	return workspaces, err
+}
+
+func (s *InstrumentedStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	start := time.Now()
+	err := s.StateStorage.Lock(ctx, workspace, id, lock)
+	s.observe(ctx, "Lock", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) Unlock(ctx context.Context, workspace, id string) error {
+	start := time.Now()
+	err := s.StateStorage.Unlock(ctx, workspace, id)
+	s.observe(ctx, "Unlock", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	start := time.Now()
+	err := s.StateStorage.UnlockIfMatch(ctx, workspace, id, lock)
+	s.observe(ctx, "UnlockIfMatch", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	start := time.Now()
+	lock, err := s.StateStorage.GetLock(ctx, workspace, id)
+	s.observe(ctx, "GetLock", start, err)
+	return lock, err
+}
+
+func (s *InstrumentedStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	start := time.Now()
+	locks, err := s.StateStorage.ListLocks(ctx, workspace)
+	s.observe(ctx, "ListLocks", start, err)
+	return locks, err
+}
+
+func (s *InstrumentedStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	start := time.Now()
+	err := s.StateStorage.RenewLock(ctx, workspace, id, lock)
+	s.observe(ctx, "RenewLock", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	start := time.Now()
+	meta, err := s.StateStorage.GetWorkspaceMeta(ctx, workspace)
+	s.observe(ctx, "GetWorkspaceMeta", start, err)
+	return meta, err
+}
+
+func (s *InstrumentedStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	start := time.Now()
+	err := s.StateStorage.PutWorkspaceMeta(ctx, meta)
+	s.observe(ctx, "PutWorkspaceMeta", start, err)
+	return err
+}
+
+// PutStateIfMatch makes the write conditional if the backend supports it and
+// writes unconditionally otherwise
+func (s *InstrumentedStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	writer, ok := s.StateStorage.(storage.ConditionalWriter)
+	if !ok {
+		return s.PutState(ctx, state)
+	}
+	start := time.Now()
+	err := writer.PutStateIfMatch(ctx, state, revision)
+	s.observe(ctx, "PutStateIfMatch", start, err)
+	if err == nil {
+		recordSize(state)
+	}
+	return err
+}
+
+// GetStateIfNoneMatch uses the conditional read of the backend if it has one
+// and otherwise always returns the state
+func (s *InstrumentedStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	reader, ok := s.StateStorage.(storage.ConditionalReader)
+	if !ok {
+		return s.GetState(ctx, workspace, id)
+	}
+	start := time.Now()
+	state, err := reader.GetStateIfNoneMatch(ctx, workspace, id, revision)
+	s.observe(ctx, "GetStateIfNoneMatch", start, err)
+	if err == nil {
+		recordSize(state)
+	}
+	return state, err
+}
+
+func (s *InstrumentedStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := s.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	start := time.Now()
+	versions, err := history.ListStateVersions(ctx, workspace, id)
+	s.observe(ctx, "ListStateVersions", start, err)
+	return versions, err
+}
+
+func (s *InstrumentedStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	history, ok := s.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	start := time.Now()
+	state, err := history.GetStateVersion(ctx, workspace, id, version)
+	s.observe(ctx, "GetStateVersion", start, err)
+	return state, err
+}
+
+// Close closes the wrapped storage if it can be closed
+func (s *InstrumentedStorage) Close() error {
+	if closer, ok := s.StateStorage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
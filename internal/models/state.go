@@ -13,6 +13,18 @@ type State struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	LockID    string    `json:"lock_id,omitempty"`
 	LockedAt  time.Time `json:"locked_at,omitempty"`
+	// Revision identifies the stored copy for conditional writes; its format
+	// is specific to the storage backend
+	Revision string `json:"revision,omitempty"`
+}
+
+// StateVersion describes a previous version of a state kept by backends with
+// history
+type StateVersion struct {
+	Version   string    `json:"version"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
 }
 
 type StateLock struct {
@@ -23,6 +35,51 @@ type StateLock struct {
 	Version   string    `json:"version"`
 	Created   time.Time `json:"created"`
 	Path      string    `json:"path"`
+	// Workspace and StateID identify the locked state; they are filled in by
+	// the storage backend
+	Workspace string `json:"workspace,omitempty"`
+	StateID   string `json:"state_id,omitempty"`
+	// LeaseID is the lease that holds the lock on backends with native leases
+	LeaseID string `json:"lease_id,omitempty"`
+	// TTLSeconds is the length of the lock lease; zero means it never expires
+	TTLSeconds int64     `json:"ttl_seconds,omitempty"`
+	Renewed    time.Time `json:"renewed,omitempty"`
+	// Revision identifies the stored lock for conditional unlocks; it is set
+	// by the storage backend when reading a lock and never stored
+	Revision string `json:"-"`
+}
+
+// Expires returns when the lock lease runs out, or the zero time if the lock
+// has no TTL. The lease starts at Created and restarts at every renewal.
+func (l *StateLock) Expires() time.Time {
+	if l.TTLSeconds <= 0 {
+		return time.Time{}
+	}
+	start := l.Created
+	if l.Renewed.After(start) {
+		start = l.Renewed
+	}
+	return start.Add(time.Duration(l.TTLSeconds) * time.Second)
+}
+
+// Expired reports whether the lock lease ran out before now
+func (l *StateLock) Expired(now time.Time) bool {
+	expires := l.Expires()
+	return !expires.IsZero() && now.After(expires)
+}
+
+// WorkspaceMeta holds per-workspace policy that applies to every state in it
+type WorkspaceMeta struct {
+	Workspace string    `json:"workspace"`
+	Protected bool      `json:"protected"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type Token struct {
+	Token     string    `json:"token"`
+	Subject   string    `json:"subject"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type TokenResponse struct {
@@ -0,0 +1,222 @@
+// Package ratelimit limits the request rate of every client with token
+// buckets, separately for each class of routes.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Route classes
+const (
+	Reads  = "reads"
+	Writes = "writes"
+	Locks  = "locks"
+	Login  = "login"
+)
+
+// sweepInterval is how often buckets of clients gone quiet are dropped
+const sweepInterval = time.Minute
+
+// Rate is the sustained rate of a class in requests per second and the burst
+// allowed on top of it. A zero Rate leaves the class unlimited.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// IdentityFunc returns the authenticated identity of a request, or an empty
+// string for anonymous requests, which are limited by client IP instead
+type IdentityFunc func(r *http.Request) string
+
+// Limiter keeps a token bucket per class and client
+type Limiter struct {
+	rates    map[string]Rate
+	proxies  []netip.Prefix
+	identity IdentityFunc
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*bucket
+	lastSweep time.Time
+
+	limited map[string]*atomic.Int64
+}
+
+type bucketKey struct {
+	class, client string
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// New returns a limiter applying rates, keyed by class. X-Forwarded-For is
+// only believed on requests coming from trustedProxies, given as IPs or CIDR
+// prefixes.
+func New(rates map[string]Rate, trustedProxies []string, identity IdentityFunc) (*Limiter, error) {
+	l := &Limiter{
+		rates:    rates,
+		identity: identity,
+		buckets:  make(map[bucketKey]*bucket),
+		limited:  make(map[string]*atomic.Int64),
+	}
+	for _, proxy := range trustedProxies {
+		prefix, err := ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		l.proxies = append(l.proxies, prefix)
+	}
+	for class := range rates {
+		l.limited[class] = &atomic.Int64{}
+	}
+	return l, nil
+}
+
+// ParsePrefix parses an IP or a CIDR prefix
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+// Limited returns how many requests of class were refused so far
+func (l *Limiter) Limited(class string) int64 {
+	if counter, ok := l.limited[class]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// Classes returns the classes with a rate
+func (l *Limiter) Classes() []string {
+	classes := make([]string, 0, len(l.rates))
+	for class := range l.rates {
+		classes = append(classes, class)
+	}
+	return classes
+}
+
+// Limit refuses requests of class over the rate of their client with 429 and
+// a Retry-After header
+func (l *Limiter) Limit(class string, next http.HandlerFunc) http.HandlerFunc {
+	limit := l.rates[class]
+	if limit.PerSecond <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := l.identity(r)
+		if client == "" {
+			client = "ip:" + clientNetwork(l.ClientIP(r))
+		}
+
+		now := time.Now()
+		reservation := l.bucket(class, client, limit, now).ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			l.limited[class].Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// bucket returns the bucket of client for class, creating it full
+func (l *Limiter) bucket(class, client string, limit Rate, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		l.sweep(now)
+	}
+	key := bucketKey{class, client}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.PerSecond), limit.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter
+}
+
+// sweep drops the buckets that refilled since they were last used, which
+// behave like new ones
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.rates[key.class]
+		refill := time.Duration(float64(limit.Burst) / limit.PerSecond * float64(time.Second))
+		if now.Sub(b.lastSeen) > max(refill, sweepInterval) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// ClientIP returns the address of the client that made r. Behind trusted
+// proxies it is the last address in X-Forwarded-For that isn't a trusted
+// proxy itself.
+func (l *Limiter) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && l.trusted(addr); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+	}
+	return addr
+}
+
+func (l *Limiter) trusted(addr netip.Addr) bool {
+	for _, prefix := range l.proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientNetwork returns the key of a client address. IPv6 clients usually get
+// a whole /64, so they are limited by it.
+func clientNetwork(addr netip.Addr) string {
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
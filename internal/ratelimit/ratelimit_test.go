@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newLimiter(t *testing.T, rates map[string]Rate, proxies ...string) *Limiter {
+	l, err := New(rates, proxies, func(r *http.Request) string { return r.Header.Get("X-Identity") })
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return l
+}
+
+func TestBucketRefill(t *testing.T) {
+	limit := Rate{PerSecond: 10, Burst: 2}
+	l := newLimiter(t, map[string]Rate{Reads: limit})
+	now := time.Now()
+
+	b := l.bucket(Reads, "client", limit, now)
+	for i := range limit.Burst {
+		if !b.AllowN(now, 1) {
+			t.Fatalf("request %d within the burst refused", i+1)
+		}
+	}
+	if b.AllowN(now, 1) {
+		t.Error("request above the burst allowed")
+	}
+	if !b.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Error("request refused after a token refilled")
+	}
+	if b != l.bucket(Reads, "client", limit, now) {
+		t.Error("bucket of the same client and class not reused")
+	}
+	if b == l.bucket(Writes, "client", limit, now) || b == l.bucket(Reads, "other", limit, now) {
+		t.Error("bucket shared across classes or clients")
+	}
+}
+
+func TestLimit(t *testing.T) {
+	l := newLimiter(t, map[string]Rate{Login: {PerSecond: 0.5, Burst: 1}})
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	handler := l.Limit(Login, ok)
+
+	request := func(remote, identity string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/login", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Identity", identity)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	if w := request("192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request = %d, want 200", w.Code)
+	}
+	w := request("192.0.2.1:4321", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if got := l.Limited(Login); got != 1 {
+		t.Errorf("Limited = %d, want 1", got)
+	}
+
+	// Other clients and authenticated identities have their own buckets
+	if w := request("192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("request of another IP = %d, want 200", w.Code)
+	}
+	if w := request("192.0.2.1:1234", "token:1"); w.Code != http.StatusOK {
+		t.Errorf("request of a token from the same IP = %d, want 200", w.Code)
+	}
+}
+
+func TestLimitUnlimitedClass(t *testing.T) {
+	l := newLimiter(t, map[string]Rate{Reads: {PerSecond: 0, Burst: 1}})
+	calls := 0
+	handler := l.Limit(Reads, func(w http.ResponseWriter, r *http.Request) { calls++ })
+	for range 10 {
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if calls != 10 {
+		t.Errorf("%d of 10 requests of a class without rate passed", calls)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	l := newLimiter(t, nil, "10.0.0.0/8", "2001:db8:ffff::1")
+	for _, tc := range []struct {
+		name, remote string
+		forwarded    []string
+		want         string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted proxy", "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+		{"trusted proxy", "10.1.2.3:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed first hop", "10.1.2.3:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{"proxy chain", "10.1.2.3:1234", []string{"198.51.100.7, 10.9.9.9"}, "198.51.100.7"},
+		{"repeated header", "10.1.2.3:1234", []string{"198.51.100.7", "10.9.9.9"}, "198.51.100.7"},
+		{"all trusted", "10.1.2.3:1234", []string{"10.4.4.4"}, "10.4.4.4"},
+		{"invalid hop", "10.1.2.3:1234", []string{"198.51.100.7, junk"}, "10.1.2.3"},
+		{"mapped IPv4", "[::ffff:10.1.2.3]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"IPv6 proxy", "[2001:db8:ffff::1]:1234", []string{"2001:db8::5"}, "2001:db8::5"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, header := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := l.ClientIP(r).String(); got != tc.want {
+				t.Errorf("ClientIP = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClientNetwork(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1":            "192.0.2.1",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+		"2001:db8:1:2:ffff::1": "2001:db8:1:2::/64",
+		"2001:db8:1:3::1":      "2001:db8:1:3::/64",
+	} {
+		if got := clientNetwork(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("clientNetwork(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	limit := Rate{PerSecond: 1, Burst: 300}
+	l := newLimiter(t, map[string]Rate{Reads: limit, Login: {PerSecond: 10, Burst: 1}})
+	start := time.Now()
+	l.bucket(Reads, "slow", limit, start)
+	l.bucket(Login, "quiet", Rate{PerSecond: 10, Burst: 1}, start)
+	l.bucket(Reads, "busy", limit, start.Add(2*sweepInterval))
+
+	// Buckets are kept until they have refilled, and for at least a sweep
+	// interval
+	l.sweep(start.Add(2 * sweepInterval))
+	for _, key := range []bucketKey{{Reads, "slow"}, {Reads, "busy"}} {
+		if _, ok := l.buckets[key]; !ok {
+			t.Errorf("bucket %v dropped before it refilled", key)
+		}
+	}
+	if _, ok := l.buckets[bucketKey{Login, "quiet"}]; ok {
+		t.Error("refilled bucket kept")
+	}
+
+	l.sweep(start.Add(6 * sweepInterval))
+	if _, ok := l.buckets[bucketKey{Reads, "slow"}]; ok {
+		t.Error("bucket kept after it refilled")
+	}
+	if _, ok := l.buckets[bucketKey{Reads, "busy"}]; !ok {
+		t.Error("bucket used since dropped before it refilled")
+	}
+}
+
+func TestNewInvalidProxy(t *testing.T) {
+	if _, err := New(nil, []string{"not-an-ip"}, nil); err == nil {
+		t.Error("New accepted an invalid trusted proxy")
+	}
+}
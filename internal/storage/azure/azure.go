@@ -0,0 +1,454 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// metaKeyName is the workspace metadata blob kept next to the state blobs
+const metaKeyName = ".workspace.json"
+
+// uuidPattern matches lock IDs that can double as lease IDs
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// AzureStorage stores states as block blobs in an Azure Storage container.
+// A lock is an infinite lease on the state's .lock blob, whose content holds
+// the lock info, so only the lease holder can take or change a lock.
+type AzureStorage struct {
+	container *container.Client
+	prefix    string // Optional prefix for all blob names
+}
+
+func NewAzureStorage(client *container.Client, prefix string) *AzureStorage {
+	return &AzureStorage{
+		container: client,
+		prefix:    prefix,
+	}
+}
+
+// getFullKey returns the complete blob name including any configured prefix
+func (a *AzureStorage) getFullKey(workspace, id string) string {
+	key := fmt.Sprintf("%s/%s", workspace, id)
+	if a.prefix != "" {
+		key = fmt.Sprintf("%s/%s", a.prefix, key)
+	}
+	return key
+}
+
+// getLockKey returns the name of the blob whose lease is the lock of a state
+func (a *AzureStorage) getLockKey(workspace, id string) string {
+	return a.getFullKey(workspace, id) + ".lock"
+}
+
+// download reads a whole blob
+func (a *AzureStorage) download(ctx context.Context, name string) ([]byte, *blob.DownloadStreamResponse, error) {
+	resp, err := a.container.NewBlobClient(name).DownloadStream(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &resp, nil
+}
+
+// upload writes a whole blob under the given access conditions
+func (a *AzureStorage) upload(ctx context.Context, name string, data []byte, conditions *blob.AccessConditions) error {
+	_, err := a.container.NewBlockBlobClient(name).Upload(ctx, streaming.NopCloser(bytes.NewReader(data)), &blockblob.UploadOptions{
+		HTTPHeaders:      &blob.HTTPHeaders{BlobContentType: to.Ptr("application/json")},
+		AccessConditions: conditions,
+	})
+	return err
+}
+
+func (a *AzureStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	data, resp, err := a.download(ctx, a.getFullKey(workspace, id))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get state from Azure: %w", err)
+	}
+
+	state := &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+	}
+	if resp.LastModified != nil {
+		state.UpdatedAt = *resp.LastModified
+	}
+	if resp.ETag != nil {
+		state.MD5 = string(*resp.ETag)
+	}
+	return state, nil
+}
+
+func (a *AzureStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := a.upload(ctx, a.getFullKey(state.Workspace, state.ID), state.State, nil); err != nil {
+		return fmt.Errorf("failed to put state to Azure: %w", err)
+	}
+	return nil
+}
+
+func (a *AzureStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if _, err := a.container.NewBlobClient(a.getFullKey(workspace, id)).Delete(ctx, nil); err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete state from Azure: %w", err)
+	}
+	return nil
+}
+
+func (a *AzureStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	prefix := a.getFullKey(workspace, "")
+	pager := a.container.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+		Prefix: to.Ptr(prefix),
+	})
+
+	states := []models.State{}
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list states from Azure: %w", err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			id := strings.TrimPrefix(*item.Name, prefix)
+			if id == metaKeyName || strings.HasSuffix(id, ".lock") {
+				continue
+			}
+			state := models.State{
+				ID:        id,
+				Workspace: workspace,
+			}
+			if item.Properties != nil && item.Properties.LastModified != nil {
+				state.UpdatedAt = *item.Properties.LastModified
+			}
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// leaseClient returns a client for the lease on the lock blob of a state.
+// Lock IDs in UUID form, as Terraform generates them, are used as lease ID;
+// otherwise the SDK generates one.
+func (a *AzureStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	prefix := a.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	pager := a.container.NewListBlobsHierarchyPager("/", &container.ListBlobsHierarchyOptions{
+		Prefix: to.Ptr(prefix),
+	})
+
+	workspaces := []string{}
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list workspaces from Azure: %w", err)
+		}
+		for _, p := range page.Segment.BlobPrefixes {
+			workspaces = append(workspaces, strings.TrimSuffix(strings.TrimPrefix(*p.Name, prefix), "/"))
+		}
+	}
+	return workspaces, nil
+}
+
+func (a *AzureStorage) leaseClient(workspace, id, lockID string) (*lease.BlobClient, error) {
+	options := &lease.BlobClientOptions{}
+	if uuidPattern.MatchString(lockID) {
+		options.LeaseID = to.Ptr(lockID)
+	}
+	return lease.NewBlobClient(a.container.NewBlockBlobClient(a.getLockKey(workspace, id)), options)
+}
+
+// Lock acquires an infinite lease on the lock blob, creating the blob first
+// if needed, and then writes the lock info under that lease.
+func (a *AzureStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	key := a.getLockKey(workspace, id)
+	err := a.upload(ctx, key, nil, &blob.AccessConditions{
+		ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: to.Ptr(azcore.ETagAny)},
+	})
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobAlreadyExists, bloberror.ConditionNotMet, bloberror.LeaseIDMissing) {
+		return fmt.Errorf("failed to create lock blob in Azure: %w", err)
+	}
+
+	leaseClient, err := a.leaseClient(workspace, id, lock.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create lease client: %w", err)
+	}
+	if _, err := leaseClient.AcquireLease(ctx, -1, nil); err != nil {
+		if !bloberror.HasCode(err, bloberror.LeaseAlreadyPresent) {
+			return fmt.Errorf("failed to acquire lease in Azure: %w", err)
+		}
+
+		// Taking a lock again under the same lock ID succeeds
+		current, err := a.GetLock(ctx, workspace, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return storage.ErrLocked
+			}
+			return err
+		}
+		if current.ID != lock.ID {
+			return storage.ErrLocked
+		}
+		return nil
+	}
+
+	if err := a.writeLock(ctx, workspace, id, lock, *leaseClient.LeaseID()); err != nil {
+		// Don't leave a lease behind that nobody knows the lock ID of
+		leaseClient.ReleaseLease(context.WithoutCancel(ctx), nil)
+		return err
+	}
+	return nil
+}
+
+// writeLock stores the lock info in the lock blob held under leaseID
+func (a *AzureStorage) writeLock(ctx context.Context, workspace, id string, lock *models.StateLock, leaseID string) error {
+	record := *lock
+	record.Workspace, record.StateID, record.LeaseID = workspace, id, leaseID
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock data: %w", err)
+	}
+
+	err = a.upload(ctx, a.getLockKey(workspace, id), data, &blob.AccessConditions{
+		LeaseAccessConditions: &blob.LeaseAccessConditions{LeaseID: to.Ptr(leaseID)},
+	})
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.LeaseIDMismatchWithBlobOperation, bloberror.LeaseLost, bloberror.LeaseNotPresentWithBlobOperation) {
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to put lock to Azure: %w", err)
+	}
+	return nil
+}
+
+// Unlock breaks the lease immediately, which also works for clients that
+// never knew the lease ID, and clears the lock info.
+func (a *AzureStorage) Unlock(ctx context.Context, workspace, id string) error {
+	if _, err := a.GetLock(ctx, workspace, id); err != nil {
+		return err
+	}
+
+	leaseClient, err := a.leaseClient(workspace, id, "")
+	if err != nil {
+		return fmt.Errorf("failed to create lease client: %w", err)
+	}
+	if _, err := leaseClient.BreakLease(ctx, &lease.BlobBreakOptions{BreakPeriod: to.Ptr(int32(0))}); err != nil {
+		if bloberror.HasCode(err, bloberror.LeaseNotPresentWithLeaseOperation) {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("failed to break lease in Azure: %w", err)
+	}
+
+	// Best effort: a new holder may already have leased the blob again
+	a.upload(ctx, a.getLockKey(workspace, id), nil, nil)
+	return nil
+}
+
+// UnlockIfMatch breaks the lease on condition that the lock blob is unchanged
+// since lock was read; taking the lock again or renewing it rewrites the blob.
+func (a *AzureStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if lock.Revision == "" {
+		return storage.ErrLocked
+	}
+
+	leaseClient, err := a.leaseClient(workspace, id, "")
+	if err != nil {
+		return fmt.Errorf("failed to create lease client: %w", err)
+	}
+	_, err = leaseClient.BreakLease(ctx, &lease.BlobBreakOptions{
+		BreakPeriod:              to.Ptr(int32(0)),
+		ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: to.Ptr(azcore.ETag(lock.Revision))},
+	})
+	if err != nil {
+		switch {
+		case bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.LeaseNotPresentWithLeaseOperation):
+			return storage.ErrNotFound
+		case bloberror.HasCode(err, bloberror.ConditionNotMet):
+			if _, err := a.GetLock(ctx, workspace, id); err != nil {
+				return err
+			}
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to break lease in Azure: %w", err)
+	}
+
+	// Best effort, as in Unlock
+	a.upload(ctx, a.getLockKey(workspace, id), nil, nil)
+	return nil
+}
+
+// GetLock returns the lock info of a leased lock blob. A blob without an
+// active lease is not a lock.
+func (a *AzureStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	key := a.getLockKey(workspace, id)
+	props, err := a.container.NewBlobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get lock from Azure: %w", err)
+	}
+	if props.LeaseState == nil || *props.LeaseState != lease.StateTypeLeased {
+		return nil, storage.ErrNotFound
+	}
+
+	return a.readLock(ctx, key, workspace, id)
+}
+
+func (a *AzureStorage) readLock(ctx context.Context, key, workspace, id string) (*models.StateLock, error) {
+	data, resp, err := a.download(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get lock from Azure: %w", err)
+	}
+
+	var lock models.StateLock
+	// The lease is taken before the lock info is written
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &lock); err != nil {
+			return nil, fmt.Errorf("failed to decode lock data: %w", err)
+		}
+	}
+	lock.Workspace, lock.StateID = workspace, id
+	if resp.ETag != nil {
+		lock.Revision = string(*resp.ETag)
+	}
+	return &lock, nil
+}
+
+func (a *AzureStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	prefix := a.prefix
+	if workspace != "" {
+		prefix = a.getFullKey(workspace, "")
+	} else if prefix != "" {
+		prefix += "/"
+	}
+
+	locks := []models.StateLock{}
+	pager := a.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: to.Ptr(prefix),
+	})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list locks from Azure: %w", err)
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			name := *item.Name
+			if !strings.HasSuffix(name, ".lock") || item.Properties == nil ||
+				item.Properties.LeaseState == nil || *item.Properties.LeaseState != lease.StateTypeLeased {
+				continue
+			}
+
+			// Names are <prefix>/<workspace>/<id>.lock
+			rest := strings.TrimSuffix(strings.TrimPrefix(name, a.prefix), ".lock")
+			ws, id, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+			lock, err := a.readLock(ctx, name, ws, id)
+			if err != nil {
+				// The lock was released while listing
+				if errors.Is(err, storage.ErrNotFound) {
+					continue
+				}
+				return nil, err
+			}
+			locks = append(locks, *lock)
+		}
+	}
+	return locks, nil
+}
+
+// RenewLock rewrites the lock info under the lease of the held lock. The
+// lease itself is infinite and needs no renewal.
+func (a *AzureStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	current, err := a.GetLock(ctx, workspace, id)
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return a.writeLock(ctx, workspace, id, lock, current.LeaseID)
+}
+
+func (a *AzureStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	data, _, err := a.download(ctx, a.getFullKey(workspace, metaKeyName))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get workspace metadata from Azure: %w", err)
+	}
+
+	var meta models.WorkspaceMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode workspace metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (a *AzureStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal workspace metadata: %w", err)
+	}
+
+	if err := a.upload(ctx, a.getFullKey(meta.Workspace, metaKeyName), data, nil); err != nil {
+		return fmt.Errorf("failed to put workspace metadata to Azure: %w", err)
+	}
+	return nil
+}
+
+// Ping writes the sentinel blob next to the workspaces and reads it back
+func (a *AzureStorage) Ping(ctx context.Context) error {
+	name := storage.HealthKeyName
+	if a.prefix != "" {
+		name = a.prefix + "/" + name
+	}
+	sentinel := time.Now().UTC().Format(time.RFC3339Nano)
+
+	if err := a.upload(ctx, name, []byte(sentinel), nil); err != nil {
+		return fmt.Errorf("failed to write sentinel to Azure: %w", err)
+	}
+	data, _, err := a.download(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel from Azure: %w", err)
+	}
+	if string(data) != sentinel {
+		return errors.New("sentinel read back from Azure does not match the one written")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+// azuriteConnectionString is the well-known development account of a local
+// Azurite, used unless AZURITE_CONNECTION_STRING is set
+const azuriteConnectionString = "DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+var containers atomic.Int64
+
+// azurite returns the connection string of the Azurite emulator, or skips the
+// test if Azurite isn't running
+func azurite(t *testing.T) string {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		connectionString = azuriteConnectionString
+	}
+	for _, part := range strings.Split(connectionString, ";") {
+		if endpoint, ok := strings.CutPrefix(part, "BlobEndpoint="); ok {
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				t.Fatalf("invalid BlobEndpoint %q: %v", endpoint, err)
+			}
+			conn, err := net.DialTimeout("tcp", u.Host, time.Second)
+			if err != nil {
+				t.Skipf("Azurite unreachable at %s: %v", u.Host, err)
+			}
+			conn.Close()
+		}
+	}
+	return connectionString
+}
+
+// newContainer returns a backend on a new container of the account
+func newContainer(t *testing.T, connectionString string) *AzureStorage {
+	name := fmt.Sprintf("terrastate-%d-%d", time.Now().UnixNano(), containers.Add(1))
+	client, err := container.NewClientFromConnectionString(connectionString, name, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromConnectionString: %v", err)
+	}
+	if _, err := client.Create(context.Background(), nil); err != nil {
+		t.Fatalf("creating container %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		client.Delete(context.Background(), nil)
+	})
+	return NewAzureStorage(client, "terrastate")
+}
+
+func TestConformance(t *testing.T) {
+	connectionString := azurite(t)
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return newContainer(t, connectionString)
+	})
+}
@@ -0,0 +1,329 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// fileExt marks the files the cache keeps in its directory
+const fileExt = ".state"
+
+// Stats reports how well the cache is doing
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// entry is a cached state. Its body is held in data for an in-memory cache
+// and in a file named after the state and revision for an on-disk cache.
+type entry struct {
+	workspace string
+	id        string
+	revision  string
+	updatedAt time.Time
+	size      int64
+	data      []byte
+}
+
+type key struct {
+	workspace, id string
+}
+
+// CachingStorage wraps a StateStorage and keeps recently used states in
+// memory or in a local directory. A cached state is only served after the
+// wrapped storage confirmed it is still current with a conditional read, so
+// caching takes effect for storages implementing storage.ConditionalReader
+// and other storages are read as before. Writes go through to the wrapped
+// storage and replace the cached copy. Locks and metadata are never cached.
+// The least recently used states are dropped to stay within maxBytes.
+type CachingStorage struct {
+	storage.StateStorage
+
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[key]*list.Element
+	lru     *list.List // of *entry, most recently used first
+	bytes   int64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// NewCachingStorage wraps inner with a cache of at most maxBytes of state
+// data. If dir is empty the cache is kept in memory, otherwise in files in
+// dir; cache files left in dir by a previous run are removed.
+func NewCachingStorage(inner storage.StateStorage, dir string, maxBytes int64) (*CachingStorage, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory: %w", err)
+		}
+		stale, err := filepath.Glob(filepath.Join(dir, "*"+fileExt))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range stale {
+			os.Remove(path)
+		}
+	}
+
+	return &CachingStorage{
+		StateStorage: inner,
+		dir:          dir,
+		maxBytes:     maxBytes,
+		entries:      make(map[key]*list.Element),
+		lru:          list.New(),
+	}, nil
+}
+
+// Unwrap returns the wrapped storage
+func (c *CachingStorage) Unwrap() storage.StateStorage {
+	return c.StateStorage
+}
+
+// Stats returns the cache counters and current size
+func (c *CachingStorage) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+	}
+}
+
+func (c *CachingStorage) filePath(e *entry) string {
+	sum := sha256.Sum256([]byte(e.workspace + "/" + e.id + "@" + e.revision))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+fileExt)
+}
+
+func (c *CachingStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	reader, ok := c.StateStorage.(storage.ConditionalReader)
+	if !ok {
+		return c.StateStorage.GetState(ctx, workspace, id)
+	}
+
+	var state *models.State
+	var err error
+	if cached := c.lookup(workspace, id); cached != nil {
+		state, err = reader.GetStateIfNoneMatch(ctx, workspace, id, cached.Revision)
+		if errors.Is(err, storage.ErrNotModified) {
+			c.hits.Add(1)
+			return cached, nil
+		}
+	} else {
+		state, err = c.StateStorage.GetState(ctx, workspace, id)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.remove(workspace, id)
+		}
+		return nil, err
+	}
+
+	c.misses.Add(1)
+	c.store(state)
+	return state, nil
+}
+
+func (c *CachingStorage) PutState(ctx context.Context, state *models.State) error {
+	err := c.StateStorage.PutState(ctx, state)
+	c.afterWrite(state, err)
+	return err
+}
+
+// PutStateIfMatch makes the write conditional if the wrapped storage
+// supports it and writes unconditionally otherwise
+func (c *CachingStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	var err error
+	if writer, ok := c.StateStorage.(storage.ConditionalWriter); ok {
+		err = writer.PutStateIfMatch(ctx, state, revision)
+	} else {
+		err = c.StateStorage.PutState(ctx, state)
+	}
+	c.afterWrite(state, err)
+	return err
+}
+
+// afterWrite caches a written state, or drops the cached copy if the outcome
+// of the write is unknown
+func (c *CachingStorage) afterWrite(state *models.State, err error) {
+	if _, ok := c.StateStorage.(storage.ConditionalReader); !ok {
+		return
+	}
+	if err != nil {
+		c.remove(state.Workspace, state.ID)
+		return
+	}
+	written := *state
+	written.UpdatedAt = time.Now().UTC()
+	c.store(&written)
+}
+
+func (c *CachingStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	defer c.remove(workspace, id)
+	return c.StateStorage.DeleteState(ctx, workspace, id)
+}
+
+func (c *CachingStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := c.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return history.ListStateVersions(ctx, workspace, id)
+}
+
+func (c *CachingStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	history, ok := c.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return history.GetStateVersion(ctx, workspace, id, version)
+}
+
+// Close closes the wrapped storage if it needs closing
+func (c *CachingStorage) Close() error {
+	if closer, ok := c.StateStorage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// lookup returns a copy of the cached state, or nil if there is none
+func (c *CachingStorage) lookup(workspace, id string) *models.State {
+	c.mu.Lock()
+	elem, ok := c.entries[key{workspace, id}]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	e := *elem.Value.(*entry)
+	c.mu.Unlock()
+
+	var data []byte
+	if c.dir == "" {
+		data = append([]byte(nil), e.data...)
+	} else {
+		var err error
+		// The file is gone if the entry was replaced since; read it afresh
+		if data, err = os.ReadFile(c.filePath(&e)); err != nil {
+			return nil
+		}
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+		UpdatedAt: e.updatedAt,
+		MD5:       e.revision,
+		Revision:  e.revision,
+	}
+}
+
+// store caches state, replacing any older copy. States without a revision
+// can't be revalidated and states larger than the whole cache are dropped.
+func (c *CachingStorage) store(state *models.State) {
+	size := int64(len(state.State))
+	if state.Revision == "" || size > c.maxBytes {
+		c.remove(state.Workspace, state.ID)
+		return
+	}
+
+	e := &entry{
+		workspace: state.Workspace,
+		id:        state.ID,
+		revision:  state.Revision,
+		updatedAt: state.UpdatedAt,
+		size:      size,
+	}
+	if c.dir == "" {
+		e.data = append([]byte(nil), state.State...)
+	} else if err := c.writeFile(e, state.State); err != nil {
+		c.remove(state.Workspace, state.ID)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key{e.workspace, e.id}]; ok && elem.Value.(*entry).revision == e.revision {
+		// Already cached; for a disk cache the file was just rewritten in place
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.removeLocked(key{e.workspace, e.id})
+	c.entries[key{e.workspace, e.id}] = c.lru.PushFront(e)
+	c.bytes += size
+
+	for c.bytes > c.maxBytes {
+		oldest := c.lru.Back().Value.(*entry)
+		c.removeLocked(key{oldest.workspace, oldest.id})
+		c.evictions.Add(1)
+	}
+}
+
+// writeFile writes the body of e to its cache file atomically
+func (c *CachingStorage) writeFile(e *entry, data []byte) error {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.filePath(e)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (c *CachingStorage) remove(workspace, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key{workspace, id})
+}
+
+// removeLocked drops a cached state; c.mu must be held
+func (c *CachingStorage) removeLocked(k key) {
+	elem, ok := c.entries[k]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*entry)
+	c.lru.Remove(elem)
+	delete(c.entries, k)
+	c.bytes -= e.size
+	if c.dir != "" {
+		os.Remove(c.filePath(e))
+	}
+}
@@ -0,0 +1,286 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+)
+
+// revisionStorage is a memory backend with conditional reads. It counts the
+// states it sends whole.
+type revisionStorage struct {
+	storage.StateStorage
+
+	mu        sync.Mutex
+	revisions map[key]string
+	seq       int
+	reads     int
+}
+
+func newRevisionStorage() *revisionStorage {
+	return &revisionStorage{StateStorage: memory.NewMemoryStorage(), revisions: make(map[key]string)}
+}
+
+func (s *revisionStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	state, err := s.StateStorage.GetState(ctx, workspace, id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	state.Revision = s.revisions[key{workspace, id}]
+	return state, nil
+}
+
+func (s *revisionStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	s.mu.Lock()
+	current, ok := s.revisions[key{workspace, id}]
+	s.mu.Unlock()
+	if ok && current == revision {
+		return nil, storage.ErrNotModified
+	}
+	return s.GetState(ctx, workspace, id)
+}
+
+func (s *revisionStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := s.StateStorage.PutState(ctx, state); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	state.Revision = strconv.Itoa(s.seq)
+	s.revisions[key{state.Workspace, state.ID}] = state.Revision
+	return nil
+}
+
+func (s *revisionStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	s.mu.Lock()
+	delete(s.revisions, key{workspace, id})
+	s.mu.Unlock()
+	return s.StateStorage.DeleteState(ctx, workspace, id)
+}
+
+func (s *revisionStorage) fullReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads
+}
+
+// forEachMode runs test against a cache in memory and one on disk, both of
+// maxBytes in front of a revisionStorage
+func forEachMode(t *testing.T, maxBytes int64, test func(t *testing.T, c *CachingStorage, inner *revisionStorage)) {
+	for _, mode := range []string{"memory", "disk"} {
+		t.Run(mode, func(t *testing.T) {
+			dir := ""
+			if mode == "disk" {
+				dir = t.TempDir()
+			}
+			inner := newRevisionStorage()
+			c, err := NewCachingStorage(inner, dir, maxBytes)
+			if err != nil {
+				t.Fatalf("NewCachingStorage: %v", err)
+			}
+			test(t, c, inner)
+		})
+	}
+}
+
+func put(t *testing.T, s storage.StateStorage, id, content string) {
+	t.Helper()
+	if err := s.PutState(context.Background(), &models.State{Workspace: "ws", ID: id, State: []byte(content)}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+}
+
+// get reads ws/id and checks its content
+func get(t *testing.T, s storage.StateStorage, id, want string) {
+	t.Helper()
+	state, err := s.GetState(context.Background(), "ws", id)
+	if err != nil || string(state.State) != want {
+		t.Fatalf("GetState(%s) = %v, %v, want %q", id, state, err, want)
+	}
+}
+
+func TestHitsAndMisses(t *testing.T) {
+	forEachMode(t, 1<<20, func(t *testing.T, c *CachingStorage, inner *revisionStorage) {
+		put(t, inner, "app", "v1")
+
+		get(t, c, "app", "v1")
+		get(t, c, "app", "v1")
+		get(t, c, "app", "v1")
+		if stats := c.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != 2 {
+			t.Errorf("Stats = %+v, want 2 hits, 1 miss and 1 entry of 2 bytes", stats)
+		}
+		if reads := inner.fullReads(); reads != 1 {
+			t.Errorf("%d whole reads of the backend, want 1", reads)
+		}
+	})
+}
+
+func TestRevalidation(t *testing.T) {
+	forEachMode(t, 1<<20, func(t *testing.T, c *CachingStorage, inner *revisionStorage) {
+		put(t, inner, "app", "v1")
+		get(t, c, "app", "v1")
+
+		// Changes made behind the cache are picked up by the next read
+		put(t, inner, "app", "v2")
+		get(t, c, "app", "v2")
+		get(t, c, "app", "v2")
+		if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 2 {
+			t.Errorf("Stats = %+v, want 1 hit and 2 misses", stats)
+		}
+
+		if err := inner.DeleteState(context.Background(), "ws", "app"); err != nil {
+			t.Fatalf("DeleteState: %v", err)
+		}
+		if _, err := c.GetState(context.Background(), "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("GetState of a state deleted behind the cache = %v, want ErrNotFound", err)
+		}
+		if stats := c.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+			t.Errorf("Stats = %+v, want the deleted state dropped", stats)
+		}
+	})
+}
+
+func TestWriteThrough(t *testing.T) {
+	forEachMode(t, 1<<20, func(t *testing.T, c *CachingStorage, inner *revisionStorage) {
+		put(t, c, "app", "v1")
+		get(t, inner, "app", "v1")
+
+		// The written state is cached, so the next read is a hit
+		get(t, c, "app", "v1")
+		if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 0 {
+			t.Errorf("Stats = %+v, want a hit on the written state", stats)
+		}
+
+		if err := c.PutStateIfMatch(context.Background(), &models.State{Workspace: "ws", ID: "app", State: []byte("v2")}, ""); err != nil {
+			t.Fatalf("PutStateIfMatch: %v", err)
+		}
+		get(t, inner, "app", "v2")
+		get(t, c, "app", "v2")
+
+		if err := c.DeleteState(context.Background(), "ws", "app"); err != nil {
+			t.Fatalf("DeleteState: %v", err)
+		}
+		if _, err := inner.GetState(context.Background(), "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("GetState on the backend after DeleteState = %v, want ErrNotFound", err)
+		}
+		if stats := c.Stats(); stats.Entries != 0 {
+			t.Errorf("Stats = %+v, want no entries after DeleteState", stats)
+		}
+	})
+}
+
+func TestEviction(t *testing.T) {
+	forEachMode(t, 10, func(t *testing.T, c *CachingStorage, inner *revisionStorage) {
+		put(t, c, "a", "aaaa")
+		put(t, c, "b", "bbbb")
+		// a becomes the most recently used, so b goes first
+		get(t, c, "a", "aaaa")
+		put(t, c, "c", "cccc")
+
+		if stats := c.Stats(); stats.Entries != 2 || stats.Bytes != 8 || stats.Evictions != 1 {
+			t.Fatalf("Stats = %+v, want 2 entries of 8 bytes after 1 eviction", stats)
+		}
+		before := inner.fullReads()
+		get(t, c, "a", "aaaa")
+		get(t, c, "c", "cccc")
+		if reads := inner.fullReads() - before; reads != 0 {
+			t.Errorf("%d whole reads of a and c, want both cached", reads)
+		}
+		get(t, c, "b", "bbbb")
+		if reads := inner.fullReads() - before; reads != 1 {
+			t.Errorf("%d whole reads after reading b, want b evicted", reads)
+		}
+
+		// A state larger than the whole cache isn't cached
+		put(t, c, "large", "0123456789a")
+		if stats := c.Stats(); stats.Bytes > 10 {
+			t.Errorf("Stats = %+v, want at most 10 bytes", stats)
+		}
+		get(t, c, "large", "0123456789a")
+		if stats := c.Stats(); stats.Bytes > 10 {
+			t.Errorf("Stats = %+v, want at most 10 bytes", stats)
+		}
+	})
+}
+
+func TestDiskCacheRestart(t *testing.T) {
+	dir := t.TempDir()
+	inner := newRevisionStorage()
+	c, err := NewCachingStorage(inner, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("NewCachingStorage: %v", err)
+	}
+	put(t, c, "app", "v1")
+	put(t, c, "other", "v1")
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+fileExt)); len(files) != 2 {
+		t.Fatalf("%d cache files, want 2", len(files))
+	}
+
+	// The state changes while the server is down
+	put(t, inner, "app", "v2")
+
+	c, err = NewCachingStorage(inner, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("NewCachingStorage after restart: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+fileExt)); len(files) != 0 {
+		t.Errorf("%d cache files left from the last run, want none", len(files))
+	}
+	get(t, c, "app", "v2")
+	get(t, c, "app", "v2")
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Stats = %+v, want 1 miss and then 1 hit", stats)
+	}
+}
+
+func TestLocksNotCached(t *testing.T) {
+	forEachMode(t, 1<<20, func(t *testing.T, c *CachingStorage, inner *revisionStorage) {
+		ctx := context.Background()
+		if err := c.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-1"}); err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		if lock, err := inner.GetLock(ctx, "ws", "app"); err != nil || lock.ID != "lock-1" {
+			t.Errorf("GetLock on the backend = %v, %v, want lock-1", lock, err)
+		}
+
+		if err := inner.Unlock(ctx, "ws", "app"); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+		if _, err := c.GetLock(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("GetLock after an unlock behind the cache = %v, want ErrNotFound", err)
+		}
+		if stats := c.Stats(); stats.Entries != 0 || stats.Hits+stats.Misses != 0 {
+			t.Errorf("Stats = %+v, want locks left out of the cache", stats)
+		}
+	})
+}
+
+func TestWithoutConditionalReads(t *testing.T) {
+	inner := memory.NewMemoryStorage()
+	c, err := NewCachingStorage(inner, "", 1<<20)
+	if err != nil {
+		t.Fatalf("NewCachingStorage: %v", err)
+	}
+	put(t, c, "app", "v1")
+	get(t, c, "app", "v1")
+	put(t, inner, "app", "v2")
+	get(t, c, "app", "v2")
+
+	if stats := c.Stats(); stats.Entries != 0 || stats.Hits != 0 {
+		t.Errorf("Stats = %+v, want nothing cached", stats)
+	}
+	if storage.ConditionalReads(c) {
+		t.Error("ConditionalReads on a cache in front of memory = true, want false")
+	}
+}
@@ -0,0 +1,409 @@
+// Package compress stores states compressed, behind a short header naming
+// the algorithm. States written before compression was turned on, or with
+// another algorithm, are still read.
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Algorithm names a compression algorithm
+type Algorithm string
+
+const (
+	// None writes states as they are. Compressed states are still read.
+	None Algorithm = "none"
+	Gzip Algorithm = "gzip"
+	Zstd Algorithm = "zstd"
+)
+
+// magic starts every compressed state. A Terraform state is JSON text and
+// can't start with a NUL byte, so uncompressed states are told apart by it.
+// The byte after it identifies the algorithm. Uncompressed states that start
+// with magic anyway are stored behind a header too, with noneID.
+const magic = "\x00TSC"
+
+const (
+	noneID byte = 0
+	gzipID byte = 1
+	zstdID byte = 2
+)
+
+// Stats reports the bytes handed to and written by the compressor
+type Stats struct {
+	// Written is the size of the states written, before compression
+	Written int64 `json:"written"`
+	// Stored is the size of what was stored for them
+	Stored int64 `json:"stored"`
+}
+
+// CompressingStorage wraps a StateStorage and compresses states on their way
+// in and decompresses them on their way out. Locks and metadata are stored
+// as they are.
+type CompressingStorage struct {
+	storage.StateStorage
+
+	algorithm Algorithm
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+
+	written atomic.Int64
+	stored  atomic.Int64
+}
+
+// NewCompressingStorage wraps inner, compressing the states it writes with
+// algorithm
+func NewCompressingStorage(inner storage.StateStorage, algorithm Algorithm) (*CompressingStorage, error) {
+	switch algorithm {
+	case None, Gzip, Zstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q, expected none, gzip or zstd", algorithm)
+	}
+	// EncodeAll and DecodeAll are safe for concurrent use
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressingStorage{
+		StateStorage: inner,
+		algorithm:    algorithm,
+		encoder:      encoder,
+		decoder:      decoder,
+	}, nil
+}
+
+// Unwrap returns the wrapped storage
+func (c *CompressingStorage) Unwrap() storage.StateStorage {
+	return c.StateStorage
+}
+
+// Algorithm returns the algorithm states are written with
+func (c *CompressingStorage) Algorithm() Algorithm {
+	return c.algorithm
+}
+
+// Stats returns the bytes compressed so far
+func (c *CompressingStorage) Stats() Stats {
+	return Stats{Written: c.written.Load(), Stored: c.stored.Load()}
+}
+
+// compress returns data with the header and compressed with the configured
+// algorithm, or data itself without compression
+func (c *CompressingStorage) compress(data []byte) ([]byte, error) {
+	var out []byte
+	switch c.algorithm {
+	case Gzip:
+		var buf bytes.Buffer
+		buf.WriteString(magic)
+		buf.WriteByte(gzipID)
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	case Zstd:
+		out = c.encoder.EncodeAll(data, append([]byte(magic), zstdID))
+	default:
+		if bytes.HasPrefix(data, []byte(magic)) {
+			return append([]byte(magic+string(noneID)), data...), nil
+		}
+		return data, nil
+	}
+	return out, nil
+}
+
+// count adds a state written as written bytes and stored as stored bytes to
+// the stats
+func (c *CompressingStorage) count(written, stored int64) {
+	if c.algorithm == None {
+		return
+	}
+	c.written.Add(written)
+	c.stored.Add(stored)
+}
+
+// decompress returns the state in data, which may or may not be compressed
+func (c *CompressingStorage) decompress(data []byte) ([]byte, error) {
+	if len(data) <= len(magic) || string(data[:len(magic)]) != magic {
+		return data, nil
+	}
+	body := data[len(magic)+1:]
+	switch data[len(magic)] {
+	case noneID:
+		return body, nil
+	case gzipID:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		out, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return out, nil
+	case zstdID:
+		out, err := c.decoder.DecodeAll(body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("state compressed with unknown algorithm %d", data[len(magic)])
+	}
+}
+
+// decompressState replaces the body of state with its decompressed form
+func (c *CompressingStorage) decompressState(state *models.State, err error) (*models.State, error) {
+	if err != nil {
+		return nil, err
+	}
+	if state.State, err = c.decompress(state.State); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// storedCopy returns a copy of state holding the body to store, so that the
+// caller's state keeps the uncompressed body
+func (c *CompressingStorage) storedCopy(state *models.State) (*models.State, error) {
+	data, err := c.compress(state.State)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress state: %w", err)
+	}
+	stored := *state
+	stored.State = data
+	return &stored, nil
+}
+
+func (c *CompressingStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	return c.decompressState(c.StateStorage.GetState(ctx, workspace, id))
+}
+
+// GetStateReader decompresses the state as it is read from the wrapped
+// storage if that can return a stream, and otherwise reads it whole
+func (c *CompressingStorage) GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error) {
+	reader, ok := c.StateStorage.(storage.StreamReader)
+	if !ok {
+		state, err := c.GetState(ctx, workspace, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return state, storage.TakeBody(state), nil
+	}
+	state, body, err := reader.GetStateReader(ctx, workspace, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressed, err := decompressStream(body)
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	return state, decompressed, nil
+}
+
+// decompressStream is decompress for a stream. Closing the returned reader
+// closes body.
+func decompressStream(body io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(len(magic) + 1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read state: %w", err)
+	}
+	if len(header) <= len(magic) || string(header[:len(magic)]) != magic {
+		return &streamCloser{Reader: br, close: body.Close}, nil
+	}
+	br.Discard(len(header))
+
+	switch header[len(magic)] {
+	case noneID:
+		return &streamCloser{Reader: br, close: body.Close}, nil
+	case gzipID:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return &streamCloser{Reader: zr, close: body.Close}, nil
+	case zstdID:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress state: %w", err)
+		}
+		return &streamCloser{Reader: zr, close: func() error {
+			zr.Close()
+			return body.Close()
+		}}, nil
+	default:
+		return nil, fmt.Errorf("state compressed with unknown algorithm %d", header[len(magic)])
+	}
+}
+
+// streamCloser is a decompressing reader closing what it reads from
+type streamCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (s *streamCloser) Close() error {
+	return s.close()
+}
+
+// GetStateIfNoneMatch uses the conditional read of the wrapped storage if it
+// has one and otherwise always returns the state
+func (c *CompressingStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	reader, ok := c.StateStorage.(storage.ConditionalReader)
+	if !ok {
+		return c.GetState(ctx, workspace, id)
+	}
+	return c.decompressState(reader.GetStateIfNoneMatch(ctx, workspace, id, revision))
+}
+
+func (c *CompressingStorage) PutState(ctx context.Context, state *models.State) error {
+	stored, err := c.storedCopy(state)
+	if err != nil {
+		return err
+	}
+	err = c.StateStorage.PutState(ctx, stored)
+	state.Revision = stored.Revision
+	if err == nil {
+		c.count(int64(len(state.State)), int64(len(stored.State)))
+	}
+	return err
+}
+
+// PutStateIfMatch makes the write conditional if the wrapped storage
+// supports it and writes unconditionally otherwise
+func (c *CompressingStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	writer, ok := c.StateStorage.(storage.ConditionalWriter)
+	if !ok {
+		return c.PutState(ctx, state)
+	}
+	stored, err := c.storedCopy(state)
+	if err != nil {
+		return err
+	}
+	err = writer.PutStateIfMatch(ctx, stored, revision)
+	state.Revision = stored.Revision
+	if err == nil {
+		c.count(int64(len(state.State)), int64(len(stored.State)))
+	}
+	return err
+}
+
+// PutStateFrom compresses body as it is streamed to the wrapped storage if
+// that can take a stream, and otherwise reads it whole and writes it with
+// PutState
+func (c *CompressingStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	writer, ok := c.StateStorage.(storage.StreamWriter)
+	if !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("failed to read state: %w", err)
+		}
+		state.State = data
+		return c.PutState(ctx, state)
+	}
+	if c.algorithm == None {
+		br := bufio.NewReader(body)
+		if prefix, _ := br.Peek(len(magic)); string(prefix) == magic {
+			return writer.PutStateFrom(ctx, state, io.MultiReader(strings.NewReader(magic+string(noneID)), br))
+		}
+		return writer.PutStateFrom(ctx, state, br)
+	}
+
+	input := &storage.CountingReader{R: body}
+	pr, pw := io.Pipe()
+	output := &countingWriter{w: pw}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(c.compressStream(output, input))
+	}()
+	err := writer.PutStateFrom(ctx, state, pr)
+	// Stop the compressor if the storage gave up before reading everything
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	if err == nil {
+		c.count(input.N, output.n)
+	}
+	return err
+}
+
+// compressStream writes the header and body compressed to output
+func (c *CompressingStorage) compressStream(output io.Writer, input io.Reader) error {
+	var zw io.WriteCloser
+	var err error
+	switch c.algorithm {
+	case Gzip:
+		if _, err := output.Write([]byte(magic + string(gzipID))); err != nil {
+			return err
+		}
+		zw = gzip.NewWriter(output)
+	case Zstd:
+		if _, err := output.Write([]byte(magic + string(zstdID))); err != nil {
+			return err
+		}
+		if zw, err = zstd.NewWriter(output); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(zw, input); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *CompressingStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := c.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return history.ListStateVersions(ctx, workspace, id)
+}
+
+func (c *CompressingStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	history, ok := c.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return c.decompressState(history.GetStateVersion(ctx, workspace, id, version))
+}
+
+// Close closes the wrapped storage if it can be closed
+func (c *CompressingStorage) Close() error {
+	if closer, ok := c.StateStorage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
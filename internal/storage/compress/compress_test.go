@@ -0,0 +1,231 @@
+package compress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/disk"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	for _, algorithm := range []Algorithm{None, Gzip, Zstd} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			// disk streams states in and out, memory doesn't
+			t.Run("disk", func(t *testing.T) {
+				storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+					return newCompressing(t, disk.NewDiskStorage(t.TempDir()), algorithm)
+				})
+			})
+			t.Run("memory", func(t *testing.T) {
+				storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+					return newCompressing(t, memory.NewMemoryStorage(), algorithm)
+				})
+			})
+		})
+	}
+}
+
+func newCompressing(t *testing.T, inner storage.StateStorage, algorithm Algorithm) *CompressingStorage {
+	c, err := NewCompressingStorage(inner, algorithm)
+	if err != nil {
+		t.Fatalf("NewCompressingStorage: %v", err)
+	}
+	return c
+}
+
+// failingStorage fails every state write
+type failingStorage struct {
+	*disk.DiskStorage
+}
+
+var errWrite = errors.New("write failed")
+
+func (s *failingStorage) PutState(ctx context.Context, state *models.State) error {
+	return errWrite
+}
+
+func (s *failingStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	io.Copy(io.Discard, body)
+	return errWrite
+}
+
+// stored returns the bytes the wrapped storage holds for ws/app
+func stored(t *testing.T, inner storage.StateStorage) []byte {
+	t.Helper()
+	state, err := inner.GetState(context.Background(), "ws", "app")
+	if err != nil {
+		t.Fatalf("GetState on the wrapped storage: %v", err)
+	}
+	return state.State
+}
+
+// readBack checks that c returns want for ws/app, whole and as a stream
+func readBack(t *testing.T, c *CompressingStorage, want []byte) {
+	t.Helper()
+	ctx := context.Background()
+	state, err := c.GetState(ctx, "ws", "app")
+	if err != nil || !bytes.Equal(state.State, want) {
+		t.Errorf("GetState = %q, %v, want %q", trim(state), err, trim(&models.State{State: want}))
+	}
+	state, body, err := c.GetStateReader(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetStateReader: %v", err)
+	}
+	defer body.Close()
+	if got, err := io.ReadAll(body); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("GetStateReader read %q, %v, want %q", trim(&models.State{State: got}), err, trim(&models.State{State: want}))
+	}
+}
+
+// trim shortens the body of state for error messages
+func trim(state *models.State) []byte {
+	if state == nil {
+		return nil
+	}
+	if len(state.State) > 32 {
+		return state.State[:32]
+	}
+	return state.State
+}
+
+func TestHeader(t *testing.T) {
+	body := []byte(`{"version":4,"serial":1}`)
+	for _, tc := range []struct {
+		algorithm Algorithm
+		header    string
+	}{
+		{None, ""},
+		{Gzip, magic + "\x01"},
+		{Zstd, magic + "\x02"},
+	} {
+		t.Run(string(tc.algorithm), func(t *testing.T) {
+			inner := disk.NewDiskStorage(t.TempDir())
+			c := newCompressing(t, inner, tc.algorithm)
+			if err := c.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: body}); err != nil {
+				t.Fatalf("PutState: %v", err)
+			}
+
+			raw := stored(t, inner)
+			if tc.header == "" && !bytes.Equal(raw, body) {
+				t.Errorf("stored %q, want the state as it is", raw)
+			}
+			if tc.header != "" && !bytes.HasPrefix(raw, []byte(tc.header)) {
+				t.Errorf("stored %q, want it to start with %q", trim(&models.State{State: raw}), tc.header)
+			}
+			readBack(t, c, body)
+		})
+	}
+}
+
+func TestReadsAnyAlgorithm(t *testing.T) {
+	body := []byte(`{"version":4,"serial":1}`)
+	for _, written := range []Algorithm{None, Gzip, Zstd} {
+		for _, reader := range []Algorithm{None, Gzip, Zstd} {
+			t.Run(string(written)+"/"+string(reader), func(t *testing.T) {
+				inner := disk.NewDiskStorage(t.TempDir())
+				if err := newCompressing(t, inner, written).PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: body}); err != nil {
+					t.Fatalf("PutState: %v", err)
+				}
+				readBack(t, newCompressing(t, inner, reader), body)
+			})
+		}
+	}
+}
+
+func TestReadsUncompressedStates(t *testing.T) {
+	// Written before compression was turned on
+	inner := disk.NewDiskStorage(t.TempDir())
+	for _, body := range []string{`{"version":4,"serial":1}`, "", "\x00TS"} {
+		if err := inner.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: []byte(body)}); err != nil {
+			t.Fatalf("PutState: %v", err)
+		}
+		readBack(t, newCompressing(t, inner, Zstd), []byte(body))
+	}
+}
+
+func TestPayloadStartingWithMagic(t *testing.T) {
+	for _, algorithm := range []Algorithm{None, Gzip, Zstd} {
+		for _, body := range []string{magic, magic + "\x01not gzip", magic + "\x00"} {
+			t.Run(fmt.Sprintf("%s/%q", algorithm, body), func(t *testing.T) {
+				inner := disk.NewDiskStorage(t.TempDir())
+				c := newCompressing(t, inner, algorithm)
+				if err := c.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: []byte(body)}); err != nil {
+					t.Fatalf("PutState: %v", err)
+				}
+				readBack(t, c, []byte(body))
+
+				if err := c.PutStateFrom(context.Background(), &models.State{Workspace: "ws", ID: "app"}, strings.NewReader(body)); err != nil {
+					t.Fatalf("PutStateFrom: %v", err)
+				}
+				readBack(t, c, []byte(body))
+			})
+		}
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	inner := disk.NewDiskStorage(t.TempDir())
+	if err := inner.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: []byte(magic + "\x7fdata")}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	c := newCompressing(t, inner, Gzip)
+	if _, err := c.GetState(context.Background(), "ws", "app"); err == nil {
+		t.Error("GetState of a state compressed with an unknown algorithm succeeded")
+	}
+	if _, _, err := c.GetStateReader(context.Background(), "ws", "app"); err == nil {
+		t.Error("GetStateReader of a state compressed with an unknown algorithm succeeded")
+	}
+}
+
+func TestStreamedWrite(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 1<<20/52)
+	for _, algorithm := range []Algorithm{Gzip, Zstd} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			inner := disk.NewDiskStorage(t.TempDir())
+			c := newCompressing(t, inner, algorithm)
+			if err := c.PutStateFrom(context.Background(), &models.State{Workspace: "ws", ID: "app"}, bytes.NewReader(body)); err != nil {
+				t.Fatalf("PutStateFrom: %v", err)
+			}
+
+			raw := stored(t, inner)
+			if len(raw) >= len(body) {
+				t.Errorf("stored %d bytes for %d, want them compressed", len(raw), len(body))
+			}
+			if stats := c.Stats(); stats.Written != int64(len(body)) || stats.Stored != int64(len(raw)) {
+				t.Errorf("Stats = %+v, want %d written and %d stored", stats, len(body), len(raw))
+			}
+			readBack(t, c, body)
+		})
+	}
+}
+
+func TestStatsCountStoredStatesOnly(t *testing.T) {
+	body := []byte(`{"version":4,"serial":1}`)
+	c := newCompressing(t, &failingStorage{disk.NewDiskStorage(t.TempDir())}, Zstd)
+	if err := c.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: body}); !errors.Is(err, errWrite) {
+		t.Fatalf("PutState = %v, want %v", err, errWrite)
+	}
+	if err := c.PutStateFrom(context.Background(), &models.State{Workspace: "ws", ID: "app"}, bytes.NewReader(body)); !errors.Is(err, errWrite) {
+		t.Fatalf("PutStateFrom = %v, want %v", err, errWrite)
+	}
+	if stats := c.Stats(); stats.Written != 0 || stats.Stored != 0 {
+		t.Errorf("Stats = %+v after failed writes, want nothing counted", stats)
+	}
+
+	c = newCompressing(t, disk.NewDiskStorage(t.TempDir()), Zstd)
+	if err := c.PutState(context.Background(), &models.State{Workspace: "ws", ID: "app", State: body}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	if stats := c.Stats(); stats.Written != int64(len(body)) || stats.Stored == 0 {
+		t.Errorf("Stats = %+v, want %d bytes written", stats, len(body))
+	}
+}
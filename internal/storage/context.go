@@ -0,0 +1,17 @@
+package storage
+
+import "context"
+
+type actorKey struct{}
+
+// WithActor returns a context carrying the authenticated user on whose behalf
+// storage calls are made, for backends that record authorship
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the user set with WithActor, or an empty string
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
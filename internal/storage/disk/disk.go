@@ -1,17 +1,33 @@
 package disk
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
 )
 
+// metaFileName is the workspace metadata file kept next to the state files
+const metaFileName = ".workspace.json"
+
 type DiskStorage struct {
 	basePath string
+
+	// lockMu makes the check and rewrite of a renewal atomic with respect to
+	// unlocking and locking, which only the server holding basePath does
+	lockMu sync.Mutex
 }
 
 func NewDiskStorage(basePath string) *DiskStorage {
@@ -26,14 +42,82 @@ func (d *DiskStorage) getLockPath(workspace, id string) string {
 	return filepath.Join(d.basePath, workspace, id+".lock")
 }
 
+func (d *DiskStorage) getMetaPath(workspace string) string {
+	return filepath.Join(d.basePath, workspace, metaFileName)
+}
+
 func (d *DiskStorage) ensureDir(path string) error {
 	return os.MkdirAll(filepath.Dir(path), 0755)
 }
 
-func (d *DiskStorage) GetState(_ context.Context, workspace, id string) (*models.State, error) {
+// writeTemp writes data to a hidden temporary file in the directory of path
+// and returns its name, so that it can be moved into place atomically
+func (d *DiskStorage) writeTemp(path string, data []byte) (string, error) {
+	return d.copyTemp(path, bytes.NewReader(data))
+}
+
+// copyTemp is writeTemp reading the data from r
+func (d *DiskStorage) copyTemp(path string, r io.Reader) (string, error) {
+	if err := d.ensureDir(path); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// writeFile replaces path with data so that readers never see a partial file
+func (d *DiskStorage) writeFile(path string, data []byte) error {
+	return d.copyFile(path, bytes.NewReader(data))
+}
+
+// copyFile is writeFile reading the data from r
+func (d *DiskStorage) copyFile(path string, r io.Reader) error {
+	tmp, err := d.copyTemp(path, r)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	return nil
+}
+
+// removeFile removes path, reporting a missing file as storage.ErrNotFound
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return storage.ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *DiskStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	path := d.getStatePath(workspace, id)
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
 		return nil, fmt.Errorf("failed to read state file: %w", err)
 	}
 
@@ -50,20 +134,60 @@ func (d *DiskStorage) GetState(_ context.Context, workspace, id string) (*models
 	}, nil
 }
 
-func (d *DiskStorage) PutState(_ context.Context, state *models.State) error {
-	path := d.getStatePath(state.Workspace, state.ID)
-	if err := d.ensureDir(path); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+// GetStateReader opens the state file for reading
+func (d *DiskStorage) GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
 	}
 
-	return os.WriteFile(path, state.State, 0644)
+	f, err := os.Open(d.getStatePath(workspace, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		UpdatedAt: fileInfo.ModTime(),
+	}, f, nil
+}
+
+func (d *DiskStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.writeFile(d.getStatePath(state.Workspace, state.ID), state.State)
 }
 
-func (d *DiskStorage) DeleteState(_ context.Context, workspace, id string) error {
-	return os.Remove(d.getStatePath(workspace, id))
+// PutStateFrom streams body into a temporary file next to the state and moves
+// it into place once complete
+func (d *DiskStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.copyFile(d.getStatePath(state.Workspace, state.ID), body)
 }
 
-func (d *DiskStorage) ListStates(_ context.Context, workspace string) ([]models.State, error) {
+func (d *DiskStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return removeFile(d.getStatePath(workspace, id))
+}
+
+func (d *DiskStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	dir := filepath.Join(d.basePath, workspace)
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -73,9 +197,10 @@ func (d *DiskStorage) ListStates(_ context.Context, workspace string) ([]models.
 		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	var states []models.State
+	states := []models.State{}
 	for _, entry := range entries {
-		if entry.IsDir() || filepath.Ext(entry.Name()) == ".lock" {
+		// Hidden files hold workspace metadata and in-flight writes
+		if entry.IsDir() || filepath.Ext(entry.Name()) == ".lock" || strings.HasPrefix(entry.Name(), ".") {
 			continue
 		}
 
@@ -93,29 +218,110 @@ func (d *DiskStorage) ListStates(_ context.Context, workspace string) ([]models.
 	return states, nil
 }
 
-func (d *DiskStorage) Lock(_ context.Context, lock *models.StateLock) error {
-	workspace, id := filepath.Split(lock.Path)
-	path := d.getLockPath(workspace, id)
+func (d *DiskStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if err := d.ensureDir(path); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
+	entries, err := os.ReadDir(d.basePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	workspaces := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			workspaces = append(workspaces, entry.Name())
+		}
+	}
+	return workspaces, nil
+}
+
+// Lock creates the lock file by hard-linking a fully written temporary file
+// into place, which fails atomically if the lock is already held.
+func (d *DiskStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	data, err := json.Marshal(lock)
+	path := d.getLockPath(workspace, id)
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	data, err := json.Marshal(record)
 	if err != nil {
 		return fmt.Errorf("failed to marshal lock: %w", err)
 	}
 
-	return os.WriteFile(path, data, 0644)
+	tmp, err := d.writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	d.lockMu.Lock()
+	defer d.lockMu.Unlock()
+	if err := os.Link(tmp, path); err == nil {
+		return nil
+	} else if !os.IsExist(err) {
+		return fmt.Errorf("failed to create lock file: %w", err)
+	}
+
+	// Taking a lock again under the same lock ID succeeds
+	current, err := d.GetLock(ctx, workspace, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return storage.ErrLocked
+		}
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return nil
 }
 
-func (d *DiskStorage) Unlock(_ context.Context, workspace, id string) error {
-	return os.Remove(d.getLockPath(workspace, id))
+func (d *DiskStorage) Unlock(ctx context.Context, workspace, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.lockMu.Lock()
+	defer d.lockMu.Unlock()
+	return removeFile(d.getLockPath(workspace, id))
+}
+
+// UnlockIfMatch removes the lock file if it still holds lock. The check and
+// the removal happen under lockMu, like those of a renewal.
+func (d *DiskStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.lockMu.Lock()
+	defer d.lockMu.Unlock()
+	current, err := d.GetLock(ctx, workspace, id)
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID || current.Revision != lock.Revision {
+		return storage.ErrLocked
+	}
+	return removeFile(d.getLockPath(workspace, id))
 }
 
-func (d *DiskStorage) GetLock(_ context.Context, workspace, id string) (*models.StateLock, error) {
+func (d *DiskStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	data, err := os.ReadFile(d.getLockPath(workspace, id))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
 		return nil, fmt.Errorf("failed to read lock file: %w", err)
 	}
 
@@ -123,6 +329,152 @@ func (d *DiskStorage) GetLock(_ context.Context, workspace, id string) (*models.
 	if err := json.Unmarshal(data, &lock); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal lock: %w", err)
 	}
+	lock.Workspace, lock.StateID = workspace, id
+	// Every lock and renewal writes a new record, so its digest tells them apart
+	sum := sha256.Sum256(data)
+	lock.Revision = hex.EncodeToString(sum[:8])
 
 	return &lock, nil
 }
+
+func (d *DiskStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	workspaces := []string{workspace}
+	if workspace == "" {
+		entries, err := os.ReadDir(d.basePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return []models.StateLock{}, nil
+			}
+			return nil, fmt.Errorf("failed to read directory: %w", err)
+		}
+		workspaces = workspaces[:0]
+		for _, entry := range entries {
+			// As in ListWorkspaces; with the git backend this skips .git
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				workspaces = append(workspaces, entry.Name())
+			}
+		}
+	}
+
+	locks := []models.StateLock{}
+	for _, ws := range workspaces {
+		entries, err := os.ReadDir(filepath.Join(d.basePath, ws))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read directory: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != ".lock" {
+				continue
+			}
+
+			id := strings.TrimSuffix(entry.Name(), ".lock")
+			lock, err := d.GetLock(ctx, ws, id)
+			if err != nil {
+				// The lock was released while listing
+				if errors.Is(err, storage.ErrNotFound) {
+					continue
+				}
+				return nil, err
+			}
+			locks = append(locks, *lock)
+		}
+	}
+	return locks, nil
+}
+
+// RenewLock rewrites the lock if it is still held under the same ID. The new
+// record is written to a temporary file first, and only the check and the
+// rename happen under lockMu, so that an unlock and a lock by another client
+// can't slip in between them.
+func (d *DiskStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	path := d.getLockPath(workspace, id)
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock: %w", err)
+	}
+
+	tmp, err := d.writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	d.lockMu.Lock()
+	defer d.lockMu.Unlock()
+	current, err := d.GetLock(ctx, workspace, id)
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace lock file: %w", err)
+	}
+	return nil
+}
+
+func (d *DiskStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(d.getMetaPath(workspace))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read workspace metadata: %w", err)
+	}
+
+	var meta models.WorkspaceMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal workspace metadata: %w", err)
+	}
+
+	return &meta, nil
+}
+
+func (d *DiskStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal workspace metadata: %w", err)
+	}
+
+	return d.writeFile(d.getMetaPath(meta.Workspace), data)
+}
+
+// Ping writes the sentinel file into the base directory and reads it back
+func (d *DiskStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path := filepath.Join(d.basePath, storage.HealthKeyName)
+	sentinel := time.Now().UTC().Format(time.RFC3339Nano)
+	if err := d.writeFile(path, []byte(sentinel)); err != nil {
+		return fmt.Errorf("directory %s is not writable: %w", d.basePath, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel file: %w", err)
+	}
+	if string(data) != sentinel {
+		return errors.New("sentinel file read back does not match the one written")
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package disk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return NewDiskStorage(t.TempDir())
+	})
+}
+
+func TestListLocksSkipsHiddenDirectories(t *testing.T) {
+	ctx := context.Background()
+	base := t.TempDir()
+	d := NewDiskStorage(base)
+	if err := d.Lock(ctx, "ws", "app", &models.StateLock{ID: "1"}); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	// A lock-like file in a hidden directory, such as a git repository's
+	hidden := filepath.Join(base, ".git", "index.lock")
+	if err := os.MkdirAll(filepath.Dir(hidden), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hidden, []byte(`{"ID":"git"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	locks, err := d.ListLocks(ctx, "")
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Workspace != "ws" {
+		t.Errorf("ListLocks = %+v, want only the lock of ws/app", locks)
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when a state, lock or metadata object does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrLocked is returned when a lock is held under a different lock ID
+	ErrLocked = errors.New("state is locked by another client")
+
+	// ErrConflict is returned when a conditional write finds the stored state
+	// changed since it was read
+	ErrConflict = errors.New("state was modified concurrently")
+
+	// ErrNotModified is returned by conditional reads when the stored state is
+	// still at the revision the caller has
+	ErrNotModified = errors.New("state not modified")
+
+	// ErrNotSupported is returned by wrapping storages when the storage they
+	// wrap lacks an optional capability
+	ErrNotSupported = errors.New("not supported by the storage backend")
+
+	// ErrInvalidName is returned for workspace and state names that clash with
+	// the files and keys backends keep for themselves
+	ErrInvalidName = errors.New("invalid workspace or state name")
+)
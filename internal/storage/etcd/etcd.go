@@ -0,0 +1,574 @@
+package etcd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// chunkSize keeps every value well below etcd's default 1.5 MiB request limit
+const chunkSize = 512 << 10
+
+// manifest is stored under the state key and points at the chunks holding
+// the current state body
+type manifest struct {
+	Generation string    `json:"generation"`
+	Chunks     int       `json:"chunks"`
+	Size       int       `json:"size"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// EtcdStorage stores states in etcd under a key prefix:
+//
+//	<prefix>/states/<workspace>/<id>               manifest of the current state
+//	<prefix>/chunks/<workspace>/<id>/<gen>/<n>     chunks of a state body
+//	<prefix>/locks/<workspace>/<id>                lock info
+//	<prefix>/meta/<workspace>                      workspace metadata
+//
+// A state is written by storing the chunks of a new generation and then
+// swapping the manifest in a transaction, so readers never see a partial
+// state. Locks with a TTL are attached to an etcd lease of that TTL: when the
+// holder stops renewing, etcd deletes the lock on its own.
+type EtcdStorage struct {
+	client *clientv3.Client
+	prefix string
+}
+
+func NewEtcdStorage(client *clientv3.Client, prefix string) *EtcdStorage {
+	return &EtcdStorage{
+		client: client,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+// Close closes the etcd client. Locks attached to leases stay until their
+// TTL runs out.
+func (e *EtcdStorage) Close() error {
+	return e.client.Close()
+}
+
+func (e *EtcdStorage) key(parts ...string) string {
+	return e.prefix + "/" + strings.Join(parts, "/")
+}
+
+func (e *EtcdStorage) stateKey(workspace, id string) string {
+	return e.key("states", workspace, id)
+}
+
+func (e *EtcdStorage) chunkPrefix(workspace, id, generation string) string {
+	return e.key("chunks", workspace, id, generation) + "/"
+}
+
+func (e *EtcdStorage) lockKey(workspace, id string) string {
+	return e.key("locks", workspace, id)
+}
+
+func (e *EtcdStorage) metaKey(workspace string) string {
+	return e.key("meta", workspace)
+}
+
+func newGeneration() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// getManifest returns the manifest of a state and its mod revision
+func (e *EtcdStorage) getManifest(ctx context.Context, workspace, id string, opts ...clientv3.OpOption) (*manifest, int64, error) {
+	resp, err := e.client.Get(ctx, e.stateKey(workspace, id), opts...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get state from etcd: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, resp.Header.Revision, storage.ErrNotFound
+	}
+
+	var m manifest
+	if err := json.Unmarshal(resp.Kvs[0].Value, &m); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode state manifest: %w", err)
+	}
+	return &m, resp.Kvs[0].ModRevision, nil
+}
+
+func (e *EtcdStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	m, rev, err := e.getManifest(ctx, workspace, id)
+	if err != nil {
+		return nil, err
+	}
+	return e.readState(ctx, workspace, id, m, rev)
+}
+
+// GetStateIfNoneMatch reads the state unless its manifest is still at the mod
+// revision given as revision
+func (e *EtcdStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	m, rev, err := e.getManifest(ctx, workspace, id)
+	if err != nil {
+		return nil, err
+	}
+	if strconv.FormatInt(rev, 10) == revision {
+		return nil, storage.ErrNotModified
+	}
+	return e.readState(ctx, workspace, id, m, rev)
+}
+
+// readState reads the chunks listed by the manifest m found at revision rev
+func (e *EtcdStorage) readState(ctx context.Context, workspace, id string, m *manifest, rev int64) (*models.State, error) {
+	// Read the chunks at the revision of the manifest, so a concurrent write
+	// cleaning up this generation can't remove them under us
+	resp, err := e.client.Get(ctx, e.chunkPrefix(workspace, id, m.Generation),
+		clientv3.WithPrefix(), clientv3.WithRev(rev))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state chunks from etcd: %w", err)
+	}
+	if len(resp.Kvs) != m.Chunks {
+		return nil, fmt.Errorf("state %s/%s has %d of %d chunks", workspace, id, len(resp.Kvs), m.Chunks)
+	}
+
+	data := make([]byte, 0, m.Size)
+	chunks := make([][]byte, m.Chunks)
+	for _, kv := range resp.Kvs {
+		n, err := strconv.Atoi(string(kv.Key[strings.LastIndex(string(kv.Key), "/")+1:]))
+		if err != nil || n < 0 || n >= m.Chunks {
+			return nil, fmt.Errorf("invalid state chunk key %s", kv.Key)
+		}
+		chunks[n] = kv.Value
+	}
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+		CreatedAt: m.CreatedAt,
+		UpdatedAt: m.UpdatedAt,
+		Revision:  strconv.FormatInt(rev, 10),
+	}, nil
+}
+
+func (e *EtcdStorage) PutState(ctx context.Context, state *models.State) error {
+	return e.putState(ctx, state, nil)
+}
+
+// PutStateIfMatch writes the state only if its manifest is still at the mod
+// revision given as revision, or does not exist if revision is empty
+func (e *EtcdStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	var rev int64
+	if revision != "" {
+		var err error
+		if rev, err = strconv.ParseInt(revision, 10, 64); err != nil {
+			return fmt.Errorf("invalid revision %q: %w", revision, err)
+		}
+	}
+	cmp := clientv3.Compare(clientv3.ModRevision(e.stateKey(state.Workspace, state.ID)), "=", rev)
+	return e.putState(ctx, state, &cmp)
+}
+
+// putState writes the chunks of a new generation, swaps the manifest to it
+// if cond holds, and removes the previous generation
+func (e *EtcdStorage) putState(ctx context.Context, state *models.State, cond *clientv3.Cmp) error {
+	previous, _, err := e.getManifest(ctx, state.Workspace, state.ID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	generation, err := newGeneration()
+	if err != nil {
+		return fmt.Errorf("failed to generate state generation: %w", err)
+	}
+	prefix := e.chunkPrefix(state.Workspace, state.ID, generation)
+
+	now := time.Now().UTC()
+	m := manifest{
+		Generation: generation,
+		Size:       len(state.State),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if previous != nil {
+		m.CreatedAt = previous.CreatedAt
+	}
+	for offset := 0; offset < len(state.State) || m.Chunks == 0; offset += chunkSize {
+		chunk := state.State[offset:min(offset+chunkSize, len(state.State))]
+		if _, err := e.client.Put(ctx, prefix+strconv.Itoa(m.Chunks), string(chunk)); err != nil {
+			e.deleteGeneration(ctx, state.Workspace, state.ID, generation)
+			return fmt.Errorf("failed to put state chunk to etcd: %w", err)
+		}
+		m.Chunks++
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state manifest: %w", err)
+	}
+	txn := e.client.Txn(ctx)
+	if cond != nil {
+		txn = txn.If(*cond)
+	}
+	resp, err := txn.Then(clientv3.OpPut(e.stateKey(state.Workspace, state.ID), string(data))).Commit()
+	if err != nil || !resp.Succeeded {
+		e.deleteGeneration(ctx, state.Workspace, state.ID, generation)
+		if err != nil {
+			return fmt.Errorf("failed to put state manifest to etcd: %w", err)
+		}
+		return storage.ErrConflict
+	}
+
+	state.Revision = strconv.FormatInt(resp.Header.Revision, 10)
+
+	if previous != nil {
+		e.deleteGeneration(ctx, state.Workspace, state.ID, previous.Generation)
+	}
+	return nil
+}
+
+// deleteGeneration removes the chunks of a state generation. Failures only
+// leave unreferenced chunks behind, so they are not reported.
+func (e *EtcdStorage) deleteGeneration(ctx context.Context, workspace, id, generation string) {
+	e.client.Delete(context.WithoutCancel(ctx), e.chunkPrefix(workspace, id, generation), clientv3.WithPrefix())
+}
+
+func (e *EtcdStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	m, rev, err := e.getManifest(ctx, workspace, id)
+	if err != nil {
+		return err
+	}
+
+	key := e.stateKey(workspace, id)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpDelete(key), clientv3.OpDelete(e.chunkPrefix(workspace, id, m.Generation), clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to delete state from etcd: %w", err)
+	}
+	if !resp.Succeeded {
+		return storage.ErrConflict
+	}
+	return nil
+}
+
+func (e *EtcdStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	prefix := e.key("states", workspace) + "/"
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list states from etcd: %w", err)
+	}
+
+	states := []models.State{}
+	for _, kv := range resp.Kvs {
+		var m manifest
+		if err := json.Unmarshal(kv.Value, &m); err != nil {
+			return nil, fmt.Errorf("failed to decode state manifest: %w", err)
+		}
+		states = append(states, models.State{
+			ID:        strings.TrimPrefix(string(kv.Key), prefix),
+			Workspace: workspace,
+			CreatedAt: m.CreatedAt,
+			UpdatedAt: m.UpdatedAt,
+			Revision:  strconv.FormatInt(kv.ModRevision, 10),
+		})
+	}
+	return states, nil
+}
+
+// ListWorkspaces collects the workspaces from the keys of states, locks and
+// metadata
+func (e *EtcdStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	workspaces := []string{}
+	for _, kind := range []string{"states", "locks", "meta"} {
+		prefix := e.key(kind) + "/"
+		resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list workspaces from etcd: %w", err)
+		}
+		for _, kv := range resp.Kvs {
+			workspace, _, _ := strings.Cut(strings.TrimPrefix(string(kv.Key), prefix), "/")
+			if !seen[workspace] {
+				seen[workspace] = true
+				workspaces = append(workspaces, workspace)
+			}
+		}
+	}
+	sort.Strings(workspaces)
+	return workspaces, nil
+}
+
+// grantLease returns a lease lasting the TTL of lock, or no lease if the lock
+// never expires
+func (e *EtcdStorage) grantLease(ctx context.Context, lock *models.StateLock) (clientv3.LeaseID, error) {
+	if lock.TTLSeconds <= 0 {
+		return clientv3.NoLease, nil
+	}
+	resp, err := e.client.Grant(ctx, lock.TTLSeconds)
+	if err != nil {
+		return clientv3.NoLease, fmt.Errorf("failed to grant lease in etcd: %w", err)
+	}
+	return resp.ID, nil
+}
+
+// revokeLease drops a lease and any key still attached to it
+func (e *EtcdStorage) revokeLease(ctx context.Context, id clientv3.LeaseID) {
+	if id != clientv3.NoLease {
+		e.client.Revoke(context.WithoutCancel(ctx), id)
+	}
+}
+
+func marshalLock(workspace, id string, lock *models.StateLock, lease clientv3.LeaseID) (string, error) {
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	record.LeaseID = ""
+	if lease != clientv3.NoLease {
+		record.LeaseID = strconv.FormatInt(int64(lease), 16)
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lock data: %w", err)
+	}
+	return string(data), nil
+}
+
+// Lock creates the lock key in a transaction that fails if it exists
+func (e *EtcdStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	lease, err := e.grantLease(ctx, lock)
+	if err != nil {
+		return err
+	}
+	data, err := marshalLock(workspace, id, lock, lease)
+	if err != nil {
+		e.revokeLease(ctx, lease)
+		return err
+	}
+
+	key := e.lockKey(workspace, id)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, data, clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		e.revokeLease(ctx, lease)
+		return fmt.Errorf("failed to put lock to etcd: %w", err)
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	e.revokeLease(ctx, lease)
+
+	// Taking a lock again under the same lock ID succeeds
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		return storage.ErrLocked
+	}
+	var current models.StateLock
+	if err := json.Unmarshal(kvs[0].Value, &current); err != nil {
+		return fmt.Errorf("failed to decode lock data: %w", err)
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return nil
+}
+
+func (e *EtcdStorage) Unlock(ctx context.Context, workspace, id string) error {
+	current, err := e.GetLock(ctx, workspace, id)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Delete(ctx, e.lockKey(workspace, id))
+	if err != nil {
+		return fmt.Errorf("failed to delete lock from etcd: %w", err)
+	}
+	if resp.Deleted == 0 {
+		return storage.ErrNotFound
+	}
+	if lease, err := strconv.ParseInt(current.LeaseID, 16, 64); err == nil {
+		e.revokeLease(ctx, clientv3.LeaseID(lease))
+	}
+	return nil
+}
+
+// UnlockIfMatch deletes the lock key on condition that its mod revision is
+// still the one lock was read at
+func (e *EtcdStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	rev, err := strconv.ParseInt(lock.Revision, 10, 64)
+	if err != nil {
+		return storage.ErrLocked
+	}
+
+	key := e.lockKey(workspace, id)
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpDelete(key)).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to delete lock from etcd: %w", err)
+	}
+	if !resp.Succeeded {
+		if resp.Responses[0].GetResponseRange().Count == 0 {
+			return storage.ErrNotFound
+		}
+		return storage.ErrLocked
+	}
+	if lease, err := strconv.ParseInt(lock.LeaseID, 16, 64); err == nil {
+		e.revokeLease(ctx, clientv3.LeaseID(lease))
+	}
+	return nil
+}
+
+func (e *EtcdStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	lock, rev, err := e.getLock(ctx, e.lockKey(workspace, id))
+	if err != nil {
+		return nil, err
+	}
+	lock.Workspace, lock.StateID = workspace, id
+	lock.Revision = strconv.FormatInt(rev, 10)
+	return lock, nil
+}
+
+// getLock reads the lock at key and returns it with its mod revision
+func (e *EtcdStorage) getLock(ctx context.Context, key string) (*models.StateLock, int64, error) {
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get lock from etcd: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, storage.ErrNotFound
+	}
+
+	var lock models.StateLock
+	if err := json.Unmarshal(resp.Kvs[0].Value, &lock); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode lock data: %w", err)
+	}
+	return &lock, resp.Kvs[0].ModRevision, nil
+}
+
+func (e *EtcdStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	prefix := e.key("locks") + "/"
+	if workspace != "" {
+		prefix = e.key("locks", workspace) + "/"
+	}
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list locks from etcd: %w", err)
+	}
+
+	locks := []models.StateLock{}
+	for _, kv := range resp.Kvs {
+		var lock models.StateLock
+		if err := json.Unmarshal(kv.Value, &lock); err != nil {
+			return nil, fmt.Errorf("failed to decode lock data: %w", err)
+		}
+		// Keys are <prefix>/locks/<workspace>/<id>
+		ws, id, _ := strings.Cut(strings.TrimPrefix(string(kv.Key), e.key("locks")+"/"), "/")
+		lock.Workspace, lock.StateID = ws, id
+		lock.Revision = strconv.FormatInt(kv.ModRevision, 10)
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// RenewLock attaches the lock to a fresh lease of its TTL, on condition that
+// the lock is unchanged since it was read, and drops the old lease
+func (e *EtcdStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	key := e.lockKey(workspace, id)
+	current, rev, err := e.getLock(ctx, key)
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+
+	lease, err := e.grantLease(ctx, lock)
+	if err != nil {
+		return err
+	}
+	data, err := marshalLock(workspace, id, lock, lease)
+	if err != nil {
+		e.revokeLease(ctx, lease)
+		return err
+	}
+
+	resp, err := e.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(clientv3.OpPut(key, data, clientv3.WithLease(lease))).
+		Commit()
+	if err != nil || !resp.Succeeded {
+		e.revokeLease(ctx, lease)
+		if err != nil {
+			return fmt.Errorf("failed to put lock to etcd: %w", err)
+		}
+		return storage.ErrLocked
+	}
+
+	if old, err := strconv.ParseInt(current.LeaseID, 16, 64); err == nil {
+		e.revokeLease(ctx, clientv3.LeaseID(old))
+	}
+	return nil
+}
+
+func (e *EtcdStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	resp, err := e.client.Get(ctx, e.metaKey(workspace))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get workspace metadata from etcd: %w", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	var meta models.WorkspaceMeta
+	if err := json.Unmarshal(resp.Kvs[0].Value, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode workspace metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (e *EtcdStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal workspace metadata: %w", err)
+	}
+
+	if _, err := e.client.Put(ctx, e.metaKey(meta.Workspace), string(data)); err != nil {
+		return fmt.Errorf("failed to put workspace metadata to etcd: %w", err)
+	}
+	return nil
+}
+
+// Ping writes the sentinel key outside the states, locks and metadata and
+// reads it back
+func (e *EtcdStorage) Ping(ctx context.Context) error {
+	key := e.key(storage.HealthKeyName)
+	sentinel := time.Now().UTC().Format(time.RFC3339Nano)
+
+	if _, err := e.client.Put(ctx, key, sentinel); err != nil {
+		return fmt.Errorf("failed to write sentinel to etcd: %w", err)
+	}
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel from etcd: %w", err)
+	}
+	if len(resp.Kvs) == 0 || string(resp.Kvs[0].Value) != sentinel {
+		return errors.New("sentinel read back from etcd does not match the one written")
+	}
+	return nil
+}
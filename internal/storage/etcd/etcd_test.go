@@ -0,0 +1,102 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// freeURL returns a local URL on a port nothing listens on
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd runs a single member etcd server for the test and returns its
+// client endpoint
+func startEtcd(t *testing.T) string {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	client, peer := freeURL(t), freeURL(t)
+	cfg.ListenClientUrls, cfg.AdvertiseClientUrls = []url.URL{client}, []url.URL{client}
+	cfg.ListenPeerUrls, cfg.AdvertisePeerUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	server, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("starting etcd: %v", err)
+	}
+	t.Cleanup(server.Close)
+	select {
+	case <-server.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd didn't start in time")
+	}
+	return client.String()
+}
+
+var prefixes atomic.Int64
+
+// newStorage returns a backend on the etcd at endpoint with a prefix of its own
+func newStorage(t *testing.T, endpoint string) *EtcdStorage {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{endpoint},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("connecting to etcd: %v", err)
+	}
+	e := NewEtcdStorage(client, fmt.Sprintf("terrastate-%d", prefixes.Add(1)))
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestConformance(t *testing.T) {
+	endpoint := startEtcd(t)
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return newStorage(t, endpoint)
+	})
+}
+
+func TestLockLeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	e := newStorage(t, startEtcd(t))
+
+	if err := e.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-1", TTLSeconds: 1}); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err := e.GetLock(ctx, "ws", "app"); err != nil {
+		t.Fatalf("GetLock right after Lock: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := e.GetLock(ctx, "ws", "app")
+		if errors.Is(err, storage.ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GetLock after the lease ran out = %v, want ErrNotFound", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := e.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-2"}); err != nil {
+		t.Errorf("Lock after the lease ran out: %v", err)
+	}
+}
@@ -0,0 +1,509 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	gcstorage "cloud.google.com/go/storage"
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// metaKeyName is the workspace metadata object kept next to the state objects
+const metaKeyName = ".workspace.json"
+
+// GCSStorage stores states in a Google Cloud Storage bucket. Locks are created
+// and renewed with generation preconditions, so only one client can hold a
+// lock. With object versioning enabled on the bucket, previous generations of
+// a state are available as its history.
+type GCSStorage struct {
+	bucket *gcstorage.BucketHandle
+	prefix string // Optional prefix for all keys
+}
+
+func NewGCSStorage(client *gcstorage.Client, bucketName, prefix string) *GCSStorage {
+	return &GCSStorage{
+		bucket: client.Bucket(bucketName),
+		prefix: prefix,
+	}
+}
+
+// getFullKey returns the complete object name including any configured prefix
+func (g *GCSStorage) getFullKey(workspace, id string) string {
+	key := fmt.Sprintf("%s/%s", workspace, id)
+	if g.prefix != "" {
+		key = fmt.Sprintf("%s/%s", g.prefix, key)
+	}
+	return key
+}
+
+// getLockKey returns the object name of the lock for a state
+func (g *GCSStorage) getLockKey(workspace, id string) string {
+	return g.getFullKey(workspace, id) + ".lock"
+}
+
+// isPreconditionFailed reports whether a conditional request lost against a
+// concurrent change of the object
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// readObject reads a whole object and returns it with its attributes
+func (g *GCSStorage) readObject(ctx context.Context, obj *gcstorage.ObjectHandle) ([]byte, *gcstorage.ReaderObjectAttrs, error) {
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &reader.Attrs, nil
+}
+
+// writeObject writes data to obj, which may carry preconditions, and returns
+// the attributes of the written object
+func (g *GCSStorage) writeObject(ctx context.Context, obj *gcstorage.ObjectHandle, data []byte, contentType string) (*gcstorage.ObjectAttrs, error) {
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return writer.Attrs(), nil
+}
+
+func (g *GCSStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	data, attrs, err := g.readObject(ctx, g.bucket.Object(g.getFullKey(workspace, id)))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get state from GCS: %w", err)
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+		UpdatedAt: attrs.LastModified,
+		Revision:  strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+func (g *GCSStorage) PutState(ctx context.Context, state *models.State) error {
+	obj := g.bucket.Object(g.getFullKey(state.Workspace, state.ID))
+	attrs, err := g.writeObject(ctx, obj, state.State, "application/json")
+	if err != nil {
+		return fmt.Errorf("failed to put state to GCS: %w", err)
+	}
+	state.Revision = strconv.FormatInt(attrs.Generation, 10)
+	return nil
+}
+
+// GetStateIfNoneMatch reads the state unless its generation is still revision.
+// The generation is checked with a metadata request, then exactly that
+// generation is read.
+func (g *GCSStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	obj := g.bucket.Object(g.getFullKey(workspace, id))
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get state from GCS: %w", err)
+	}
+	if strconv.FormatInt(attrs.Generation, 10) == revision {
+		return nil, storage.ErrNotModified
+	}
+	state, err := g.GetStateVersion(ctx, workspace, id, strconv.FormatInt(attrs.Generation, 10))
+	if errors.Is(err, storage.ErrNotFound) {
+		// The generation was replaced in between on a bucket without versioning
+		return g.GetState(ctx, workspace, id)
+	}
+	return state, err
+}
+
+// PutStateIfMatch writes the state only if the stored object is still at the
+// generation given as revision, or does not exist if revision is empty
+func (g *GCSStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	conditions := gcstorage.Conditions{DoesNotExist: true}
+	if revision != "" {
+		generation, err := strconv.ParseInt(revision, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid revision %q: %w", revision, err)
+		}
+		conditions = gcstorage.Conditions{GenerationMatch: generation}
+	}
+
+	obj := g.bucket.Object(g.getFullKey(state.Workspace, state.ID)).If(conditions)
+	attrs, err := g.writeObject(ctx, obj, state.State, "application/json")
+	if err != nil {
+		if isPreconditionFailed(err) {
+			return storage.ErrConflict
+		}
+		return fmt.Errorf("failed to put state to GCS: %w", err)
+	}
+	state.Revision = strconv.FormatInt(attrs.Generation, 10)
+	return nil
+}
+
+func (g *GCSStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if err := g.bucket.Object(g.getFullKey(workspace, id)).Delete(ctx); err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete state from GCS: %w", err)
+	}
+	return nil
+}
+
+func (g *GCSStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	// The object iterator can end quietly instead of failing on a canceled context
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix := g.getFullKey(workspace, "")
+	it := g.bucket.Objects(ctx, &gcstorage.Query{Prefix: prefix, Delimiter: "/"})
+
+	states := []models.State{}
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list states from GCS: %w", err)
+		}
+
+		// Sub-prefixes come back as entries without a name
+		id := strings.TrimPrefix(attrs.Name, prefix)
+		if attrs.Name == "" || id == metaKeyName || strings.HasSuffix(id, ".lock") {
+			continue
+		}
+		states = append(states, models.State{
+			ID:        id,
+			Workspace: workspace,
+			CreatedAt: attrs.Created,
+			UpdatedAt: attrs.Updated,
+			Revision:  strconv.FormatInt(attrs.Generation, 10),
+		})
+	}
+	return states, nil
+}
+
+func (g *GCSStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix := g.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	it := g.bucket.Objects(ctx, &gcstorage.Query{Prefix: prefix, Delimiter: "/"})
+
+	workspaces := []string{}
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list workspaces from GCS: %w", err)
+		}
+		if attrs.Prefix != "" {
+			workspaces = append(workspaces, strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/"))
+		}
+	}
+	return workspaces, nil
+}
+
+// ListStateVersions lists the generations of a state kept by bucket
+// versioning, newest first
+func (g *GCSStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key := g.getFullKey(workspace, id)
+	it := g.bucket.Objects(ctx, &gcstorage.Query{Prefix: key, Versions: true})
+
+	versions := []models.StateVersion{}
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list state versions from GCS: %w", err)
+		}
+		if attrs.Name != key {
+			continue
+		}
+		versions = append(versions, models.StateVersion{
+			Version:   strconv.FormatInt(attrs.Generation, 10),
+			Size:      attrs.Size,
+			CreatedAt: attrs.Created,
+			Current:   attrs.Deleted.IsZero(),
+		})
+	}
+	if len(versions) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
+	})
+	return versions, nil
+}
+
+func (g *GCSStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, storage.ErrNotFound
+	}
+
+	obj := g.bucket.Object(g.getFullKey(workspace, id)).Generation(generation)
+	data, attrs, err := g.readObject(ctx, obj)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get state version from GCS: %w", err)
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+		UpdatedAt: attrs.LastModified,
+		Revision:  version,
+	}, nil
+}
+
+// getLockObject reads the lock at key and returns it with its generation
+func (g *GCSStorage) getLockObject(ctx context.Context, key string) (*models.StateLock, int64, error) {
+	data, attrs, err := g.readObject(ctx, g.bucket.Object(key))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, 0, err
+		}
+		return nil, 0, fmt.Errorf("failed to get lock from GCS: %w", err)
+	}
+
+	var lock models.StateLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode lock data: %w", err)
+	}
+	return &lock, attrs.Generation, nil
+}
+
+// putLockObject writes a lock under the given preconditions. A failed
+// precondition is reported as storage.ErrLocked.
+func (g *GCSStorage) putLockObject(ctx context.Context, workspace, id string, lock *models.StateLock, conditions gcstorage.Conditions) error {
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock data: %w", err)
+	}
+
+	obj := g.bucket.Object(g.getLockKey(workspace, id)).If(conditions)
+	if _, err := g.writeObject(ctx, obj, data, "application/json"); err != nil {
+		if isPreconditionFailed(err) {
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to put lock to GCS: %w", err)
+	}
+	return nil
+}
+
+// Lock creates the lock object on condition that it does not exist yet
+func (g *GCSStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	err := g.putLockObject(ctx, workspace, id, lock, gcstorage.Conditions{DoesNotExist: true})
+	if !errors.Is(err, storage.ErrLocked) {
+		return err
+	}
+
+	// Taking a lock again under the same lock ID succeeds
+	current, err := g.GetLock(ctx, workspace, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return storage.ErrLocked
+		}
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return nil
+}
+
+func (g *GCSStorage) Unlock(ctx context.Context, workspace, id string) error {
+	if err := g.bucket.Object(g.getLockKey(workspace, id)).Delete(ctx); err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("failed to delete lock from GCS: %w", err)
+	}
+	return nil
+}
+
+// UnlockIfMatch deletes the lock object on condition that it is still at the
+// generation lock was read at
+func (g *GCSStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	generation, err := strconv.ParseInt(lock.Revision, 10, 64)
+	if err != nil {
+		return storage.ErrLocked
+	}
+
+	obj := g.bucket.Object(g.getLockKey(workspace, id)).If(gcstorage.Conditions{GenerationMatch: generation})
+	if err := obj.Delete(ctx); err != nil {
+		if errors.Is(err, gcstorage.ErrObjectNotExist) {
+			return storage.ErrNotFound
+		}
+		if isPreconditionFailed(err) {
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to delete lock from GCS: %w", err)
+	}
+	return nil
+}
+
+func (g *GCSStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	lock, generation, err := g.getLockObject(ctx, g.getLockKey(workspace, id))
+	if err != nil {
+		return nil, err
+	}
+	lock.Workspace, lock.StateID = workspace, id
+	lock.Revision = strconv.FormatInt(generation, 10)
+	return lock, nil
+}
+
+func (g *GCSStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	prefix := g.prefix
+	if workspace != "" {
+		prefix = g.getFullKey(workspace, "")
+	} else if prefix != "" {
+		prefix += "/"
+	}
+
+	locks := []models.StateLock{}
+	it := g.bucket.Objects(ctx, &gcstorage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list locks from GCS: %w", err)
+		}
+		if !strings.HasSuffix(attrs.Name, ".lock") {
+			continue
+		}
+
+		lock, generation, err := g.getLockObject(ctx, attrs.Name)
+		if err != nil {
+			// The lock was released while listing
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		// Keys are <prefix>/<workspace>/<id>.lock
+		ws, id := path.Split(strings.TrimSuffix(attrs.Name, ".lock"))
+		lock.Workspace, lock.StateID = path.Base(ws), id
+		lock.Revision = strconv.FormatInt(generation, 10)
+		locks = append(locks, *lock)
+	}
+	return locks, nil
+}
+
+// RenewLock overwrites the lock only if it is at the generation that was read
+func (g *GCSStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	current, generation, err := g.getLockObject(ctx, g.getLockKey(workspace, id))
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return g.putLockObject(ctx, workspace, id, lock, gcstorage.Conditions{GenerationMatch: generation})
+}
+
+func (g *GCSStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	data, _, err := g.readObject(ctx, g.bucket.Object(g.getFullKey(workspace, metaKeyName)))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get workspace metadata from GCS: %w", err)
+	}
+
+	var meta models.WorkspaceMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode workspace metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (g *GCSStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal workspace metadata: %w", err)
+	}
+
+	obj := g.bucket.Object(g.getFullKey(meta.Workspace, metaKeyName))
+	if _, err := g.writeObject(ctx, obj, data, "application/json"); err != nil {
+		return fmt.Errorf("failed to put workspace metadata to GCS: %w", err)
+	}
+	return nil
+}
+
+// Ping writes the sentinel object next to the workspaces and reads it back
+func (g *GCSStorage) Ping(ctx context.Context) error {
+	key := storage.HealthKeyName
+	if g.prefix != "" {
+		key = g.prefix + "/" + key
+	}
+	obj := g.bucket.Object(key)
+	sentinel := time.Now().UTC().Format(time.RFC3339Nano)
+
+	if _, err := g.writeObject(ctx, obj, []byte(sentinel), "text/plain"); err != nil {
+		return fmt.Errorf("failed to write sentinel to GCS: %w", err)
+	}
+	data, _, err := g.readObject(ctx, obj)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel from GCS: %w", err)
+	}
+	if string(data) != sentinel {
+		return errors.New("sentinel read back from GCS does not match the one written")
+	}
+	return nil
+}
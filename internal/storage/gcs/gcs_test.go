@@ -0,0 +1,135 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	gcstorage "cloud.google.com/go/storage"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"google.golang.org/api/option"
+)
+
+// conditionalDeletes adds the ifGenerationMatch precondition of object
+// deletes, which the fake server ignores, by checking the object's generation
+// first. Changes are serialized so that the check and the delete are atomic.
+type conditionalDeletes struct {
+	server *fakestorage.Server
+	next   http.RoundTripper
+	mu     sync.Mutex
+}
+
+func (c *conditionalDeletes) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Method == http.MethodGet {
+		return c.next.RoundTrip(r)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	want := r.URL.Query().Get("ifGenerationMatch")
+	if r.Method != http.MethodDelete || want == "" {
+		return c.next.RoundTrip(r)
+	}
+	// Paths are /storage/v1/b/<bucket>/o/<object>
+	bucket, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/storage/v1/b/"), "/o/")
+	obj, err := c.server.GetObject(bucket, name)
+	if err == nil && strconv.FormatInt(obj.Generation, 10) != want {
+		body := `{"error":{"code":412,"message":"Precondition Failed"}}`
+		return &http.Response{
+			StatusCode: http.StatusPreconditionFailed,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	}
+	return c.next.RoundTrip(r)
+}
+
+// newFakeGCS starts an in-process fake GCS server with an empty versioned
+// bucket and returns a backend using it
+func newFakeGCS(t *testing.T) *GCSStorage {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{NoListener: true})
+	if err != nil {
+		t.Skipf("fake GCS server unavailable: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "states", VersioningEnabled: true})
+
+	transport := &conditionalDeletes{server: server, next: server.HTTPClient().Transport}
+	client, err := gcstorage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: transport}))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return NewGCSStorage(client, "states", "terrastate")
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return newFakeGCS(t)
+	})
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	g := newFakeGCS(t)
+
+	first := &models.State{Workspace: "ws", ID: "app", State: []byte(`{"serial":1}`)}
+	if err := g.PutStateIfMatch(ctx, first, ""); err != nil {
+		t.Fatalf("PutStateIfMatch of a new state: %v", err)
+	}
+	if err := g.PutStateIfMatch(ctx, &models.State{Workspace: "ws", ID: "app", State: []byte(`{}`)}, ""); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("PutStateIfMatch of an existing state without revision = %v, want ErrConflict", err)
+	}
+
+	second := &models.State{Workspace: "ws", ID: "app", State: []byte(`{"serial":2}`)}
+	if err := g.PutStateIfMatch(ctx, second, first.Revision); err != nil {
+		t.Fatalf("PutStateIfMatch at the current generation: %v", err)
+	}
+	if err := g.PutStateIfMatch(ctx, &models.State{Workspace: "ws", ID: "app", State: []byte(`{}`)}, first.Revision); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("PutStateIfMatch at a stale generation = %v, want ErrConflict", err)
+	}
+	if _, err := g.GetStateIfNoneMatch(ctx, "ws", "app", second.Revision); !errors.Is(err, storage.ErrNotModified) {
+		t.Errorf("GetStateIfNoneMatch at the current generation = %v, want ErrNotModified", err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	g := newFakeGCS(t)
+
+	revisions := make([]string, 3)
+	for i := range revisions {
+		state := &models.State{Workspace: "ws", ID: "app", State: []byte(fmt.Sprintf(`{"serial":%d}`, i+1))}
+		if err := g.PutState(ctx, state); err != nil {
+			t.Fatalf("PutState: %v", err)
+		}
+		revisions[i] = state.Revision
+	}
+
+	versions, err := g.ListStateVersions(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("ListStateVersions: %v", err)
+	}
+	if len(versions) != len(revisions) {
+		t.Fatalf("ListStateVersions = %+v, want %d versions", versions, len(revisions))
+	}
+	for i, revision := range revisions {
+		state, err := g.GetStateVersion(ctx, "ws", "app", revision)
+		if err != nil {
+			t.Fatalf("GetStateVersion %s: %v", revision, err)
+		}
+		if want := fmt.Sprintf(`{"serial":%d}`, i+1); string(state.State) != want {
+			t.Errorf("GetStateVersion %s = %s, want %s", revision, state.State, want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/disk"
+)
+
+// metaFileName matches the workspace metadata file of the disk backend, which
+// lays out the working tree
+const metaFileName = ".workspace.json"
+
+// committer is the identity git records as committer; the author of a commit
+// is the user who wrote the state
+const committer = "terrastate"
+
+// GitStorage keeps states as files in the working tree of a git repository,
+// laid out like the disk backend, and commits every change. Locks live in a
+// sidecar directory inside .git so they are never committed. If a remote is
+// configured, every commit is pushed to it.
+type GitStorage struct {
+	repoPath string
+	remote   string
+	files    *disk.DiskStorage
+	locks    *disk.DiskStorage
+
+	// mu serializes changes to the index and the working tree
+	mu sync.Mutex
+}
+
+// NewGitStorage opens the repository at repoPath, creating it if needed.
+// remote names the remote to push to and may be empty.
+func NewGitStorage(repoPath, remote string) (*GitStorage, error) {
+	g := &GitStorage{
+		repoPath: repoPath,
+		remote:   remote,
+		files:    disk.NewDiskStorage(repoPath),
+		locks:    disk.NewDiskStorage(filepath.Join(repoPath, ".git", "terrastate", "locks")),
+	}
+
+	if _, err := os.Stat(filepath.Join(repoPath, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(repoPath, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create repository directory: %w", err)
+		}
+		if _, err := g.git(context.Background(), "init", "-q"); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+	return g, nil
+}
+
+// git runs a git command in the repository and returns its output
+func (g *GitStorage) git(ctx context.Context, args ...string) ([]byte, error) {
+	return g.gitInput(ctx, nil, args...)
+}
+
+func (g *GitStorage) gitInput(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.repoPath
+	cmd.Env = append(os.Environ(),
+		"GIT_COMMITTER_NAME="+committer,
+		"GIT_COMMITTER_EMAIL="+committer,
+		"GIT_TERMINAL_PROMPT=0",
+	)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// statePath returns the path of a state relative to the repository root
+func statePath(workspace, id string) string {
+	return path.Join(workspace, id)
+}
+
+// checkNames refuses names that would reach outside the state files, most of
+// all into .git, where a written config could run commands on the next commit
+func checkNames(workspace, id string) error {
+	if err := storage.ValidateName(workspace); err != nil {
+		return err
+	}
+	return storage.ValidateName(id)
+}
+
+// author returns the commit author for the user in ctx
+func author(ctx context.Context) string {
+	name := storage.ActorFromContext(ctx)
+	if name == "" {
+		name = committer
+	}
+	return fmt.Sprintf("%s <%s>", name, name)
+}
+
+// commitMessage describes a state change, taking the subject from the lock
+// operation and the body from the lock info if the state is locked
+func commitMessage(action, workspace, id string, lock *models.StateLock) string {
+	subject := fmt.Sprintf("%s %s/%s", action, workspace, id)
+	if lock == nil {
+		return subject
+	}
+	if lock.Operation != "" {
+		subject = fmt.Sprintf("%s %s/%s", lock.Operation, workspace, id)
+	}
+
+	var msg strings.Builder
+	msg.WriteString(subject + "\n")
+	if lock.Info != "" {
+		msg.WriteString("\n" + lock.Info + "\n")
+	}
+	msg.WriteString("\nLock-ID: " + lock.ID + "\n")
+	if lock.Who != "" {
+		msg.WriteString("Lock-Who: " + lock.Who + "\n")
+	}
+	return msg.String()
+}
+
+// commit records the current content of paths, then pushes if a remote is
+// configured. A failed push is only logged: the commit is kept and goes out
+// with the next successful push.
+func (g *GitStorage) commit(ctx context.Context, message string, paths ...string) error {
+	args := append([]string{"add", "-A", "--"}, paths...)
+	if _, err := g.git(ctx, args...); err != nil {
+		return err
+	}
+	if _, err := g.gitInput(ctx, []byte(message), "commit", "-q", "--allow-empty",
+		"--author", author(ctx), "-F", "-"); err != nil {
+		return err
+	}
+
+	if g.remote != "" {
+		if _, err := g.git(ctx, "push", "-q", g.remote, "HEAD"); err != nil {
+			slog.WarnContext(ctx, "Failed to push state repository", "remote", g.remote, "error", err)
+		}
+	}
+	return nil
+}
+
+// restore puts file back as HEAD has it after a change to it could not be
+// committed, so that the working tree never keeps a change git doesn't record
+func (g *GitStorage) restore(ctx context.Context, file string) {
+	ctx = context.WithoutCancel(ctx)
+	var err error
+	if _, headErr := g.git(ctx, "cat-file", "-e", "HEAD:"+file); headErr == nil {
+		_, err = g.git(ctx, "checkout", "-q", "HEAD", "--", file)
+	} else if _, err = g.git(ctx, "rm", "-q", "--cached", "--ignore-unmatch", "--", file); err == nil {
+		// The file is new, and so may be its workspace directory
+		if err = os.Remove(filepath.Join(g.repoPath, file)); os.IsNotExist(err) {
+			err = nil
+		}
+		os.Remove(filepath.Join(g.repoPath, path.Dir(file)))
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to restore state file after a failed commit", "path", file, "error", err)
+	}
+}
+
+// currentLock returns the lock held on a state, or nil if there is none
+func (g *GitStorage) currentLock(ctx context.Context, workspace, id string) *models.StateLock {
+	lock, err := g.locks.GetLock(ctx, workspace, id)
+	if err != nil {
+		return nil
+	}
+	return lock
+}
+
+func (g *GitStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	if err := checkNames(workspace, id); err != nil {
+		return nil, err
+	}
+	return g.files.GetState(ctx, workspace, id)
+}
+
+func (g *GitStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := checkNames(state.Workspace, state.ID); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.files.PutState(ctx, state); err != nil {
+		return err
+	}
+	file := statePath(state.Workspace, state.ID)
+	message := commitMessage("Update", state.Workspace, state.ID, g.currentLock(ctx, state.Workspace, state.ID))
+	if err := g.commit(ctx, message, file); err != nil {
+		g.restore(ctx, file)
+		return err
+	}
+	return nil
+}
+
+func (g *GitStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if err := checkNames(workspace, id); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.files.DeleteState(ctx, workspace, id); err != nil {
+		return err
+	}
+	file := statePath(workspace, id)
+	message := commitMessage("Delete", workspace, id, g.currentLock(ctx, workspace, id))
+	if err := g.commit(ctx, message, file); err != nil {
+		g.restore(ctx, file)
+		return err
+	}
+	return nil
+}
+
+func (g *GitStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	if err := storage.ValidateName(workspace); err != nil {
+		return nil, err
+	}
+	return g.files.ListStates(ctx, workspace)
+}
+
+func (g *GitStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	return g.files.ListWorkspaces(ctx)
+}
+
+// ListStateVersions returns the commits that wrote a state, newest first
+func (g *GitStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	if err := checkNames(workspace, id); err != nil {
+		return nil, err
+	}
+
+	file := statePath(workspace, id)
+	out, err := g.git(ctx, "log", "--format=%H %ct", "--diff-filter=AMT", "--", file)
+	if err != nil {
+		// A repository without commits has no history
+		if _, headErr := g.git(ctx, "rev-parse", "-q", "--verify", "HEAD"); headErr != nil {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+
+	var versions []models.StateVersion
+	var objects bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		hash, timestamp, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid commit time %q: %w", timestamp, err)
+		}
+		versions = append(versions, models.StateVersion{
+			Version:   hash,
+			CreatedAt: time.Unix(seconds, 0).UTC(),
+		})
+		fmt.Fprintf(&objects, "%s:%s\n", hash, file)
+	}
+	if len(versions) == 0 {
+		return nil, storage.ErrNotFound
+	}
+
+	// Look up the size of every version in one go
+	out, err = g.gitInput(ctx, objects.Bytes(), "cat-file", "--batch-check=%(objectsize)")
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for i := 0; scanner.Scan() && i < len(versions); i++ {
+		versions[i].Size, _ = strconv.ParseInt(scanner.Text(), 10, 64)
+	}
+
+	if _, err := os.Stat(filepath.Join(g.repoPath, file)); err == nil {
+		versions[0].Current = true
+	}
+	return versions, nil
+}
+
+// GetStateVersion returns a state as written by the commit version
+func (g *GitStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	if err := checkNames(workspace, id); err != nil {
+		return nil, err
+	}
+	if !isCommitHash(version) {
+		return nil, storage.ErrNotFound
+	}
+
+	file := statePath(workspace, id)
+	data, err := g.git(ctx, "cat-file", "blob", version+":"+file)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, storage.ErrNotFound
+	}
+
+	out, err := g.git(ctx, "show", "-s", "--format=%ct", version)
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit time %q: %w", out, err)
+	}
+
+	return &models.State{
+		ID:        id,
+		Workspace: workspace,
+		State:     data,
+		UpdatedAt: time.Unix(seconds, 0).UTC(),
+	}, nil
+}
+
+// isCommitHash reports whether version looks like a full or abbreviated
+// commit hash, which also keeps it from being taken as a git option
+func isCommitHash(version string) bool {
+	if len(version) < 4 || len(version) > 64 {
+		return false
+	}
+	for _, c := range version {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *GitStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := checkNames(workspace, id); err != nil {
+		return err
+	}
+	return g.locks.Lock(ctx, workspace, id, lock)
+}
+
+func (g *GitStorage) Unlock(ctx context.Context, workspace, id string) error {
+	if err := checkNames(workspace, id); err != nil {
+		return err
+	}
+	return g.locks.Unlock(ctx, workspace, id)
+}
+
+func (g *GitStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := checkNames(workspace, id); err != nil {
+		return err
+	}
+	return g.locks.UnlockIfMatch(ctx, workspace, id, lock)
+}
+
+func (g *GitStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	if err := checkNames(workspace, id); err != nil {
+		return nil, err
+	}
+	return g.locks.GetLock(ctx, workspace, id)
+}
+
+func (g *GitStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	if workspace != "" {
+		if err := storage.ValidateName(workspace); err != nil {
+			return nil, err
+		}
+	}
+	return g.locks.ListLocks(ctx, workspace)
+}
+
+func (g *GitStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := checkNames(workspace, id); err != nil {
+		return err
+	}
+	return g.locks.RenewLock(ctx, workspace, id, lock)
+}
+
+func (g *GitStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	if err := storage.ValidateName(workspace); err != nil {
+		return nil, err
+	}
+	return g.files.GetWorkspaceMeta(ctx, workspace)
+}
+
+func (g *GitStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	if err := storage.ValidateName(meta.Workspace); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.files.PutWorkspaceMeta(ctx, meta); err != nil {
+		return err
+	}
+	file := path.Join(meta.Workspace, metaFileName)
+	message := fmt.Sprintf("Update workspace metadata of %s", meta.Workspace)
+	if err := g.commit(ctx, message, file); err != nil {
+		g.restore(ctx, file)
+		return err
+	}
+	return nil
+}
+
+// Ping checks that the repository can be read and that locks can be written.
+// The sentinel goes next to the locks so it never shows up in a commit.
+func (g *GitStorage) Ping(ctx context.Context) error {
+	if _, err := g.git(ctx, "rev-parse", "--git-dir"); err != nil {
+		return err
+	}
+	return g.locks.Ping(ctx)
+}
@@ -0,0 +1,145 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+// newGitStorage is gittest.NewStorage, which these tests can't import since
+// it imports this package
+func newGitStorage(t *testing.T) *GitStorage {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	g, err := NewGitStorage(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewGitStorage: %v", err)
+	}
+	return g
+}
+
+func TestReservedNames(t *testing.T) {
+	ctx := context.Background()
+	g := newGitStorage(t)
+	config := filepath.Join(g.repoPath, ".git", "config")
+	before, err := os.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []struct{ workspace, id string }{
+		{".git", "config"},
+		{".git", "HEAD"},
+		{"prod", ".workspace.json"},
+		{"prod", ".."},
+		{"..", "config"},
+	} {
+		state := &models.State{Workspace: name.workspace, ID: name.id, State: []byte(`[core]`)}
+		if err := g.PutState(ctx, state); !errors.Is(err, storage.ErrInvalidName) {
+			t.Errorf("PutState(%s/%s) = %v, want ErrInvalidName", name.workspace, name.id, err)
+		}
+		if _, err := g.GetState(ctx, name.workspace, name.id); !errors.Is(err, storage.ErrInvalidName) {
+			t.Errorf("GetState(%s/%s) = %v, want ErrInvalidName", name.workspace, name.id, err)
+		}
+		if err := g.Lock(ctx, name.workspace, name.id, &models.StateLock{ID: "1"}); !errors.Is(err, storage.ErrInvalidName) {
+			t.Errorf("Lock(%s/%s) = %v, want ErrInvalidName", name.workspace, name.id, err)
+		}
+	}
+	if err := g.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: ".git"}); !errors.Is(err, storage.ErrInvalidName) {
+		t.Errorf("PutWorkspaceMeta(.git) = %v, want ErrInvalidName", err)
+	}
+
+	after, err := os.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf(".git/config was rewritten:\n%s", after)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return newGitStorage(t)
+	})
+}
+
+// failCommits makes every later commit in the repository fail
+func failCommits(t *testing.T, g *GitStorage) {
+	hook := filepath.Join(g.repoPath, ".git", "hooks", "pre-commit")
+	if err := os.MkdirAll(filepath.Dir(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertClean fails if the working tree or the index has uncommitted changes
+func assertClean(t *testing.T, g *GitStorage) {
+	t.Helper()
+	out, err := g.git(context.Background(), "status", "--porcelain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 0 {
+		t.Errorf("working tree has uncommitted changes:\n%s", out)
+	}
+}
+
+func TestFailedCommitRestoresWorkingTree(t *testing.T) {
+	ctx := context.Background()
+	g := newGitStorage(t)
+	old := &models.State{Workspace: "prod", ID: "network", State: []byte(`{"serial":1}`)}
+	if err := g.PutState(ctx, old); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	failCommits(t, g)
+
+	t.Run("Update", func(t *testing.T) {
+		state := &models.State{Workspace: "prod", ID: "network", State: []byte(`{"serial":2}`)}
+		if err := g.PutState(ctx, state); err == nil {
+			t.Fatal("PutState succeeded with failing commits")
+		}
+		got, err := g.GetState(ctx, "prod", "network")
+		if err != nil {
+			t.Fatalf("GetState: %v", err)
+		}
+		if string(got.State) != string(old.State) {
+			t.Errorf("state = %s, want %s", got.State, old.State)
+		}
+		assertClean(t, g)
+	})
+
+	t.Run("Create", func(t *testing.T) {
+		state := &models.State{Workspace: "staging", ID: "network", State: []byte(`{"serial":1}`)}
+		if err := g.PutState(ctx, state); err == nil {
+			t.Fatal("PutState succeeded with failing commits")
+		}
+		if _, err := g.GetState(ctx, "staging", "network"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("GetState = %v, want ErrNotFound", err)
+		}
+		if workspaces, _ := g.ListWorkspaces(ctx); len(workspaces) != 1 {
+			t.Errorf("workspaces = %v, want [prod]", workspaces)
+		}
+		assertClean(t, g)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := g.DeleteState(ctx, "prod", "network"); err == nil {
+			t.Fatal("DeleteState succeeded with failing commits")
+		}
+		if _, err := g.GetState(ctx, "prod", "network"); err != nil {
+			t.Errorf("GetState: %v", err)
+		}
+		assertClean(t, g)
+	})
+}
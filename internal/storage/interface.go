@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"io"
 
 	"github.com/c4po/terrastate/internal/models"
 )
@@ -12,9 +14,186 @@ type StateStorage interface {
 	PutState(ctx context.Context, state *models.State) error
 	DeleteState(ctx context.Context, workspace, id string) error
 	ListStates(ctx context.Context, workspace string) ([]models.State, error)
+	// ListWorkspaces returns the workspaces holding states, locks or metadata
+	ListWorkspaces(ctx context.Context) ([]string, error)
 
 	// Lock operations
-	Lock(ctx context.Context, lock *models.StateLock) error
+	Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error
 	Unlock(ctx context.Context, workspace, id string) error
+	// UnlockIfMatch releases the lock only if it is still lock as read by
+	// GetLock or ListLocks: held under the same lock ID and unchanged since,
+	// as told by its Revision. It returns ErrLocked otherwise, and ErrNotFound
+	// if no lock is held.
+	UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error
 	GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error)
+	// ListLocks returns the locks held in workspace, or in every workspace
+	// if workspace is empty
+	ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error)
+	// RenewLock replaces the held lock with lock, which must carry the same
+	// lock ID, and returns ErrLocked otherwise
+	RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error
+
+	// Workspace metadata operations
+	GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error)
+	PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error
+}
+
+// ConditionalWriter is implemented by backends that can make a state write
+// conditional on the stored copy being unchanged. An empty revision means the
+// state must not exist yet. A failed condition returns ErrConflict.
+type ConditionalWriter interface {
+	PutStateIfMatch(ctx context.Context, state *models.State, revision string) error
+}
+
+// ConditionalReader is implemented by backends that can skip sending a state
+// the caller already has. GetStateIfNoneMatch returns ErrNotModified if the
+// stored state is still at revision. Backends implementing it also set
+// State.Revision on the states written by PutState.
+type ConditionalReader interface {
+	GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error)
+}
+
+// StreamWriter is implemented by backends that can write a state as they read
+// it from body, instead of holding it in memory. The State field of state is
+// ignored. If reading body fails nothing is written and the read error is
+// returned wrapped.
+type StreamWriter interface {
+	PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error
+}
+
+// StreamReader is implemented by backends that can return a state as a
+// stream, so that callers needing only its start don't read it whole. The
+// returned state has every field set but State, which is read from the
+// returned reader; the caller closes it.
+type StreamReader interface {
+	GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error)
+}
+
+// StateHistory is implemented by backends that keep previous versions of
+// states
+type StateHistory interface {
+	ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error)
+	GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error)
+}
+
+// Pinger is implemented by backends that can check they are reachable and
+// accept writes, by writing and reading back a sentinel object outside the
+// workspaces
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthKeyName is the name of the sentinel object written by Ping
+const HealthKeyName = ".terrastate-health"
+
+// Wrapper is implemented by storages that decorate another storage
+type Wrapper interface {
+	Unwrap() StateStorage
+}
+
+// Streams reports whether a state written with PutStateFrom on s reaches the
+// backend as a stream. Wrappers that need the whole state, such as caches,
+// don't implement StreamWriter and end the stream.
+func Streams(s StateStorage) bool {
+	for {
+		if _, ok := s.(StreamWriter); !ok {
+			return false
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			return true
+		}
+		s = w.Unwrap()
+	}
+}
+
+// ConditionalWrites reports whether PutStateIfMatch on s makes the write
+// conditional. Wrappers implement ConditionalWriter either way and write
+// unconditionally when the backend at the end of their chain can't.
+func ConditionalWrites(s StateStorage) bool {
+	for {
+		if _, ok := s.(ConditionalWriter); !ok {
+			return false
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			return true
+		}
+		s = w.Unwrap()
+	}
+}
+
+// ConditionalReads reports whether GetStateIfNoneMatch on s can return
+// ErrNotModified. Wrappers implement ConditionalReader either way and read
+// the whole state when the backend at the end of their chain can't.
+func ConditionalReads(s StateStorage) bool {
+	for {
+		if _, ok := s.(ConditionalReader); !ok {
+			return false
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			return true
+		}
+		s = w.Unwrap()
+	}
+}
+
+// History returns s as a StateHistory if the backend at the end of its chain
+// of wrappers keeps history. Wrappers implement StateHistory either way and
+// return ErrNotSupported when the backend has none, so a type assertion on s
+// alone can't tell.
+func History(s StateStorage) (StateHistory, bool) {
+	history, ok := s.(StateHistory)
+	if !ok {
+		return nil, false
+	}
+	for {
+		if _, ok := s.(StateHistory); !ok {
+			return nil, false
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			return history, true
+		}
+		s = w.Unwrap()
+	}
+}
+
+// As finds the first storage in the chain of wrappers starting at s that has
+// type T
+func As[T any](s StateStorage) (T, bool) {
+	for s != nil {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+		w, ok := s.(Wrapper)
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// CountingReader counts the bytes read through it, to report the size of
+// states written as a stream
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// TakeBody moves the body of state into a reader, for StreamReader
+// implementations that fall back to GetState
+func TakeBody(state *models.State) io.ReadCloser {
+	body := io.NopCloser(bytes.NewReader(state.State))
+	state.State = nil
+	return body
 }
@@ -0,0 +1,367 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// key identifies a state within the store
+type key struct {
+	Workspace string `json:"workspace"`
+	ID        string `json:"id"`
+}
+
+// MemoryStorage keeps states, locks and workspace metadata in maps guarded by
+// a single mutex. Nothing survives a restart unless a snapshot file is set.
+type MemoryStorage struct {
+	mu       sync.RWMutex
+	states   map[key]models.State
+	locks    map[key]models.StateLock
+	meta     map[string]models.WorkspaceMeta
+	snapshot string
+
+	// lockSeq numbers every lock and renewal, as the revision of the lock
+	lockSeq uint64
+}
+
+// snapshotData is the on-disk form of the store
+type snapshotData struct {
+	States []models.State         `json:"states"`
+	Locks  []models.StateLock     `json:"locks"`
+	Meta   []models.WorkspaceMeta `json:"meta"`
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		states: make(map[key]models.State),
+		locks:  make(map[key]models.StateLock),
+		meta:   make(map[string]models.WorkspaceMeta),
+	}
+}
+
+// NewMemoryStorageWithSnapshot creates a store that loads path on startup, if
+// it exists, and writes itself back to path on Close
+func NewMemoryStorageWithSnapshot(path string) (*MemoryStorage, error) {
+	m := NewMemoryStorage()
+	m.snapshot = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snap snapshotData
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal snapshot: %w", err)
+	}
+	for _, state := range snap.States {
+		m.states[key{state.Workspace, state.ID}] = state
+	}
+	for _, lock := range snap.Locks {
+		m.locks[key{lock.Workspace, lock.StateID}] = m.lockRecord(lock.Workspace, lock.StateID, &lock)
+	}
+	for _, meta := range snap.Meta {
+		m.meta[meta.Workspace] = meta
+	}
+	return m, nil
+}
+
+// Close writes the snapshot file, if one is configured
+func (m *MemoryStorage) Close() error {
+	if m.snapshot == "" {
+		return nil
+	}
+
+	m.mu.RLock()
+	snap := snapshotData{
+		States: make([]models.State, 0, len(m.states)),
+		Locks:  make([]models.StateLock, 0, len(m.locks)),
+		Meta:   make([]models.WorkspaceMeta, 0, len(m.meta)),
+	}
+	for _, state := range m.states {
+		snap.States = append(snap.States, state)
+	}
+	for _, lock := range m.locks {
+		snap.Locks = append(snap.Locks, lock)
+	}
+	for _, meta := range m.meta {
+		snap.Meta = append(snap.Meta, meta)
+	}
+	m.mu.RUnlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	// Write next to the target and rename so a crash never leaves half a snapshot
+	tmp, err := os.CreateTemp(filepath.Dir(m.snapshot), ".snapshot-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return os.Rename(tmp.Name(), m.snapshot)
+}
+
+// copyState returns state with its own copy of the state body, so callers
+// can't modify stored data
+func copyState(state models.State) *models.State {
+	state.State = append([]byte(nil), state.State...)
+	return &state
+}
+
+func (m *MemoryStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.states[key{workspace, id}]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return copyState(state), nil
+}
+
+func (m *MemoryStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stored := copyState(*state)
+	stored.UpdatedAt = time.Now().UTC()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{state.Workspace, state.ID}
+	if current, ok := m.states[k]; ok {
+		stored.CreatedAt = current.CreatedAt
+	} else {
+		stored.CreatedAt = stored.UpdatedAt
+	}
+	m.states[k] = *stored
+	return nil
+}
+
+func (m *MemoryStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{workspace, id}
+	if _, ok := m.states[k]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(m.states, k)
+	return nil
+}
+
+func (m *MemoryStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	states := []models.State{}
+	for k, state := range m.states {
+		if k.Workspace != workspace {
+			continue
+		}
+		states = append(states, models.State{
+			ID:        state.ID,
+			Workspace: state.Workspace,
+			CreatedAt: state.CreatedAt,
+			UpdatedAt: state.UpdatedAt,
+		})
+	}
+	return states, nil
+}
+
+func (m *MemoryStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	seen := make(map[string]bool)
+	for k := range m.states {
+		seen[k.Workspace] = true
+	}
+	for k := range m.locks {
+		seen[k.Workspace] = true
+	}
+	for workspace := range m.meta {
+		seen[workspace] = true
+	}
+
+	workspaces := []string{}
+	for workspace := range seen {
+		workspaces = append(workspaces, workspace)
+	}
+	sort.Strings(workspaces)
+	return workspaces, nil
+}
+
+func (m *MemoryStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{workspace, id}
+	if current, ok := m.locks[k]; ok {
+		// Taking a lock again under the same lock ID succeeds
+		if current.ID != lock.ID {
+			return storage.ErrLocked
+		}
+		return nil
+	}
+
+	m.locks[k] = m.lockRecord(workspace, id, lock)
+	return nil
+}
+
+// lockRecord returns the lock as stored, under the next revision. m.mu must
+// be held for writing.
+func (m *MemoryStorage) lockRecord(workspace, id string, lock *models.StateLock) models.StateLock {
+	m.lockSeq++
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	record.Revision = strconv.FormatUint(m.lockSeq, 10)
+	return record
+}
+
+func (m *MemoryStorage) Unlock(ctx context.Context, workspace, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{workspace, id}
+	if _, ok := m.locks[k]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(m.locks, k)
+	return nil
+}
+
+func (m *MemoryStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{workspace, id}
+	current, ok := m.locks[k]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if current.ID != lock.ID || current.Revision != lock.Revision {
+		return storage.ErrLocked
+	}
+	delete(m.locks, k)
+	return nil
+}
+
+func (m *MemoryStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	lock, ok := m.locks[key{workspace, id}]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &lock, nil
+}
+
+func (m *MemoryStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	locks := []models.StateLock{}
+	for k, lock := range m.locks {
+		if workspace == "" || k.Workspace == workspace {
+			locks = append(locks, lock)
+		}
+	}
+	return locks, nil
+}
+
+func (m *MemoryStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := key{workspace, id}
+	current, ok := m.locks[k]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+
+	m.locks[k] = m.lockRecord(workspace, id, lock)
+	return nil
+}
+
+func (m *MemoryStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	meta, ok := m.meta[workspace]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &meta, nil
+}
+
+func (m *MemoryStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.meta[meta.Workspace] = *meta
+	return nil
+}
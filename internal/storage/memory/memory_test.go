@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return NewMemoryStorage()
+	})
+}
+
+func TestConformanceWithSnapshot(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		m, err := NewMemoryStorageWithSnapshot(filepath.Join(t.TempDir(), "snapshot.json"))
+		if err != nil {
+			t.Fatalf("NewMemoryStorageWithSnapshot: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := m.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+		})
+		return m
+	})
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	m, err := NewMemoryStorageWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewMemoryStorageWithSnapshot of a missing file: %v", err)
+	}
+	if err := m.PutState(ctx, &models.State{Workspace: "ws", ID: "app", Serial: 3, State: []byte(`{"serial":3}`)}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	if err := m.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-1", Who: "ci"}); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := m.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	m, err = NewMemoryStorageWithSnapshot(path)
+	if err != nil {
+		t.Fatalf("NewMemoryStorageWithSnapshot: %v", err)
+	}
+	state, err := m.GetState(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetState after reload: %v", err)
+	}
+	if string(state.State) != `{"serial":3}` || state.Serial != 3 {
+		t.Errorf("GetState after reload = serial %d %q, want serial 3 %q", state.Serial, state.State, `{"serial":3}`)
+	}
+	lock, err := m.GetLock(ctx, "ws", "app")
+	if err != nil || lock.ID != "lock-1" || lock.Who != "ci" {
+		t.Errorf("GetLock after reload = %+v, %v, want lock-1 held by ci", lock, err)
+	}
+	meta, err := m.GetWorkspaceMeta(ctx, "ws")
+	if err != nil || !meta.Protected {
+		t.Errorf("GetWorkspaceMeta after reload = %+v, %v, want protected", meta, err)
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMemoryStorageWithSnapshot(path); err == nil {
+		t.Error("NewMemoryStorageWithSnapshot of an invalid file succeeded, want an error")
+	}
+}
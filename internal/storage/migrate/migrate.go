@@ -0,0 +1,266 @@
+// Package migrate copies workspaces, states with their history and workspace
+// metadata from one storage backend to another.
+//
+// A migration is planned first, which reads every state and refuses locked
+// states and states that already exist on the destination. Each state is
+// then copied under a lock taken on the source, so clients can't change it
+// mid-copy, and finally the destination is checked against the checksums of
+// what was read.
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// Item is a state to copy
+type Item struct {
+	Workspace string `json:"workspace"`
+	ID        string `json:"id"`
+	Size      int64  `json:"size"`
+	// Versions is the number of previous versions copied along
+	Versions int    `json:"versions"`
+	Checksum string `json:"checksum"`
+}
+
+func (i Item) String() string {
+	return i.Workspace + "/" + i.ID
+}
+
+// Plan lists what a migration copies and what stands in its way
+type Plan struct {
+	Workspaces []string `json:"workspaces"`
+	States     []Item   `json:"states"`
+	// Metadata lists the workspaces with metadata to copy
+	Metadata []string `json:"metadata"`
+	// Locked lists the states locked on the source
+	Locked []string `json:"locked"`
+	// Conflicts lists the states that already exist on the destination
+	Conflicts []string `json:"conflicts"`
+}
+
+// Err returns why the plan can't be carried out, or nil if it can
+func (p *Plan) Err(overwrite bool) error {
+	if len(p.Locked) > 0 {
+		return fmt.Errorf("refusing to migrate locked states: %v", p.Locked)
+	}
+	if len(p.Conflicts) > 0 && !overwrite {
+		return fmt.Errorf("states already exist on the destination: %v", p.Conflicts)
+	}
+	return nil
+}
+
+// NewPlan plans copying the given workspaces, or every workspace if none are
+// given, from source to destination
+func NewPlan(ctx context.Context, from, to storage.StateStorage, workspaces ...string) (*Plan, error) {
+	if len(workspaces) == 0 {
+		var err error
+		if workspaces, err = from.ListWorkspaces(ctx); err != nil {
+			return nil, fmt.Errorf("failed to list workspaces: %w", err)
+		}
+	}
+	slices.Sort(workspaces)
+
+	plan := &Plan{Workspaces: workspaces}
+	now := time.Now()
+	_, keepHistory := storage.History(to)
+
+	for _, workspace := range workspaces {
+		if _, err := from.GetWorkspaceMeta(ctx, workspace); err == nil {
+			plan.Metadata = append(plan.Metadata, workspace)
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+
+		locks, err := from.ListLocks(ctx, workspace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list locks of %s: %w", workspace, err)
+		}
+		for _, lock := range locks {
+			if !lock.Expired(now) {
+				plan.Locked = append(plan.Locked, workspace+"/"+lock.StateID)
+			}
+		}
+
+		states, err := from.ListStates(ctx, workspace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list states of %s: %w", workspace, err)
+		}
+		for _, listed := range states {
+			state, err := from.GetState(ctx, workspace, listed.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s/%s: %w", workspace, listed.ID, err)
+			}
+			item := Item{
+				Workspace: workspace,
+				ID:        listed.ID,
+				Size:      int64(len(state.State)),
+				Checksum:  checksum(state.State),
+			}
+			if keepHistory {
+				versions, err := PreviousVersions(ctx, from, workspace, listed.ID)
+				if err != nil {
+					return nil, err
+				}
+				item.Versions = len(versions)
+			}
+			plan.States = append(plan.States, item)
+
+			if _, err := to.GetState(ctx, workspace, listed.ID); err == nil {
+				plan.Conflicts = append(plan.Conflicts, item.String())
+			} else if !errors.Is(err, storage.ErrNotFound) {
+				return nil, fmt.Errorf("failed to check %s on the destination: %w", item, err)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// Run copies what plan lists and records the checksum of every state as
+// copied. progress is called after each state.
+func Run(ctx context.Context, from, to storage.StateStorage, plan *Plan, progress func(Item)) error {
+	for _, workspace := range plan.Metadata {
+		meta, err := from.GetWorkspaceMeta(ctx, workspace)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata of %s: %w", workspace, err)
+		}
+		if err := to.PutWorkspaceMeta(ctx, meta); err != nil {
+			return fmt.Errorf("failed to write metadata of %s: %w", workspace, err)
+		}
+	}
+
+	for i := range plan.States {
+		if err := copyState(ctx, from, to, &plan.States[i]); err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", plan.States[i], err)
+		}
+		if progress != nil {
+			progress(plan.States[i])
+		}
+	}
+	return nil
+}
+
+// Verify compares every copied state on the destination with its checksum
+// and returns the states that don't match
+func Verify(ctx context.Context, to storage.StateStorage, plan *Plan) ([]string, error) {
+	var mismatches []string
+	for _, item := range plan.States {
+		state, err := to.GetState(ctx, item.Workspace, item.ID)
+		if errors.Is(err, storage.ErrNotFound) {
+			mismatches = append(mismatches, item.String())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from the destination: %w", item, err)
+		}
+		if checksum(state.State) != item.Checksum {
+			mismatches = append(mismatches, item.String())
+		}
+	}
+	return mismatches, nil
+}
+
+// copyState copies a state under a lock on the source, oldest version first
+// if both backends keep history
+func copyState(ctx context.Context, from, to storage.StateStorage, item *Item) error {
+	lockID, err := newLockID()
+	if err != nil {
+		return err
+	}
+	lock := &models.StateLock{
+		ID:        lockID,
+		Operation: "migrate",
+		Who:       "terrastate migrate",
+		Created:   time.Now().UTC(),
+	}
+	if err := from.Lock(ctx, item.Workspace, item.ID, lock); err != nil {
+		return fmt.Errorf("failed to lock the source: %w", err)
+	}
+	defer from.Unlock(context.WithoutCancel(ctx), item.Workspace, item.ID)
+
+	_, keepHistory := storage.History(to)
+	if history, ok := storage.History(from); ok && keepHistory {
+		versions, err := PreviousVersions(ctx, from, item.Workspace, item.ID)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			state, err := history.GetStateVersion(ctx, item.Workspace, item.ID, version.Version)
+			if err != nil {
+				return fmt.Errorf("failed to read version %s: %w", version.Version, err)
+			}
+			if err := to.PutState(ctx, newState(item, state.State)); err != nil {
+				return err
+			}
+		}
+		item.Versions = len(versions)
+	}
+
+	state, err := from.GetState(ctx, item.Workspace, item.ID)
+	if err != nil {
+		return err
+	}
+	item.Size = int64(len(state.State))
+	item.Checksum = checksum(state.State)
+	return to.PutState(ctx, newState(item, state.State))
+}
+
+// PreviousVersions returns the versions of a state before the current one,
+// oldest first, or none if the source keeps no history
+func PreviousVersions(ctx context.Context, from storage.StateStorage, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := storage.History(from)
+	if !ok {
+		return nil, nil
+	}
+	versions, err := history.ListStateVersions(ctx, workspace, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrNotSupported) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list versions of %s/%s: %w", workspace, id, err)
+	}
+
+	var previous []models.StateVersion
+	for _, version := range versions {
+		if !version.Current {
+			previous = append(previous, version)
+		}
+	}
+	// Versions are listed newest first; sort by time but keep that order
+	// reversed for versions written within the same second
+	slices.Reverse(previous)
+	slices.SortStableFunc(previous, func(a, b models.StateVersion) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return previous, nil
+}
+
+func newState(item *Item, data []byte) *models.State {
+	return &models.State{
+		ID:        item.ID,
+		Workspace: item.Workspace,
+		State:     data,
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newLockID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lock ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+	"github.com/c4po/terrastate/internal/storage/storagetest/gittest"
+)
+
+// migrate plans and runs a migration of everything and checks the result
+func migrate(t *testing.T, from, to storage.StateStorage) *Plan {
+	ctx := context.Background()
+	plan, err := NewPlan(ctx, from, to)
+	if err != nil {
+		t.Fatalf("NewPlan: %v", err)
+	}
+	if err := plan.Err(false); err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if err := Run(ctx, from, to, plan, nil); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if mismatches, err := Verify(ctx, to, plan); err != nil || len(mismatches) > 0 {
+		t.Fatalf("Verify = %v, %v, want no mismatches", mismatches, err)
+	}
+	return plan
+}
+
+func TestMigrateIntoHistory(t *testing.T) {
+	from := memory.NewMemoryStorage()
+	storagetest.PutSerials(t, from, "ws", "app", 2)
+	to := gittest.NewStorage(t)
+
+	plan := migrate(t, from, to)
+	if len(plan.States) != 1 || plan.States[0].Versions != 0 {
+		t.Errorf("migrated %+v, want ws/app without previous versions", plan.States)
+	}
+	state, err := to.GetState(context.Background(), "ws", "app")
+	if err != nil || string(state.State) != `{"serial":2}` {
+		t.Errorf("GetState on the destination = %v, %v, want serial 2", state, err)
+	}
+}
+
+func TestMigrateHistory(t *testing.T) {
+	from := gittest.NewStorage(t)
+	storagetest.PutSerials(t, from, "ws", "app", 3)
+
+	plan := migrate(t, from, gittest.NewStorage(t))
+	if len(plan.States) != 1 || plan.States[0].Versions != 2 {
+		t.Errorf("migrated %+v, want ws/app with 2 previous versions", plan.States)
+	}
+
+	plan = migrate(t, from, memory.NewMemoryStorage())
+	if len(plan.States) != 1 || plan.States[0].Versions != 0 {
+		t.Errorf("migrated %+v into memory, want ws/app without previous versions", plan.States)
+	}
+}
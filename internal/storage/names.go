@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidateName checks a workspace or state name. Names starting with a dot
+// are reserved: backends keep workspace metadata, locks, the health sentinel
+// and, for git, the repository itself under such names.
+func ValidateName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
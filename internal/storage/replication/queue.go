@@ -0,0 +1,158 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of items in the retry queue
+const (
+	KindState = "state"
+	KindMeta  = "meta"
+)
+
+// Item is a state or workspace metadata waiting to be copied to the secondary
+type Item struct {
+	Kind      string    `json:"kind"`
+	Workspace string    `json:"workspace"`
+	ID        string    `json:"id,omitempty"`
+	Since     time.Time `json:"since"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+
+	// seq changes every time the item is queued again, so that a copy that
+	// started before the latest write doesn't take the item off the queue
+	seq uint64
+}
+
+type itemKey struct {
+	kind, workspace, id string
+}
+
+func (i *Item) key() itemKey {
+	return itemKey{i.Kind, i.Workspace, i.ID}
+}
+
+// queue holds the items still to be copied. With a path it is saved to that
+// file on every change and reloaded on start, so no pending copy is lost
+// across restarts.
+type queue struct {
+	path string
+
+	mu    sync.Mutex
+	items map[itemKey]*Item
+	seq   uint64
+}
+
+func openQueue(path string) (*queue, error) {
+	q := &queue{path: path, items: make(map[itemKey]*Item)}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, fmt.Errorf("failed to read replication queue: %w", err)
+	}
+	var items []*Item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to decode replication queue: %w", err)
+	}
+	for _, item := range items {
+		q.seq++
+		item.seq = q.seq
+		q.items[item.key()] = item
+	}
+	return q, nil
+}
+
+// add queues a copy, keeping the time of the oldest pending write
+func (q *queue) add(kind, workspace, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	k := itemKey{kind, workspace, id}
+	if item, ok := q.items[k]; ok {
+		item.seq = q.seq
+		return nil
+	}
+	q.items[k] = &Item{Kind: kind, Workspace: workspace, ID: id, Since: time.Now().UTC(), seq: q.seq}
+	return q.saveLocked()
+}
+
+// done takes item off the queue unless it was queued again since it was read
+func (q *queue) done(item Item) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if current, ok := q.items[item.key()]; ok && current.seq == item.seq {
+		delete(q.items, item.key())
+		return q.saveLocked()
+	}
+	return nil
+}
+
+// failed records a failed copy of item
+func (q *queue) failed(item Item, err error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if current, ok := q.items[item.key()]; ok {
+		current.Attempts++
+		current.LastError = err.Error()
+		return q.saveLocked()
+	}
+	return nil
+}
+
+// pending returns copies of the queued items, oldest first
+func (q *queue) pending() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Since.Before(items[j].Since)
+	})
+	return items
+}
+
+// saveLocked replaces the queue file; q.mu must be held
+func (q *queue) saveLocked() error {
+	if q.path == "" {
+		return nil
+	}
+
+	items := make([]*Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, item)
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return fmt.Errorf("failed to encode replication queue: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return fmt.Errorf("failed to create replication queue directory: %w", err)
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write replication queue: %w", err)
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return fmt.Errorf("failed to write replication queue: %w", err)
+	}
+	return nil
+}
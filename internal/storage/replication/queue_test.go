@@ -0,0 +1,90 @@
+package replication
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	q, err := openQueue("")
+	if err != nil {
+		t.Fatalf("openQueue: %v", err)
+	}
+	for _, id := range []string{"a", "b", "a"} {
+		if err := q.add(KindState, "ws", id); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	items := q.pending()
+	if len(items) != 2 || items[0].ID != "a" || items[1].ID != "b" {
+		t.Fatalf("pending = %+v, want a then b", items)
+	}
+
+	if err := q.failed(items[0], errors.New("secondary down")); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if item := q.pending()[0]; item.Attempts != 1 || item.LastError != "secondary down" {
+		t.Errorf("after failed, item = %+v, want 1 attempt and the error", item)
+	}
+
+	// a was queued again while the copy read before ran
+	if err := q.add(KindState, "ws", "a"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := q.done(items[0]); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+	if err := q.done(items[1]); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+	items = q.pending()
+	if len(items) != 1 || items[0].ID != "a" {
+		t.Fatalf("pending = %+v, want only a, queued again", items)
+	}
+	if err := q.done(items[0]); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+	if items := q.pending(); len(items) != 0 {
+		t.Errorf("pending = %+v, want none", items)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue", "replication.json")
+	q, err := openQueue(path)
+	if err != nil {
+		t.Fatalf("openQueue: %v", err)
+	}
+	if err := q.add(KindState, "ws", "app"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := q.add(KindMeta, "ws", ""); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := q.failed(q.pending()[0], errors.New("secondary down")); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	q, err = openQueue(path)
+	if err != nil {
+		t.Fatalf("openQueue after restart: %v", err)
+	}
+	items := q.pending()
+	if len(items) != 2 || items[0].Kind != KindState || items[0].Attempts != 1 || items[1].Kind != KindMeta {
+		t.Fatalf("reloaded %+v, want the state with 1 attempt, then the metadata", items)
+	}
+
+	// Items loaded from the file can be taken off the queue
+	if err := q.done(items[0]); err != nil {
+		t.Fatalf("done: %v", err)
+	}
+	q, err = openQueue(path)
+	if err != nil {
+		t.Fatalf("openQueue after restart: %v", err)
+	}
+	if items := q.pending(); len(items) != 1 || items[0].Kind != KindMeta {
+		t.Errorf("reloaded %+v, want only the metadata", items)
+	}
+}
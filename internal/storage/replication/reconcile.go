@@ -0,0 +1,166 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// Reasons for a divergence between primary and secondary
+const (
+	MissingOnSecondary = "missing on secondary"
+	MissingOnPrimary   = "missing on primary"
+	ContentDiffers     = "content differs"
+	MetadataDiffers    = "metadata differs"
+)
+
+// Divergence is a state or workspace metadata whose secondary copy doesn't
+// match the primary
+type Divergence struct {
+	Kind      string `json:"kind"`
+	Workspace string `json:"workspace"`
+	ID        string `json:"id,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Diff compares the states and workspace metadata of primary and secondary in
+// workspace, or in every workspace of either if workspace is empty
+func Diff(ctx context.Context, primary, secondary storage.StateStorage, workspace string) ([]Divergence, error) {
+	workspaces := []string{workspace}
+	if workspace == "" {
+		var err error
+		if workspaces, err = listWorkspaces(ctx, primary, secondary); err != nil {
+			return nil, err
+		}
+	}
+
+	divergences := []Divergence{}
+	for _, ws := range workspaces {
+		found, err := diffWorkspace(ctx, primary, secondary, ws)
+		if err != nil {
+			return nil, err
+		}
+		divergences = append(divergences, found...)
+	}
+	return divergences, nil
+}
+
+// Reconcile copies every divergent state and workspace metadata from primary
+// to secondary, deleting states the primary doesn't have, and returns what it
+// fixed. With dryRun it only reports what it would fix.
+func Reconcile(ctx context.Context, primary, secondary storage.StateStorage, workspace string, dryRun bool) ([]Divergence, error) {
+	divergences, err := Diff(ctx, primary, secondary, workspace)
+	if err != nil || dryRun {
+		return divergences, err
+	}
+
+	for _, d := range divergences {
+		if err := copyItem(ctx, primary, secondary, d.Kind, d.Workspace, d.ID); err != nil {
+			return nil, err
+		}
+	}
+	return divergences, nil
+}
+
+// Diff compares the primary and the secondary, see Diff
+func (r *ReplicatingStorage) Diff(ctx context.Context, workspace string) ([]Divergence, error) {
+	return Diff(ctx, r.StateStorage, r.secondary, workspace)
+}
+
+func listWorkspaces(ctx context.Context, primary, secondary storage.StateStorage) ([]string, error) {
+	var workspaces []string
+	for _, s := range []storage.StateStorage{primary, secondary} {
+		found, err := s.ListWorkspaces(ctx)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, found...)
+	}
+	slices.Sort(workspaces)
+	return slices.Compact(workspaces), nil
+}
+
+func diffWorkspace(ctx context.Context, primary, secondary storage.StateStorage, workspace string) ([]Divergence, error) {
+	var divergences []Divergence
+
+	primaryMeta, err := getMeta(ctx, primary, workspace)
+	if err != nil {
+		return nil, err
+	}
+	secondaryMeta, err := getMeta(ctx, secondary, workspace)
+	if err != nil {
+		return nil, err
+	}
+	if primaryMeta.Protected != secondaryMeta.Protected {
+		divergences = append(divergences, Divergence{Kind: KindMeta, Workspace: workspace, Reason: MetadataDiffers})
+	}
+
+	primaryIDs, err := listIDs(ctx, primary, workspace)
+	if err != nil {
+		return nil, err
+	}
+	secondaryIDs, err := listIDs(ctx, secondary, workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := slices.Compact(slices.Sorted(slices.Values(append(slices.Clone(primaryIDs), secondaryIDs...))))
+	for _, id := range ids {
+		reason := ""
+		switch {
+		case !slices.Contains(secondaryIDs, id):
+			reason = MissingOnSecondary
+		case !slices.Contains(primaryIDs, id):
+			reason = MissingOnPrimary
+		default:
+			same, err := sameState(ctx, primary, secondary, workspace, id)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				reason = ContentDiffers
+			}
+		}
+		if reason != "" {
+			divergences = append(divergences, Divergence{Kind: KindState, Workspace: workspace, ID: id, Reason: reason})
+		}
+	}
+	return divergences, nil
+}
+
+// getMeta returns the metadata of workspace, with defaults if it has none
+func getMeta(ctx context.Context, s storage.StateStorage, workspace string) (*models.WorkspaceMeta, error) {
+	meta, err := s.GetWorkspaceMeta(ctx, workspace)
+	if errors.Is(err, storage.ErrNotFound) {
+		return &models.WorkspaceMeta{Workspace: workspace}, nil
+	}
+	return meta, err
+}
+
+func listIDs(ctx context.Context, s storage.StateStorage, workspace string) ([]string, error) {
+	states, err := s.ListStates(ctx, workspace)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(states))
+	for _, state := range states {
+		ids = append(ids, state.ID)
+	}
+	return ids, nil
+}
+
+func sameState(ctx context.Context, primary, secondary storage.StateStorage, workspace, id string) (bool, error) {
+	a, err := primary.GetState(ctx, workspace, id)
+	if err != nil {
+		return false, err
+	}
+	b, err := secondary.GetState(ctx, workspace, id)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(a.State, b.State), nil
+}
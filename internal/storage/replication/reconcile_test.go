@@ -0,0 +1,91 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+)
+
+// diverged returns a primary and a secondary with one divergence of every
+// kind, and a state they agree on
+func diverged(t *testing.T) (primary, secondary storage.StateStorage) {
+	ctx := context.Background()
+	primary, secondary = memory.NewMemoryStorage(), memory.NewMemoryStorage()
+	put := func(s storage.StateStorage, workspace, id, content string) {
+		if err := s.PutState(ctx, &models.State{Workspace: workspace, ID: id, State: []byte(content)}); err != nil {
+			t.Fatalf("PutState: %v", err)
+		}
+	}
+	put(primary, "ws", "same", `{"serial":1}`)
+	put(secondary, "ws", "same", `{"serial":1}`)
+	put(primary, "ws", "changed", `{"serial":2}`)
+	put(secondary, "ws", "changed", `{"serial":1}`)
+	put(primary, "ws", "new", `{"serial":1}`)
+	put(secondary, "ws", "deleted", `{"serial":1}`)
+	put(secondary, "old", "app", `{"serial":1}`)
+	if err := primary.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+	// Without metadata on the primary, old is unprotected
+	if err := secondary.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "old", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+	return primary, secondary
+}
+
+var divergences = []Divergence{
+	{Kind: KindMeta, Workspace: "old", Reason: MetadataDiffers},
+	{Kind: KindState, Workspace: "old", ID: "app", Reason: MissingOnPrimary},
+	{Kind: KindMeta, Workspace: "ws", Reason: MetadataDiffers},
+	{Kind: KindState, Workspace: "ws", ID: "changed", Reason: ContentDiffers},
+	{Kind: KindState, Workspace: "ws", ID: "deleted", Reason: MissingOnPrimary},
+	{Kind: KindState, Workspace: "ws", ID: "new", Reason: MissingOnSecondary},
+}
+
+func TestDiff(t *testing.T) {
+	primary, secondary := diverged(t)
+	found, err := Diff(context.Background(), primary, secondary, "")
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !reflect.DeepEqual(found, divergences) {
+		t.Errorf("Diff = %+v, want %+v", found, divergences)
+	}
+
+	found, err = Diff(context.Background(), primary, secondary, "old")
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if !reflect.DeepEqual(found, divergences[:2]) {
+		t.Errorf("Diff of one workspace = %+v, want %+v", found, divergences[:2])
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := diverged(t)
+
+	fixed, err := Reconcile(ctx, primary, secondary, "", true)
+	if err != nil || !reflect.DeepEqual(fixed, divergences) {
+		t.Fatalf("dry run Reconcile = %+v, %v, want %+v", fixed, err, divergences)
+	}
+	if found, err := Diff(ctx, primary, secondary, ""); err != nil || len(found) != len(divergences) {
+		t.Fatalf("Diff after a dry run = %+v, %v, want nothing fixed", found, err)
+	}
+
+	fixed, err = Reconcile(ctx, primary, secondary, "", false)
+	if err != nil || !reflect.DeepEqual(fixed, divergences) {
+		t.Fatalf("Reconcile = %+v, %v, want %+v", fixed, err, divergences)
+	}
+	if found, err := Diff(ctx, primary, secondary, ""); err != nil || len(found) != 0 {
+		t.Errorf("Diff after Reconcile = %+v, %v, want none", found, err)
+	}
+	if _, err := secondary.GetState(ctx, "ws", "deleted"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetState of a state the primary doesn't have = %v, want ErrNotFound", err)
+	}
+}
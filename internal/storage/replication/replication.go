@@ -0,0 +1,364 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// Mode selects when writes are copied to the secondary
+type Mode string
+
+const (
+	// ModeSync copies every write to the secondary before the write returns.
+	// Copies that fail are queued and retried.
+	ModeSync Mode = "sync"
+	// ModeAsync queues every write and copies it in the background
+	ModeAsync Mode = "async"
+)
+
+// copyTimeout bounds a background copy, so that a hanging secondary can't
+// stall the queue or shutdown for long
+const copyTimeout = time.Minute
+
+// Status reports how far the secondary is behind the primary
+type Status struct {
+	Mode    Mode `json:"mode"`
+	Pending int  `json:"pending"`
+	// LagSeconds is the age of the oldest write not yet on the secondary
+	LagSeconds float64      `json:"lag_seconds"`
+	Replicated int64        `json:"replicated"`
+	Failures   int64        `json:"failures"`
+	LastSync   *time.Time   `json:"last_sync,omitempty"`
+	LastError  string       `json:"last_error,omitempty"`
+	Queue      []Item       `json:"queue"`
+	Divergence []Divergence `json:"divergence,omitempty"`
+}
+
+// ReplicatingStorage wraps a primary StateStorage and copies every state and
+// workspace metadata write to a secondary storage. Reads and locks only use
+// the primary: the secondary is a copy to fail over to, not a second place to
+// take locks. Copies are made by reading the primary, so retries always
+// converge on its latest content.
+type ReplicatingStorage struct {
+	storage.StateStorage
+
+	secondary     storage.StateStorage
+	mode          Mode
+	queue         *queue
+	retryInterval time.Duration
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+
+	replicated atomic.Int64
+	failures   atomic.Int64
+
+	mu        sync.Mutex
+	lastSync  time.Time
+	lastError string
+
+	// copying serializes the copies of each item, so that a copy that read
+	// the primary before a write can't land on the secondary after a copy
+	// that read it after the write
+	copyMu  sync.Mutex
+	copying map[itemKey]*itemLock
+}
+
+// itemLock is the lock of an item being copied and the number of copies
+// holding or waiting for it
+type itemLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewReplicatingStorage wraps primary and starts copying writes to secondary.
+// Failed copies are kept in a queue saved at queuePath, or only in memory if
+// queuePath is empty, and retried every retryInterval.
+func NewReplicatingStorage(primary, secondary storage.StateStorage, mode Mode, queuePath string, retryInterval time.Duration) (*ReplicatingStorage, error) {
+	if mode != ModeSync && mode != ModeAsync {
+		return nil, fmt.Errorf("invalid replication mode %q", mode)
+	}
+	q, err := openQueue(queuePath)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReplicatingStorage{
+		StateStorage:  primary,
+		secondary:     secondary,
+		mode:          mode,
+		queue:         q,
+		retryInterval: retryInterval,
+		copying:       make(map[itemKey]*itemLock),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go r.run()
+	// Pick up the copies left over from the last run right away
+	r.notify()
+	return r, nil
+}
+
+// Unwrap returns the primary storage
+func (r *ReplicatingStorage) Unwrap() storage.StateStorage {
+	return r.StateStorage
+}
+
+// Secondary returns the storage writes are copied to
+func (r *ReplicatingStorage) Secondary() storage.StateStorage {
+	return r.secondary
+}
+
+func (r *ReplicatingStorage) PutState(ctx context.Context, state *models.State) error {
+	if err := r.StateStorage.PutState(ctx, state); err != nil {
+		return err
+	}
+	r.replicate(ctx, KindState, state.Workspace, state.ID)
+	return nil
+}
+
+// PutStateIfMatch makes the write conditional if the primary supports it and
+// writes unconditionally otherwise
+func (r *ReplicatingStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	var err error
+	if writer, ok := r.StateStorage.(storage.ConditionalWriter); ok {
+		err = writer.PutStateIfMatch(ctx, state, revision)
+	} else {
+		err = r.StateStorage.PutState(ctx, state)
+	}
+	if err != nil {
+		return err
+	}
+	r.replicate(ctx, KindState, state.Workspace, state.ID)
+	return nil
+}
+
+func (r *ReplicatingStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	if err := r.StateStorage.DeleteState(ctx, workspace, id); err != nil {
+		return err
+	}
+	r.replicate(ctx, KindState, workspace, id)
+	return nil
+}
+
+func (r *ReplicatingStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	if err := r.StateStorage.PutWorkspaceMeta(ctx, meta); err != nil {
+		return err
+	}
+	r.replicate(ctx, KindMeta, meta.Workspace, "")
+	return nil
+}
+
+// GetStateIfNoneMatch uses the conditional read of the primary if it has one
+// and otherwise always returns the state
+func (r *ReplicatingStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	if reader, ok := r.StateStorage.(storage.ConditionalReader); ok {
+		return reader.GetStateIfNoneMatch(ctx, workspace, id, revision)
+	}
+	return r.StateStorage.GetState(ctx, workspace, id)
+}
+
+func (r *ReplicatingStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := r.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return history.ListStateVersions(ctx, workspace, id)
+}
+
+func (r *ReplicatingStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	history, ok := r.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return history.GetStateVersion(ctx, workspace, id, version)
+}
+
+// Close stops the background copies and closes both storages. Copies still
+// queued are kept in the queue file for the next start.
+func (r *ReplicatingStorage) Close() error {
+	close(r.stop)
+	<-r.done
+
+	var errs []error
+	for _, s := range []storage.StateStorage{r.StateStorage, r.secondary} {
+		if closer, ok := s.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status reports the replication counters and the queued copies
+func (r *ReplicatingStorage) Status() Status {
+	status := Status{
+		Mode:       r.mode,
+		Replicated: r.replicated.Load(),
+		Failures:   r.failures.Load(),
+		Queue:      r.queue.pending(),
+	}
+	status.Pending = len(status.Queue)
+	if status.Pending > 0 {
+		status.LagSeconds = time.Since(status.Queue[0].Since).Seconds()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.lastSync.IsZero() {
+		lastSync := r.lastSync
+		status.LastSync = &lastSync
+	}
+	status.LastError = r.lastError
+	return status
+}
+
+// replicate copies a write right away in sync mode and queues it otherwise
+// or if the copy failed
+func (r *ReplicatingStorage) replicate(ctx context.Context, kind, workspace, id string) {
+	if r.mode == ModeSync {
+		// The primary write is done, so finish the copy even if the client
+		// goes away
+		err := r.copy(context.WithoutCancel(ctx), kind, workspace, id)
+		r.record(err)
+		if err == nil {
+			return
+		}
+		slog.WarnContext(ctx, "Failed to replicate, queueing retry", "kind", kind, "workspace", workspace, "id", id, "error", err)
+	}
+
+	if err := r.queue.add(kind, workspace, id); err != nil {
+		slog.ErrorContext(ctx, "Failed to queue replication", "kind", kind, "workspace", workspace, "id", id, "error", err)
+	}
+	r.notify()
+}
+
+// copy brings the secondary copy of a state or workspace metadata in line
+// with the primary. Copies of the same item run one at a time, and each one
+// reads the primary only once the one before has written the secondary.
+func (r *ReplicatingStorage) copy(ctx context.Context, kind, workspace, id string) error {
+	defer r.lockItem(itemKey{kind, workspace, id})()
+	return copyItem(ctx, r.StateStorage, r.secondary, kind, workspace, id)
+}
+
+// lockItem waits until no other copy of k runs and returns the function
+// ending this one
+func (r *ReplicatingStorage) lockItem(k itemKey) func() {
+	r.copyMu.Lock()
+	l, ok := r.copying[k]
+	if !ok {
+		l = &itemLock{}
+		r.copying[k] = l
+	}
+	l.refs++
+	r.copyMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.copyMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(r.copying, k)
+		}
+		r.copyMu.Unlock()
+	}
+}
+
+func copyItem(ctx context.Context, from, to storage.StateStorage, kind, workspace, id string) error {
+	if kind == KindMeta {
+		// A workspace without metadata has the defaults
+		meta, err := getMeta(ctx, from, workspace)
+		if err != nil {
+			return err
+		}
+		return to.PutWorkspaceMeta(ctx, meta)
+	}
+
+	state, err := from.GetState(ctx, workspace, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		if err := to.DeleteState(ctx, workspace, id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return to.PutState(ctx, &models.State{
+		ID:        id,
+		Workspace: workspace,
+		Serial:    state.Serial,
+		State:     state.State,
+	})
+}
+
+// record updates the counters after a copy
+func (r *ReplicatingStorage) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.failures.Add(1)
+		r.lastError = err.Error()
+		return
+	}
+	r.replicated.Add(1)
+	r.lastSync = time.Now().UTC()
+}
+
+func (r *ReplicatingStorage) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run copies the queued items whenever there are new ones and retries the
+// failed ones every retry interval
+func (r *ReplicatingStorage) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+		r.drain()
+	}
+}
+
+func (r *ReplicatingStorage) drain() {
+	for _, item := range r.queue.pending() {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), copyTimeout)
+		err := r.copy(ctx, item.Kind, item.Workspace, item.ID)
+		cancel()
+		r.record(err)
+		if err != nil {
+			err = r.queue.failed(item, err)
+		} else {
+			err = r.queue.done(item)
+		}
+		if err != nil {
+			slog.Error("Failed to update replication queue", "error", err)
+		}
+	}
+}
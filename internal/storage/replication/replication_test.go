@@ -0,0 +1,197 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+)
+
+// secondary fails its writes while down and can hold a write of a given
+// content until released
+type secondary struct {
+	storage.StateStorage
+
+	mu   sync.Mutex
+	down bool
+	hold string
+
+	held    chan struct{}
+	release chan struct{}
+}
+
+func newSecondary() *secondary {
+	return &secondary{StateStorage: memory.NewMemoryStorage()}
+}
+
+func (s *secondary) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// holdWrite makes the next write of content wait until the returned function
+// is called, and returns once that write is waiting
+func (s *secondary) holdWrite(content string) (waiting <-chan struct{}, release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold = content
+	s.held = make(chan struct{})
+	s.release = make(chan struct{})
+	return s.held, func() { close(s.release) }
+}
+
+func (s *secondary) PutState(ctx context.Context, state *models.State) error {
+	s.mu.Lock()
+	down := s.down
+	var held, release chan struct{}
+	if s.hold != "" && s.hold == string(state.State) {
+		s.hold = ""
+		held, release = s.held, s.release
+	}
+	s.mu.Unlock()
+
+	if down {
+		return errors.New("secondary down")
+	}
+	if held != nil {
+		close(held)
+		<-release
+	}
+	return s.StateStorage.PutState(ctx, state)
+}
+
+func newReplicating(t *testing.T, mode Mode, secondary storage.StateStorage) *ReplicatingStorage {
+	r, err := NewReplicatingStorage(memory.NewMemoryStorage(), secondary, mode, "", 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewReplicatingStorage: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func putSerial(t *testing.T, s storage.StateStorage, serial int) {
+	state := &models.State{Workspace: "ws", ID: "app", State: []byte(fmt.Sprintf(`{"serial":%d}`, serial))}
+	if err := s.PutState(context.Background(), state); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+}
+
+// waitFor polls until the secondary holds serial of ws/app and the queue is
+// empty
+func waitFor(t *testing.T, r *ReplicatingStorage, serial int) {
+	want := fmt.Sprintf(`{"serial":%d}`, serial)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, err := r.Secondary().GetState(context.Background(), "ws", "app")
+		if err == nil && string(state.State) == want && r.Status().Pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("secondary has %v, %v with %d pending, want %s", state, err, r.Status().Pending, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSyncReplication(t *testing.T) {
+	ctx := context.Background()
+	r := newReplicating(t, ModeSync, newSecondary())
+	putSerial(t, r, 1)
+
+	state, err := r.Secondary().GetState(ctx, "ws", "app")
+	if err != nil || string(state.State) != `{"serial":1}` {
+		t.Fatalf("secondary GetState = %v, %v, want serial 1 as soon as PutState returns", state, err)
+	}
+	if err := r.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+	if meta, err := r.Secondary().GetWorkspaceMeta(ctx, "ws"); err != nil || !meta.Protected {
+		t.Errorf("secondary GetWorkspaceMeta = %v, %v, want protected", meta, err)
+	}
+	if err := r.DeleteState(ctx, "ws", "app"); err != nil {
+		t.Fatalf("DeleteState: %v", err)
+	}
+	if _, err := r.Secondary().GetState(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("secondary GetState after delete = %v, want ErrNotFound", err)
+	}
+
+	if status := r.Status(); status.Replicated != 3 || status.Failures != 0 || status.LastSync == nil {
+		t.Errorf("Status = %+v, want 3 copies and no failures", status)
+	}
+}
+
+func TestAsyncReplication(t *testing.T) {
+	r := newReplicating(t, ModeAsync, newSecondary())
+	putSerial(t, r, 1)
+	putSerial(t, r, 2)
+	waitFor(t, r, 2)
+}
+
+func TestSecondaryDown(t *testing.T) {
+	for _, mode := range []Mode{ModeSync, ModeAsync} {
+		t.Run(string(mode), func(t *testing.T) {
+			down := newSecondary()
+			down.setDown(true)
+			r := newReplicating(t, mode, down)
+
+			putSerial(t, r, 1)
+			state, err := r.GetState(context.Background(), "ws", "app")
+			if err != nil || string(state.State) != `{"serial":1}` {
+				t.Fatalf("GetState = %v, %v, want the write on the primary", state, err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				status := r.Status()
+				if status.Pending == 1 && status.Failures > 0 && status.LastError == "secondary down" {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Status = %+v, want the write queued after a failure", status)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			down.setDown(false)
+			waitFor(t, r, 1)
+		})
+	}
+}
+
+func TestCopiesKeepOrder(t *testing.T) {
+	slow := newSecondary()
+	r := newReplicating(t, ModeSync, slow)
+
+	waiting, release := slow.holdWrite(`{"serial":1}`)
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		putSerial(t, r, 1)
+	}()
+	<-waiting
+
+	// The copy of serial 2 can only read the primary once the copy of
+	// serial 1, which read it before, has written the secondary
+	second := make(chan struct{})
+	go func() {
+		defer close(second)
+		putSerial(t, r, 2)
+	}()
+	select {
+	case <-second:
+		t.Fatal("copy of serial 2 finished while the copy of serial 1 was still writing")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-first
+	<-second
+	waitFor(t, r, 2)
+}
@@ -0,0 +1,113 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+)
+
+// These tests run against the MinIO at MINIO_ENDPOINT, such as
+// http://127.0.0.1:9000, with the MINIO_ACCESS_KEY and MINIO_SECRET_KEY
+// credentials (minioadmin by default). MINIO_SSE sets the encryption to check,
+// AES256 or aws:kms, which needs a KMS configured on the MinIO server.
+
+// newMinIO returns a client of MinIO with path-style addressing and a new
+// bucket, or skips the test if MINIO_ENDPOINT isn't set
+func newMinIO(t *testing.T) (*s3.Client, string) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("MINIO_ENDPOINT not set")
+	}
+	accessKey, secretKey := os.Getenv("MINIO_ACCESS_KEY"), os.Getenv("MINIO_SECRET_KEY")
+	if accessKey == "" {
+		accessKey, secretKey = "minioadmin", "minioadmin"
+	}
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+	})
+	bucket := fmt.Sprintf("terrastate-%d", time.Now().UnixNano())
+	if _, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("CreateBucket on %s: %v", endpoint, err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				break
+			}
+			for _, obj := range page.Contents {
+				client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: obj.Key})
+			}
+		}
+		client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+	})
+	return client, bucket
+}
+
+func TestMinIOConformance(t *testing.T) {
+	if os.Getenv("MINIO_ENDPOINT") == "" {
+		t.Skip("MINIO_ENDPOINT not set")
+	}
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		client, bucket := newMinIO(t)
+		return NewS3Storage(client, bucket, "terrastate")
+	})
+}
+
+func TestMinIOObjectOptions(t *testing.T) {
+	ctx := context.Background()
+	client, bucket := newMinIO(t)
+	sse := types.ServerSideEncryption(os.Getenv("MINIO_SSE"))
+	s := NewS3StorageWithOptions(client, bucket, "terrastate", Options{
+		ServerSideEncryption: sse,
+		StorageClass:         types.StorageClassReducedRedundancy,
+		Tags:                 map[string]string{"team": "platform"},
+		TagStates:            true,
+	})
+
+	if err := s.PutState(ctx, &models.State{Workspace: "ws", ID: "app", Serial: 7, State: []byte(`{"serial":7}`)}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	key := aws.String(s.getFullKey("ws", "app"))
+
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: key})
+	if err != nil {
+		t.Fatalf("HeadObject: %v", err)
+	}
+	if head.StorageClass != types.StorageClassReducedRedundancy {
+		t.Errorf("storage class = %q, want %q", head.StorageClass, types.StorageClassReducedRedundancy)
+	}
+	if sse != "" && head.ServerSideEncryption != sse {
+		t.Errorf("server-side encryption = %q, want %q", head.ServerSideEncryption, sse)
+	}
+
+	tagging, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: key})
+	if err != nil {
+		t.Fatalf("GetObjectTagging: %v", err)
+	}
+	tags := make(map[string]string)
+	for _, tag := range tagging.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	for k, v := range map[string]string{"team": "platform", "workspace": "ws", "id": "app", "serial": "7"} {
+		if tags[k] != v {
+			t.Errorf("tag %s = %q, want %q (tags %v)", k, tags[k], v, tags)
+		}
+	}
+}
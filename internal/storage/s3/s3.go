@@ -4,30 +4,125 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
 )
 
+// metaKeyName is the workspace metadata object kept next to the state objects
+const metaKeyName = ".workspace.json"
+
+// locksPrefix holds the lock objects, apart from the states so that listing
+// every lock doesn't list every state
+const locksPrefix = ".locks"
+
+// errReleased is returned for a lock object emptied by UnlockIfMatch but not
+// deleted yet, which counts as no lock
+var errReleased = fmt.Errorf("lock was released: %w", storage.ErrNotFound)
+
+// releasedTimeout is how long an emptied lock object may stay behind before
+// Lock takes it over. Until then it belongs to an unlock still under way,
+// whose delete would otherwise remove the new lock.
+var releasedTimeout = time.Minute
+
 type S3Storage struct {
 	client     *s3.Client
+	uploader   *manager.Uploader
 	bucketName string
 	prefix     string // Optional prefix for all keys
+	options    Options
+}
+
+// Options sets how objects are written. The zero value leaves everything to
+// the bucket defaults.
+type Options struct {
+	// ServerSideEncryption is AES256 for SSE-S3 or aws:kms for SSE-KMS
+	ServerSideEncryption types.ServerSideEncryption
+	// KMSKeyID is the KMS key of SSE-KMS; the AWS managed key is used if empty
+	KMSKeyID string
+	// StorageClass is set on state objects only; locks, metadata and the
+	// health sentinel are small and read often, so they stay in the bucket
+	// default class
+	StorageClass types.StorageClass
+	ACL          types.ObjectCannedACL
+	// Tags are set on every object
+	Tags map[string]string
+	// TagStates adds the workspace, ID and serial of a state as tags of its
+	// object
+	TagStates bool
 }
 
-func NewS3Storage(client *s3.Client, bucketName string) *S3Storage {
-	prefix := os.Getenv("S3_PREFIX")
+func NewS3Storage(client *s3.Client, bucketName, prefix string) *S3Storage {
+	return NewS3StorageWithOptions(client, bucketName, prefix, Options{})
+}
+
+// NewS3StorageWithOptions writes objects with the encryption, storage class,
+// ACL and tags in options
+func NewS3StorageWithOptions(client *s3.Client, bucketName, prefix string, options Options) *S3Storage {
 	return &S3Storage{
 		client:     client,
+		uploader:   manager.NewUploader(client),
 		bucketName: bucketName,
 		prefix:     prefix,
+		options:    options,
 	}
 }
 
+// putObjectInput returns the input of a write of body to key with the
+// configured encryption and ACL, adding extraTags to the configured tags
+func (s *S3Storage) putObjectInput(key string, body io.Reader, extraTags map[string]string) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.bucketName),
+		Key:                  aws.String(key),
+		Body:                 body,
+		ServerSideEncryption: s.options.ServerSideEncryption,
+		ACL:                  s.options.ACL,
+	}
+	if s.options.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.options.KMSKeyID)
+	}
+
+	tags := url.Values{}
+	for k, v := range s.options.Tags {
+		tags.Set(k, v)
+	}
+	for k, v := range extraTags {
+		tags.Set(k, v)
+	}
+	if len(tags) > 0 {
+		input.Tagging = aws.String(tags.Encode())
+	}
+	return input
+}
+
+// getLockKey returns the S3 key of the lock object for a state, which is
+// <prefix>/.locks/<workspace>/<id>
+func (s *S3Storage) getLockKey(workspace, id string) string {
+	return s.getLocksPrefix() + workspace + "/" + id
+}
+
+// getLocksPrefix returns the key prefix of all the lock objects
+func (s *S3Storage) getLocksPrefix() string {
+	if s.prefix != "" {
+		return s.prefix + "/" + locksPrefix + "/"
+	}
+	return locksPrefix + "/"
+}
+
 // getFullKey returns the complete S3 key including any configured prefix
 func (s *S3Storage) getFullKey(workspace, id string) string {
 	key := fmt.Sprintf("%s/%s", workspace, id)
@@ -37,22 +132,77 @@ func (s *S3Storage) getFullKey(workspace, id string) string {
 	return key
 }
 
+// isNotFound reports whether err is S3's answer for a missing object
+func isNotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
+// isPreconditionFailed reports whether a conditional write lost against a
+// concurrent change of the object
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code := apiErr.ErrorCode()
+	return code == "PreconditionFailed" || code == "ConditionalRequestConflict"
+}
+
+// isNotModified reports whether a conditional read found the object unchanged
+func isNotModified(err error) bool {
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// checkExists returns storage.ErrNotFound if the object at key is missing
+func (s *S3Storage) checkExists(ctx context.Context, key string) error {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return storage.ErrNotFound
+		}
+		return fmt.Errorf("failed to check object in S3: %w", err)
+	}
+	return nil
+}
+
 func (s *S3Storage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	return s.getState(ctx, workspace, id, "")
+}
+
+// GetStateIfNoneMatch reads the state unless its ETag is still revision
+func (s *S3Storage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	return s.getState(ctx, workspace, id, revision)
+}
+
+func (s *S3Storage) getState(ctx context.Context, workspace, id, ifNoneMatch string) (*models.State, error) {
 	key := s.getFullKey(workspace, id)
 
-	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
-	})
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	output, err := s.client.GetObject(ctx, input)
 	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrNotFound
+		}
+		if isNotModified(err) {
+			return nil, storage.ErrNotModified
+		}
 		return nil, fmt.Errorf("failed to get state from S3: %w", err)
 	}
 	defer output.Body.Close()
 
-	state := &models.State{
-		ID:        id,
-		Workspace: workspace,
-	}
+	state := stateFromObject(workspace, id, output)
 
 	// Read the state data
 	stateData, err := io.ReadAll(output.Body)
@@ -61,19 +211,47 @@ func (s *S3Storage) GetState(ctx context.Context, workspace, id string) (*models
 	}
 	state.State = stateData
 
-	// Set metadata from object
+	return state, nil
+}
+
+// GetStateReader returns the body of the state object as it is downloaded
+func (s *S3Storage) GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.getFullKey(workspace, id)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil, storage.ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to get state from S3: %w", err)
+	}
+	return stateFromObject(workspace, id, output), output.Body, nil
+}
+
+// stateFromObject returns the state stored in a state object, without its
+// body
+func stateFromObject(workspace, id string, output *s3.GetObjectOutput) *models.State {
+	state := &models.State{
+		ID:        id,
+		Workspace: workspace,
+	}
 	if output.LastModified != nil {
 		state.UpdatedAt = *output.LastModified
 	}
 	if etag := output.ETag; etag != nil {
 		state.MD5 = *etag
+		state.Revision = *etag
 	}
-
-	return state, nil
+	return state
 }
 
 func (s *S3Storage) DeleteState(ctx context.Context, workspace, id string) error {
 	key := s.getFullKey(workspace, id)
+	if err := s.checkExists(ctx, key); err != nil {
+		return err
+	}
+
 	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
@@ -85,76 +263,378 @@ func (s *S3Storage) DeleteState(ctx context.Context, workspace, id string) error
 }
 
 func (s *S3Storage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
-	key := s.getFullKey(workspace, id) + ".lock"
+	lock, etag, err := s.getLockObject(ctx, s.getLockKey(workspace, id))
+	if err != nil {
+		return nil, err
+	}
+	lock.Workspace, lock.StateID = workspace, id
+	lock.Revision = etag
+	return lock, nil
+}
+
+// getLockObject reads the lock object at key and returns it with its ETag
+func (s *S3Storage) getLockObject(ctx context.Context, key string) (*models.StateLock, string, error) {
 	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get lock from S3: %w", err)
+		if isNotFound(err) {
+			return nil, "", storage.ErrNotFound
+		}
+		return nil, "", fmt.Errorf("failed to get lock from S3: %w", err)
 	}
 	defer output.Body.Close()
 
+	etag := aws.ToString(output.ETag)
 	var lock models.StateLock
 	if err := json.NewDecoder(output.Body).Decode(&lock); err != nil {
-		return nil, fmt.Errorf("failed to decode lock data: %w", err)
+		if errors.Is(err, io.EOF) {
+			return nil, etag, errReleased
+		}
+		return nil, "", fmt.Errorf("failed to decode lock data: %w", err)
+	}
+	return &lock, etag, nil
+}
+
+// putLockObject writes a lock object. With ifNoneMatch the write only
+// succeeds if no lock exists; with an ifMatch ETag only if the lock is
+// unchanged. A lost race is reported as storage.ErrLocked.
+func (s *S3Storage) putLockObject(ctx context.Context, workspace, id string, lock *models.StateLock, ifNoneMatch bool, ifMatch string) error {
+	record := *lock
+	record.Workspace, record.StateID = workspace, id
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock data: %w", err)
+	}
+
+	input := s.putObjectInput(s.getLockKey(workspace, id), bytes.NewReader(data), nil)
+	if ifNoneMatch {
+		input.IfNoneMatch = aws.String("*")
+	}
+	if ifMatch != "" {
+		input.IfMatch = aws.String(ifMatch)
 	}
-	return &lock, nil
+
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		if isPreconditionFailed(err) {
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to put lock to S3: %w", err)
+	}
+	return nil
 }
 
 func (s *S3Storage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
 	prefix := s.getFullKey(workspace, "")
-	output, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+
+	states := []models.State{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list states from S3: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			id := strings.TrimPrefix(*obj.Key, prefix)
+			// Names starting with a dot are reserved, for the metadata object
+			if strings.HasPrefix(id, ".") {
+				continue
+			}
+			states = append(states, models.State{
+				ID:        id,
+				Workspace: workspace,
+				UpdatedAt: aws.ToTime(obj.LastModified),
+			})
+		}
+	}
+	return states, nil
+}
+
+func (s *S3Storage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	prefix := s.prefix
+	if prefix != "" {
+		prefix += "/"
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+
+	workspaces := []string{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list workspaces from S3: %w", err)
+		}
+		for _, p := range page.CommonPrefixes {
+			workspace := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(p.Prefix), prefix), "/")
+			if workspace == locksPrefix {
+				continue
+			}
+			workspaces = append(workspaces, workspace)
+		}
+	}
+	return workspaces, nil
+}
+
+// Lock creates the lock object with a conditional write, which fails if the
+// lock is already held.
+func (s *S3Storage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	err := s.putLockObject(ctx, workspace, id, lock, true, "")
+	if !errors.Is(err, storage.ErrLocked) {
+		return err
+	}
+
+	current, _, err := s.getLockObject(ctx, s.getLockKey(workspace, id))
+	if errors.Is(err, errReleased) {
+		return s.takeReleased(ctx, workspace, id, lock)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return storage.ErrLocked
+		}
+		return err
+	}
+	// Taking a lock again under the same lock ID succeeds
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return nil
+}
+
+// takeReleased takes the lock over from an emptied lock object that an
+// unlock left behind for longer than releasedTimeout
+func (s *S3Storage) takeReleased(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	head, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucketName),
-		Prefix: aws.String(prefix),
+		Key:    aws.String(s.getLockKey(workspace, id)),
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list states from S3: %w", err)
+		if isNotFound(err) {
+			return storage.ErrLocked
+		}
+		return fmt.Errorf("failed to check lock in S3: %w", err)
 	}
+	if time.Since(aws.ToTime(head.LastModified)) < releasedTimeout {
+		return storage.ErrLocked
+	}
+	return s.putLockObject(ctx, workspace, id, lock, false, aws.ToString(head.ETag))
+}
 
-	var states []models.State
-	for _, obj := range output.Contents {
-		states = append(states, models.State{
-			ID:        *obj.Key,
-			Workspace: workspace,
-			UpdatedAt: *obj.LastModified,
-		})
+func (s *S3Storage) PutState(ctx context.Context, state *models.State) error {
+	output, err := s.client.PutObject(ctx, s.putStateInput(state, bytes.NewReader(state.State)))
+	if err != nil {
+		return fmt.Errorf("failed to put state to S3: %w", err)
 	}
-	return states, nil
+	state.Revision = aws.ToString(output.ETag)
+	return nil
 }
 
-func (s *S3Storage) Lock(ctx context.Context, lock *models.StateLock) error {
-	key := s.getFullKey(lock.Path, "") + ".lock"
-	data, err := json.Marshal(lock)
+// PutStateFrom uploads body in parts, so that only a few parts are held in
+// memory at a time. States smaller than a part are sent in a single request.
+func (s *S3Storage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	output, err := s.uploader.Upload(ctx, s.putStateInput(state, body))
 	if err != nil {
-		return fmt.Errorf("failed to marshal lock data: %w", err)
+		return fmt.Errorf("failed to upload state to S3: %w", err)
 	}
+	state.Revision = aws.ToString(output.ETag)
+	return nil
+}
+
+// putStateInput is putObjectInput for a state object, in the configured
+// storage class
+func (s *S3Storage) putStateInput(state *models.State, body io.Reader) *s3.PutObjectInput {
+	input := s.putObjectInput(s.getFullKey(state.Workspace, state.ID), body, s.stateTags(state))
+	input.StorageClass = s.options.StorageClass
+	return input
+}
+
+// stateTags returns the tags identifying state if states are tagged
+func (s *S3Storage) stateTags(state *models.State) map[string]string {
+	if !s.options.TagStates {
+		return nil
+	}
+	return map[string]string{
+		"workspace": state.Workspace,
+		"id":        state.ID,
+		"serial":    strconv.FormatInt(state.Serial, 10),
+	}
+}
+
+func (s *S3Storage) Unlock(ctx context.Context, workspace, id string) error {
+	key := s.getLockKey(workspace, id)
+	if _, _, err := s.getLockObject(ctx, key); err != nil {
+		return err
+	}
+	return s.deleteLockObject(ctx, key)
+}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+// UnlockIfMatch releases the lock in two steps, since S3 only takes an ETag
+// precondition on writes: the lock object is emptied on condition that its
+// ETag is still that of lock, which leaves a record nobody else can take or
+// release, and then deleted. On S3 implementations that accept an If-Match
+// write of a missing object, concurrent callers may each be told they
+// released the lock, but none of them removes a lock taken in between.
+func (s *S3Storage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	if lock.Revision == "" {
+		return storage.ErrLocked
+	}
+
+	// Some S3 implementations, MinIO among them, accept an If-Match write of
+	// a missing object
+	key := s.getLockKey(workspace, id)
+	if _, _, err := s.getLockObject(ctx, key); err != nil {
+		return err
+	}
+
+	input := s.putObjectInput(key, bytes.NewReader(nil), nil)
+	input.IfMatch = aws.String(lock.Revision)
+	if _, err := s.client.PutObject(ctx, input); err != nil {
+		if !isPreconditionFailed(err) && !isNotFound(err) {
+			return fmt.Errorf("failed to release lock in S3: %w", err)
+		}
+		if _, _, err := s.getLockObject(ctx, key); err != nil {
+			return err
+		}
+		return storage.ErrLocked
+	}
+	return s.deleteLockObject(ctx, key)
+}
+
+func (s *S3Storage) deleteLockObject(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
-		Body:   bytes.NewReader(data),
 	})
-	return err
+	if err != nil {
+		return fmt.Errorf("failed to delete lock from S3: %w", err)
+	}
+	return nil
 }
 
-func (s *S3Storage) PutState(ctx context.Context, state *models.State) error {
-	key := s.getFullKey(state.Workspace, state.ID)
-	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+// ListLocks lists the lock objects only, under the locks prefix of the
+// workspace or of all workspaces
+func (s *S3Storage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	locks := s.getLocksPrefix()
+	prefix := locks
+	if workspace != "" {
+		prefix = s.getLockKey(workspace, "")
+	}
+
+	list := []models.StateLock{}
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucketName),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(state.State),
+		Prefix: aws.String(prefix),
 	})
-	return err
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list locks from S3: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			key := *obj.Key
+			ws, id, ok := strings.Cut(strings.TrimPrefix(key, locks), "/")
+			if !ok {
+				continue
+			}
+
+			lock, etag, err := s.getLockObject(ctx, key)
+			if err != nil {
+				// The lock was released while listing
+				if errors.Is(err, storage.ErrNotFound) {
+					continue
+				}
+				return nil, err
+			}
+			lock.Workspace, lock.StateID = ws, id
+			lock.Revision = etag
+			list = append(list, *lock)
+		}
+	}
+	return list, nil
 }
 
-func (s *S3Storage) Unlock(ctx context.Context, workspace, id string) error {
-	key := s.getFullKey(workspace, id) + ".lock"
-	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+// RenewLock overwrites the lock only if it is unchanged since it was read
+func (s *S3Storage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	current, etag, err := s.getLockObject(ctx, s.getLockKey(workspace, id))
+	if err != nil {
+		return err
+	}
+	if current.ID != lock.ID {
+		return storage.ErrLocked
+	}
+	return s.putLockObject(ctx, workspace, id, lock, false, etag)
+}
+
+func (s *S3Storage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	key := s.getFullKey(workspace, metaKeyName)
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to get workspace metadata from S3: %w", err)
+	}
+	defer output.Body.Close()
+
+	var meta models.WorkspaceMeta
+	if err := json.NewDecoder(output.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("failed to decode workspace metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+func (s *S3Storage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	key := s.getFullKey(meta.Workspace, metaKeyName)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal workspace metadata: %w", err)
+	}
+
+	_, err = s.client.PutObject(ctx, s.putObjectInput(key, bytes.NewReader(data), nil))
 	return err
 }
 
-// Implement other interface methods...
+// Ping writes the sentinel object next to the workspaces and reads it back
+func (s *S3Storage) Ping(ctx context.Context) error {
+	key := storage.HealthKeyName
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	sentinel := time.Now().UTC().Format(time.RFC3339Nano)
+
+	input := s.putObjectInput(key, strings.NewReader(sentinel), nil)
+	input.ContentType = aws.String("text/plain")
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to write sentinel to S3: %w", err)
+	}
+
+	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel from S3: %w", err)
+	}
+	defer result.Body.Close()
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read sentinel from S3: %w", err)
+	}
+	if string(data) != sentinel {
+		return errors.New("sentinel read back from S3 does not match the one written")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/storagetest"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// conditionalWrites adds the If-None-Match and If-Match preconditions of
+// PutObject, which gofakes3 ignores, by checking the object with a HEAD
+// request first. Writes are serialized so that the check and the write are
+// atomic.
+func conditionalWrites(next http.Handler) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		ifNoneMatch, ifMatch := r.Header.Get("If-None-Match"), r.Header.Get("If-Match")
+		if ifNoneMatch != "" || ifMatch != "" {
+			head := httptest.NewRecorder()
+			next.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.String(), nil))
+			exists := head.Code == http.StatusOK
+			if (ifNoneMatch == "*" && exists) || (ifMatch != "" && (!exists || head.Header().Get("ETag") != ifMatch)) {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusPreconditionFailed)
+				w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newFakeS3 starts an in-process S3 stand-in and returns a client of it with
+// an empty bucket
+func newFakeS3(t *testing.T, bucket string) *s3.Client {
+	server := httptest.NewServer(conditionalWrites(gofakes3.New(s3mem.New()).Server()))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	if _, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	return client
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+		return NewS3Storage(newFakeS3(t, "states"), "states", "terrastate")
+	})
+}
+
+func TestListStatesNamedLikeLocks(t *testing.T) {
+	ctx := context.Background()
+	s := NewS3Storage(newFakeS3(t, "states"), "states", "terrastate")
+	for _, id := range []string{"app", "app.lock"} {
+		if err := s.PutState(ctx, &models.State{Workspace: "ws", ID: id, State: []byte(`{}`)}); err != nil {
+			t.Fatalf("PutState: %v", err)
+		}
+	}
+	if err := s.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-1"}); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := s.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws"}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+
+	states, err := s.ListStates(ctx, "ws")
+	if err != nil {
+		t.Fatalf("ListStates: %v", err)
+	}
+	var ids []string
+	for _, state := range states {
+		ids = append(ids, state.ID)
+	}
+	if !slices.Equal(ids, []string{"app", "app.lock"}) {
+		t.Errorf("ListStates = %v, want app and app.lock without the lock or metadata objects", ids)
+	}
+}
+
+func TestStorageClassOnStatesOnly(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	classes := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			mu.Lock()
+			classes[r.URL.Path] = r.Header.Get("X-Amz-Storage-Class")
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+	s := NewS3StorageWithOptions(client, "states", "", Options{StorageClass: types.StorageClassStandardIa})
+	if err := s.PutState(ctx, &models.State{Workspace: "ws", ID: "app", State: []byte(`{}`)}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	if err := s.Lock(ctx, "ws", "app", &models.StateLock{ID: "lock-1"}); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := s.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws"}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+
+	want := map[string]string{
+		"/states/ws/app":            "STANDARD_IA",
+		"/states/.locks/ws/app":     "",
+		"/states/ws/" + metaKeyName: "",
+	}
+	for path, class := range want {
+		if got, ok := classes[path]; !ok || got != class {
+			t.Errorf("storage class of %s = %q (written %v), want %q", path, got, ok, class)
+		}
+	}
+}
+
+func TestReleasedLockTakeover(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeS3(t, "states")
+	s := NewS3Storage(client, "states", "terrastate")
+
+	// An unlock that emptied the lock object but never deleted it
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String("states"),
+		Key:    aws.String(s.getLockKey("ws", "app")),
+		Body:   strings.NewReader(""),
+	})
+	if err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if _, err := s.GetLock(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetLock of a released lock = %v, want ErrNotFound", err)
+	}
+	if err := s.Lock(ctx, "ws", "app", &models.StateLock{ID: "1"}); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("Lock while the unlock may still be under way = %v, want ErrLocked", err)
+	}
+
+	defer func(timeout time.Duration) { releasedTimeout = timeout }(releasedTimeout)
+	releasedTimeout = 0
+	if err := s.Lock(ctx, "ws", "app", &models.StateLock{ID: "1"}); err != nil {
+		t.Fatalf("Lock after the released lock timed out: %v", err)
+	}
+	if lock, err := s.GetLock(ctx, "ws", "app"); err != nil || lock.ID != "1" {
+		t.Errorf("GetLock = %v, %v, want lock 1", lock, err)
+	}
+}
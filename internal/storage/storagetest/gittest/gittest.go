@@ -0,0 +1,25 @@
+// Package gittest provides git backends for tests that need a backend
+// keeping history. It is apart from storagetest, which the git package's own
+// tests import.
+package gittest
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/storage/git"
+)
+
+// NewStorage returns a git backend in a new directory, or skips the test
+// without git
+func NewStorage(t *testing.T) *git.GitStorage {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	g, err := git.NewGitStorage(t.TempDir(), "")
+	if err != nil {
+		t.Fatalf("NewGitStorage: %v", err)
+	}
+	return g
+}
@@ -0,0 +1,621 @@
+// Package storagetest provides a conformance suite that every
+// storage.StateStorage implementation must pass.
+//
+// A backend runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.StateStorage {
+//			return disk.NewDiskStorage(t.TempDir())
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// Factory returns an empty storage backend for a single test
+type Factory func(t *testing.T) storage.StateStorage
+
+var cases = []struct {
+	name string
+	run  func(t *testing.T, s storage.StateStorage)
+}{
+	{"StateRoundTrip", testStateRoundTrip},
+	{"NotFound", testNotFound},
+	{"ListStates", testListStates},
+	{"ListWorkspaces", testListWorkspaces},
+	{"Ping", testPing},
+	{"WorkspaceMeta", testWorkspaceMeta},
+	{"LockRoundTrip", testLockRoundTrip},
+	{"LockExclusive", testLockExclusive},
+	{"Unlock", testUnlock},
+	{"RenewLock", testRenewLock},
+	{"UnlockIfMatch", testUnlockIfMatch},
+	{"ConcurrentUnlockIfMatch", testConcurrentUnlockIfMatch},
+	{"ConcurrentWriters", testConcurrentWriters},
+	{"ConcurrentLockers", testConcurrentLockers},
+	{"LargeState", testLargeState},
+	{"StreamWrite", testStreamWrite},
+	{"StreamRead", testStreamRead},
+	{"ContextCanceled", testContextCanceled},
+}
+
+// Run runs the conformance suite against the backends made by newStorage.
+// Every case gets a fresh backend.
+func Run(t *testing.T, newStorage Factory) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.run(t, newStorage(t))
+		})
+	}
+}
+
+// PutSerials writes serials 1 to serials of workspace/id, each as a state
+// document holding only its serial
+func PutSerials(t *testing.T, s storage.StateStorage, workspace, id string, serials int) {
+	t.Helper()
+	for serial := 1; serial <= serials; serial++ {
+		mustPut(t, s, &models.State{Workspace: workspace, ID: id, State: []byte(fmt.Sprintf(`{"serial":%d}`, serial))})
+	}
+}
+
+func newState(workspace, id string, serial int) *models.State {
+	return &models.State{
+		Workspace: workspace,
+		ID:        id,
+		State:     []byte(fmt.Sprintf(`{"version":4,"serial":%d,"lineage":"storagetest"}`, serial)),
+	}
+}
+
+func newLock(id string) *models.StateLock {
+	return &models.StateLock{
+		ID:        id,
+		Operation: "OperationTypeApply",
+		Who:       "ci@runner",
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}
+}
+
+func mustPut(t *testing.T, s storage.StateStorage, state *models.State) {
+	t.Helper()
+	if err := s.PutState(context.Background(), state); err != nil {
+		t.Fatalf("PutState %s/%s: %v", state.Workspace, state.ID, err)
+	}
+}
+
+func testStateRoundTrip(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	for serial := 1; serial <= 2; serial++ {
+		want := newState("ws", "app", serial)
+		mustPut(t, s, want)
+
+		got, err := s.GetState(ctx, "ws", "app")
+		if err != nil {
+			t.Fatalf("GetState: %v", err)
+		}
+		if got.Workspace != "ws" || got.ID != "app" {
+			t.Errorf("GetState returned %s/%s, want ws/app", got.Workspace, got.ID)
+		}
+		if !bytes.Equal(got.State, want.State) {
+			t.Errorf("GetState = %s, want %s", got.State, want.State)
+		}
+	}
+
+	if err := s.DeleteState(ctx, "ws", "app"); err != nil {
+		t.Fatalf("DeleteState: %v", err)
+	}
+	if _, err := s.GetState(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetState after DeleteState: got %v, want ErrNotFound", err)
+	}
+}
+
+func testNotFound(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	if _, err := s.GetState(ctx, "ws", "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetState: got %v, want ErrNotFound", err)
+	}
+	if err := s.DeleteState(ctx, "ws", "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("DeleteState: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetLock(ctx, "ws", "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetLock: got %v, want ErrNotFound", err)
+	}
+	if err := s.Unlock(ctx, "ws", "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Unlock: got %v, want ErrNotFound", err)
+	}
+	if err := s.RenewLock(ctx, "ws", "missing", newLock("lock-1")); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("RenewLock: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetWorkspaceMeta(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetWorkspaceMeta: got %v, want ErrNotFound", err)
+	}
+}
+
+func testListStates(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	mustPut(t, s, newState("ws", "b", 1))
+	mustPut(t, s, newState("ws", "a", 1))
+	mustPut(t, s, newState("other", "c", 1))
+	// Locks and metadata must not show up as states
+	if err := s.Lock(ctx, "ws", "a", newLock("lock-1")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := s.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+
+	states, err := s.ListStates(ctx, "ws")
+	if err != nil {
+		t.Fatalf("ListStates: %v", err)
+	}
+	var ids []string
+	for _, state := range states {
+		if state.Workspace != "ws" {
+			t.Errorf("ListStates returned state %s in workspace %q", state.ID, state.Workspace)
+		}
+		ids = append(ids, state.ID)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"a", "b"}) {
+		t.Errorf("ListStates = %v, want [a b]", ids)
+	}
+
+	states, err = s.ListStates(ctx, "empty")
+	if err != nil || len(states) != 0 {
+		t.Errorf("ListStates of an empty workspace = %v, %v, want none", states, err)
+	}
+}
+
+func testListWorkspaces(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	workspaces, err := s.ListWorkspaces(ctx)
+	if err != nil || len(workspaces) != 0 {
+		t.Errorf("ListWorkspaces of an empty backend = %v, %v, want none", workspaces, err)
+	}
+
+	mustPut(t, s, newState("ws", "a", 1))
+	mustPut(t, s, newState("ws", "b", 1))
+	if err := s.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "meta-only", Protected: true}); err != nil {
+		t.Fatalf("PutWorkspaceMeta: %v", err)
+	}
+
+	workspaces, err = s.ListWorkspaces(ctx)
+	if err != nil {
+		t.Fatalf("ListWorkspaces: %v", err)
+	}
+	slices.Sort(workspaces)
+	if !slices.Equal(workspaces, []string{"meta-only", "ws"}) {
+		t.Errorf("ListWorkspaces = %v, want [meta-only ws]", workspaces)
+	}
+}
+
+func testPing(t *testing.T, s storage.StateStorage) {
+	pinger, ok := storage.As[storage.Pinger](s)
+	if !ok {
+		t.Skip("backend does not implement storage.Pinger")
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := pinger.Ping(ctx); err != nil {
+			t.Fatalf("Ping: %v", err)
+		}
+	}
+	// The sentinel must stay out of the workspaces
+	workspaces, err := s.ListWorkspaces(ctx)
+	if err != nil || len(workspaces) != 0 {
+		t.Errorf("ListWorkspaces after Ping = %v, %v, want none", workspaces, err)
+	}
+}
+
+func testWorkspaceMeta(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	for _, protected := range []bool{true, false} {
+		if err := s.PutWorkspaceMeta(ctx, &models.WorkspaceMeta{Workspace: "ws", Protected: protected}); err != nil {
+			t.Fatalf("PutWorkspaceMeta: %v", err)
+		}
+		meta, err := s.GetWorkspaceMeta(ctx, "ws")
+		if err != nil {
+			t.Fatalf("GetWorkspaceMeta: %v", err)
+		}
+		if meta.Workspace != "ws" || meta.Protected != protected {
+			t.Errorf("GetWorkspaceMeta = %+v, want protected=%t", meta, protected)
+		}
+	}
+}
+
+func testLockRoundTrip(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	lock := newLock("lock-1")
+
+	if err := s.Lock(ctx, "ws", "app", lock); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	got, err := s.GetLock(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if got.ID != lock.ID || got.Who != lock.Who || got.Workspace != "ws" || got.StateID != "app" {
+		t.Fatalf("GetLock = %+v, want lock %s on ws/app", got, lock.ID)
+	}
+	if !got.Created.Equal(lock.Created) {
+		t.Errorf("GetLock created = %v, want %v", got.Created, lock.Created)
+	}
+	if _, err := s.GetLock(ctx, "ws", "other"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetLock on another state: got %v, want ErrNotFound", err)
+	}
+
+	locks, err := s.ListLocks(ctx, "ws")
+	if err != nil {
+		t.Fatalf("ListLocks: %v", err)
+	}
+	if len(locks) != 1 || locks[0].Workspace != "ws" || locks[0].StateID != "app" {
+		t.Fatalf("ListLocks = %+v, want the lock on ws/app", locks)
+	}
+	if locks, err := s.ListLocks(ctx, ""); err != nil || len(locks) != 1 {
+		t.Fatalf("ListLocks of all workspaces = %+v, %v, want one lock", locks, err)
+	}
+
+	if err := s.Unlock(ctx, "ws", "app"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if _, err := s.GetLock(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetLock after Unlock: got %v, want ErrNotFound", err)
+	}
+	if locks, err := s.ListLocks(ctx, ""); err != nil || len(locks) != 0 {
+		t.Fatalf("ListLocks after Unlock = %+v, %v, want none", locks, err)
+	}
+}
+
+func testLockExclusive(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-1")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-2")); !errors.Is(err, storage.ErrLocked) {
+		t.Fatalf("Lock held by another ID: got %v, want ErrLocked", err)
+	}
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-1")); err != nil {
+		t.Errorf("Lock again with the same ID: %v", err)
+	}
+
+	got, err := s.GetLock(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if got.ID != "lock-1" {
+		t.Errorf("GetLock ID = %s, want lock-1", got.ID)
+	}
+
+	// Locks on other states are independent
+	if err := s.Lock(ctx, "ws", "other", newLock("lock-2")); err != nil {
+		t.Errorf("Lock on another state: %v", err)
+	}
+}
+
+func testUnlock(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	mustPut(t, s, newState("ws", "app", 1))
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-1")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	if err := s.Unlock(ctx, "ws", "app"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := s.Unlock(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("second Unlock: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetState(ctx, "ws", "app"); err != nil {
+		t.Errorf("GetState after Unlock: %v", err)
+	}
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-2")); err != nil {
+		t.Errorf("Lock after Unlock: %v", err)
+	}
+}
+
+func testRenewLock(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	lock := newLock("lock-1")
+	if err := s.Lock(ctx, "ws", "app", lock); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	renewed := *lock
+	renewed.TTLSeconds = 60
+	renewed.Renewed = lock.Created.Add(time.Minute)
+	if err := s.RenewLock(ctx, "ws", "app", &renewed); err != nil {
+		t.Fatalf("RenewLock: %v", err)
+	}
+	got, err := s.GetLock(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+	if got.TTLSeconds != 60 || !got.Renewed.Equal(renewed.Renewed) {
+		t.Errorf("GetLock after RenewLock = %+v, want ttl 60 renewed at %v", got, renewed.Renewed)
+	}
+
+	if err := s.RenewLock(ctx, "ws", "app", newLock("lock-2")); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("RenewLock with another ID: got %v, want ErrLocked", err)
+	}
+}
+
+func testUnlockIfMatch(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	lock := newLock("lock-1")
+	if err := s.Lock(ctx, "ws", "app", lock); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	read, err := s.GetLock(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+
+	// A renewal makes the lock read before it stale
+	renewed := *read
+	renewed.Renewed = lock.Created.Add(time.Minute)
+	if err := s.RenewLock(ctx, "ws", "app", &renewed); err != nil {
+		t.Fatalf("RenewLock: %v", err)
+	}
+	if err := s.UnlockIfMatch(ctx, "ws", "app", read); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("UnlockIfMatch of the lock before renewal: got %v, want ErrLocked", err)
+	}
+
+	listed, err := s.ListLocks(ctx, "ws")
+	if err != nil || len(listed) != 1 {
+		t.Fatalf("ListLocks = %v, %v, want one lock", listed, err)
+	}
+	if err := s.UnlockIfMatch(ctx, "ws", "app", &listed[0]); err != nil {
+		t.Fatalf("UnlockIfMatch of the listed lock: %v", err)
+	}
+	if _, err := s.GetLock(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetLock after UnlockIfMatch: got %v, want ErrNotFound", err)
+	}
+	if err := s.UnlockIfMatch(ctx, "ws", "app", &listed[0]); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("second UnlockIfMatch: got %v, want ErrNotFound", err)
+	}
+
+	// A new lock under another ID is left alone
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-2")); err != nil {
+		t.Fatalf("Lock after UnlockIfMatch: %v", err)
+	}
+	if err := s.UnlockIfMatch(ctx, "ws", "app", &listed[0]); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("UnlockIfMatch of a replaced lock: got %v, want ErrLocked", err)
+	}
+	if got, err := s.GetLock(ctx, "ws", "app"); err != nil || got.ID != "lock-2" {
+		t.Errorf("GetLock = %v, %v, want lock-2", got, err)
+	}
+}
+
+// testConcurrentUnlockIfMatch has clients that all read the same lock race
+// to release it and take their own, as clients clearing an expired lock do.
+// A release must never remove a lock taken in between, so that no two
+// clients end up holding the lock.
+func testConcurrentUnlockIfMatch(t *testing.T, s storage.StateStorage) {
+	ctx := context.Background()
+	if err := s.Lock(ctx, "ws", "app", newLock("expired")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	read, err := s.GetLock(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetLock: %v", err)
+	}
+
+	const clients = 8
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	released, acquired := 0, 0
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.UnlockIfMatch(ctx, "ws", "app", read)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrLocked) {
+				t.Errorf("UnlockIfMatch: %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				released++
+				mu.Unlock()
+			}
+			err = s.Lock(ctx, "ws", "app", newLock(fmt.Sprintf("lock-%d", i)))
+			if err != nil && !errors.Is(err, storage.ErrLocked) {
+				t.Errorf("Lock: %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				acquired++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if released == 0 {
+		t.Errorf("none of %d clients released the lock they read", clients)
+	}
+	if acquired > 1 {
+		t.Errorf("%d of %d clients acquired the lock, want at most 1", acquired, clients)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, s storage.StateStorage) {
+	const writers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.PutState(context.Background(), newState("ws", "app", i))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("PutState: %v", err)
+		}
+	}
+
+	got, err := s.GetState(context.Background(), "ws", "app")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	for i := range writers {
+		if bytes.Equal(got.State, newState("ws", "app", i).State) {
+			return
+		}
+	}
+	t.Errorf("GetState = %s, want the body of one of the writers", got.State)
+}
+
+func testConcurrentLockers(t *testing.T, s storage.StateStorage) {
+	const lockers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, lockers)
+	for i := range lockers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.Lock(context.Background(), "ws", "app", newLock(fmt.Sprintf("lock-%d", i)))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	acquired := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			acquired++
+		case !errors.Is(err, storage.ErrLocked):
+			t.Errorf("Lock: %v", err)
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("%d of %d concurrent lockers acquired the lock, want 1", acquired, lockers)
+	}
+}
+
+func testLargeState(t *testing.T, s storage.StateStorage) {
+	body := bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 8<<20/52)
+	state := &models.State{Workspace: "ws", ID: "large", State: body}
+	mustPut(t, s, state)
+
+	got, err := s.GetState(context.Background(), "ws", "large")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if !bytes.Equal(got.State, body) {
+		t.Errorf("GetState returned %d bytes, want the %d bytes written", len(got.State), len(body))
+	}
+}
+
+func testStreamWrite(t *testing.T, s storage.StateStorage) {
+	writer, ok := s.(storage.StreamWriter)
+	if !ok {
+		t.Skip("backend does not implement storage.StreamWriter")
+	}
+
+	// Large enough to take several parts on backends that upload in parts
+	body := bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 12<<20/52)
+	ctx := context.Background()
+	if err := writer.PutStateFrom(ctx, &models.State{Workspace: "ws", ID: "streamed"}, bytes.NewReader(body)); err != nil {
+		t.Fatalf("PutStateFrom: %v", err)
+	}
+	got, err := s.GetState(ctx, "ws", "streamed")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if !bytes.Equal(got.State, body) {
+		t.Errorf("GetState returned %d bytes, want the %d bytes streamed", len(got.State), len(body))
+	}
+
+	// A body that fails part way must leave the stored state alone
+	failing := io.MultiReader(bytes.NewReader(body[:1<<20]), iotest.ErrReader(errTruncated))
+	if err := writer.PutStateFrom(ctx, &models.State{Workspace: "ws", ID: "streamed"}, failing); !errors.Is(err, errTruncated) {
+		t.Fatalf("PutStateFrom with a failing body = %v, want %v", err, errTruncated)
+	}
+	got, err = s.GetState(ctx, "ws", "streamed")
+	if err != nil || !bytes.Equal(got.State, body) {
+		t.Errorf("state changed by a failed PutStateFrom")
+	}
+}
+
+var errTruncated = errors.New("body truncated")
+
+func testStreamRead(t *testing.T, s storage.StateStorage) {
+	reader, ok := s.(storage.StreamReader)
+	if !ok {
+		t.Skip("backend does not implement storage.StreamReader")
+	}
+
+	ctx := context.Background()
+	if _, _, err := reader.GetStateReader(ctx, "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetStateReader of a missing state = %v, want ErrNotFound", err)
+	}
+
+	body := bytes.Repeat([]byte(`{"type":"aws_instance","name":"web","instances":[]},`), 1<<20/52)
+	mustPut(t, s, &models.State{Workspace: "ws", ID: "app", State: body})
+	want, err := s.GetState(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+
+	state, r, err := reader.GetStateReader(ctx, "ws", "app")
+	if err != nil {
+		t.Fatalf("GetStateReader: %v", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading the state: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("GetStateReader returned %d bytes, want the %d bytes written", len(got), len(body))
+	}
+	if state.Workspace != "ws" || state.ID != "app" || state.Revision != want.Revision || state.State != nil {
+		t.Errorf("GetStateReader = %+v, want ws/app at revision %q without a body", state, want.Revision)
+	}
+}
+
+func testContextCanceled(t *testing.T, s storage.StateStorage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := s.PutState(ctx, newState("ws", "app", 1)); err == nil {
+		t.Error("PutState with a canceled context succeeded")
+	}
+	if err := s.Lock(ctx, "ws", "app", newLock("lock-1")); err == nil {
+		t.Error("Lock with a canceled context succeeded")
+	}
+	if _, err := s.GetState(ctx, "ws", "app"); err == nil {
+		t.Error("GetState with a canceled context succeeded")
+	}
+	if _, err := s.ListStates(ctx, "ws"); err == nil {
+		t.Error("ListStates with a canceled context succeeded")
+	}
+
+	// Nothing may have been written
+	if _, err := s.GetState(context.Background(), "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetState after canceled PutState: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.GetLock(context.Background(), "ws", "app"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("GetLock after canceled Lock: got %v, want ErrNotFound", err)
+	}
+}
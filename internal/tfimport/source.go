@@ -0,0 +1,116 @@
+package tfimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// errNotExist is returned by sources for a missing file
+var errNotExist = errors.New("file does not exist")
+
+// Source is a tree of Terraform state files, addressed by slash separated
+// paths relative to its root
+type Source interface {
+	List(ctx context.Context) ([]string, error)
+	Read(ctx context.Context, path string) ([]byte, error)
+}
+
+// DirSource reads state files from a local directory
+type DirSource struct {
+	root string
+}
+
+func NewDirSource(root string) *DirSource {
+	return &DirSource{root: root}
+}
+
+func (d *DirSource) List(ctx context.Context) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(d.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			rel, err := filepath.Rel(d.root, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", d.root, err)
+	}
+	return paths, nil
+}
+
+func (d *DirSource) Read(ctx context.Context, path string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(d.root, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		return nil, errNotExist
+	}
+	return data, err
+}
+
+// S3Source reads state files from a bucket, below an optional prefix
+type S3Source struct {
+	client     *s3.Client
+	bucketName string
+	prefix     string
+}
+
+func NewS3Source(client *s3.Client, bucketName, prefix string) *S3Source {
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+	return &S3Source{client: client, bucketName: bucketName, prefix: prefix}
+}
+
+func (s *S3Source) List(ctx context.Context) ([]string, error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucketName),
+		Prefix: aws.String(s.prefix),
+	})
+
+	var paths []string
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects from S3: %w", err)
+		}
+		for _, obj := range page.Contents {
+			paths = append(paths, strings.TrimPrefix(aws.ToString(obj.Key), s.prefix))
+		}
+	}
+	return paths, nil
+}
+
+func (s *S3Source) Read(ctx context.Context, path string) ([]byte, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucketName),
+		Key:    aws.String(s.prefix + path),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, errNotExist
+		}
+		return nil, fmt.Errorf("failed to get %s from S3: %w", path, err)
+	}
+	defer output.Body.Close()
+	return io.ReadAll(output.Body)
+}
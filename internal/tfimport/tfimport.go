@@ -0,0 +1,299 @@
+// Package tfimport imports states kept in the layouts of Terraform's own
+// backends into terrastate.
+//
+// Two layouts are recognized, in a local directory or in a bucket:
+//
+//	<key>                                 S3 backend, default workspace
+//	env:/<workspace>/<key>                S3 backend, other workspaces
+//	<dir>/terraform.tfstate               local backend, default workspace
+//	<dir>/terraform.tfstate.d/<ws>/terraform.tfstate
+//	                                      local backend, other workspaces
+//
+// Native S3 lock files (<key>.tflock) mark a state as locked, and digest
+// files (<key>-md5) as exported from the DynamoDB lock table are checked
+// against the state. States are imported byte for byte, so their serial and
+// lineage stay intact.
+package tfimport
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+)
+
+// DefaultWorkspaceKeyPrefix is the workspace_key_prefix of the S3 backend
+const DefaultWorkspaceKeyPrefix = "env:"
+
+// DefaultWorkspace is the name Terraform gives the default workspace
+const DefaultWorkspace = "default"
+
+// Status of an entry in an import
+const (
+	StatusImport         = "import"
+	StatusUpToDate       = "up to date"
+	StatusConflict       = "conflict"
+	StatusLocked         = "locked"
+	StatusDigestMismatch = "digest mismatch"
+)
+
+// Rule maps the source workspace and key of a state to a terrastate
+// workspace and id. Pattern is matched against "<workspace>/<key>" and
+// Template, which may refer to submatches as in regexp.Expand, must produce
+// "<workspace>/<id>".
+type Rule struct {
+	Pattern  *regexp.Regexp
+	Template string
+}
+
+// ParseRule parses a rule written as <pattern>=<template>
+func ParseRule(value string) (Rule, error) {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("invalid mapping rule %q: expected <pattern>=<template>", value)
+	}
+	pattern, err := regexp.Compile(value[:i])
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid mapping rule %q: %w", value, err)
+	}
+	return Rule{Pattern: pattern, Template: value[i+1:]}, nil
+}
+
+// Options configure how a source is scanned and mapped
+type Options struct {
+	// WorkspaceKeyPrefix is the workspace_key_prefix of the S3 backend;
+	// DefaultWorkspaceKeyPrefix if empty
+	WorkspaceKeyPrefix string
+	// Rules are tried in order; states matching none are mapped by
+	// DefaultMapping
+	Rules []Rule
+	// Overwrite imports states over unrelated states with another lineage
+	Overwrite bool
+}
+
+// Entry is a state found in the source
+type Entry struct {
+	Path            string `json:"path"`
+	SourceWorkspace string `json:"source_workspace"`
+	Key             string `json:"key"`
+	Workspace       string `json:"workspace"`
+	ID              string `json:"id"`
+	Serial          int64  `json:"serial"`
+	Lineage         string `json:"lineage"`
+	Status          string `json:"status"`
+	Reason          string `json:"reason,omitempty"`
+}
+
+// stateHeader holds the fields of a state file used to recognize it
+type stateHeader struct {
+	Version int    `json:"version"`
+	Serial  int64  `json:"serial"`
+	Lineage string `json:"lineage"`
+}
+
+// Scan finds the states in src, maps them to terrastate names and decides
+// for each whether to import it into dst
+func Scan(ctx context.Context, src Source, dst storage.StateStorage, opts Options) ([]Entry, error) {
+	prefix := opts.WorkspaceKeyPrefix
+	if prefix == "" {
+		prefix = DefaultWorkspaceKeyPrefix
+	}
+
+	paths, err := src.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		files[p] = true
+	}
+
+	var entries []Entry
+	for _, p := range paths {
+		if isSidecar(p) {
+			continue
+		}
+		data, err := src.Read(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		var header stateHeader
+		if json.Unmarshal(data, &header) != nil || header.Version == 0 || header.Lineage == "" {
+			// Not a state file
+			continue
+		}
+
+		workspace, key := Classify(p, prefix)
+		entry := Entry{
+			Path:            p,
+			SourceWorkspace: workspace,
+			Key:             key,
+			Serial:          header.Serial,
+			Lineage:         header.Lineage,
+		}
+		if entry.Workspace, entry.ID, err = Map(workspace, key, opts.Rules); err != nil {
+			return nil, err
+		}
+		if err := check(ctx, src, dst, files, &entry, data, opts.Overwrite); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	// Two source states mapped to the same name can't both be imported
+	seen := make(map[string]string)
+	for i := range entries {
+		name := entries[i].Workspace + "/" + entries[i].ID
+		if other, ok := seen[name]; ok {
+			entries[i].Status = StatusConflict
+			entries[i].Reason = fmt.Sprintf("%s also maps to %s", other, name)
+			continue
+		}
+		seen[name] = entries[i].Path
+	}
+	return entries, nil
+}
+
+// Import copies the entries marked for import from src to dst and returns
+// how many it imported
+func Import(ctx context.Context, src Source, dst storage.StateStorage, entries []Entry) (int, error) {
+	imported := 0
+	for _, entry := range entries {
+		if entry.Status != StatusImport {
+			continue
+		}
+		data, err := src.Read(ctx, entry.Path)
+		if err != nil {
+			return imported, err
+		}
+		err = dst.PutState(ctx, &models.State{
+			ID:        entry.ID,
+			Workspace: entry.Workspace,
+			Serial:    entry.Serial,
+			State:     data,
+		})
+		if err != nil {
+			return imported, fmt.Errorf("failed to import %s: %w", entry.Path, err)
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+// Classify splits a source path into the Terraform workspace and the backend
+// key of the state
+func Classify(p, workspaceKeyPrefix string) (workspace, key string) {
+	if rest, ok := strings.CutPrefix(p, workspaceKeyPrefix+"/"); ok {
+		if workspace, key, ok := strings.Cut(rest, "/"); ok && key != "" {
+			return workspace, key
+		}
+	}
+
+	parts := strings.Split(p, "/")
+	if n := len(parts); n >= 3 && parts[n-3] == "terraform.tfstate.d" {
+		return parts[n-2], path.Join(append(parts[:n-3:n-3], parts[n-1])...)
+	}
+	return DefaultWorkspace, p
+}
+
+// Map returns the terrastate workspace and id of a state, using the first
+// matching rule or DefaultMapping. Names the API would refuse, such as those
+// starting with a dot, are an error.
+func Map(workspace, key string, rules []Rule) (string, string, error) {
+	source := workspace + "/" + key
+	for _, rule := range rules {
+		match := rule.Pattern.FindStringSubmatchIndex(source)
+		if match == nil {
+			continue
+		}
+		target := string(rule.Pattern.ExpandString(nil, rule.Template, source, match))
+		ws, id, ok := strings.Cut(target, "/")
+		if !ok || storage.ValidateName(ws) != nil || storage.ValidateName(id) != nil {
+			return "", "", fmt.Errorf("rule %s maps %s to %q, want <workspace>/<id>", rule.Pattern, source, target)
+		}
+		return ws, id, nil
+	}
+	ws, id := DefaultMapping(workspace, key)
+	if err := storage.ValidateName(ws); err != nil {
+		return "", "", fmt.Errorf("cannot map %s: %w", source, err)
+	}
+	if err := storage.ValidateName(id); err != nil {
+		return "", "", fmt.Errorf("cannot map %s: %w", source, err)
+	}
+	return ws, id, nil
+}
+
+// DefaultMapping keeps the workspace and derives the id from the key: the
+// .tfstate extension and a trailing terraform.tfstate are dropped and
+// slashes become dashes, so network/terraform.tfstate becomes network and
+// apps/web.tfstate becomes apps-web. A bare terraform.tfstate becomes
+// default.
+func DefaultMapping(workspace, key string) (string, string) {
+	id := key
+	if path.Base(id) == "terraform.tfstate" {
+		id = path.Dir(id)
+	}
+	id = strings.ReplaceAll(strings.Trim(strings.TrimSuffix(id, ".tfstate"), "/"), "/", "-")
+	if id == "" || id == "." {
+		id = DefaultWorkspace
+	}
+	return workspace, id
+}
+
+// isSidecar reports whether p is a lock, digest or backup file kept next to
+// a state
+func isSidecar(p string) bool {
+	return strings.HasSuffix(p, ".tflock") || strings.HasSuffix(p, "-md5") ||
+		strings.HasSuffix(p, ".backup") || strings.HasPrefix(path.Base(p), ".")
+}
+
+// check sets the status of entry from its lock file, its digest and the
+// state already in dst
+func check(ctx context.Context, src Source, dst storage.StateStorage, files map[string]bool, entry *Entry, data []byte, overwrite bool) error {
+	if files[entry.Path+".tflock"] {
+		entry.Status, entry.Reason = StatusLocked, "lock file "+entry.Path+".tflock exists"
+		return nil
+	}
+
+	if files[entry.Path+"-md5"] {
+		digest, err := src.Read(ctx, entry.Path+"-md5")
+		if err != nil && !errors.Is(err, errNotExist) {
+			return err
+		}
+		sum := md5.Sum(data)
+		if want := strings.TrimSpace(string(digest)); want != "" && want != hex.EncodeToString(sum[:]) {
+			entry.Status, entry.Reason = StatusDigestMismatch, "state does not match digest "+want
+			return nil
+		}
+	}
+
+	current, err := dst.GetState(ctx, entry.Workspace, entry.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		entry.Status = StatusImport
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s/%s: %w", entry.Workspace, entry.ID, err)
+	}
+
+	var stored stateHeader
+	json.Unmarshal(current.State, &stored)
+	switch {
+	case stored.Lineage != entry.Lineage && !overwrite:
+		entry.Status = StatusConflict
+		entry.Reason = fmt.Sprintf("%s/%s holds lineage %s", entry.Workspace, entry.ID, stored.Lineage)
+	case stored.Lineage == entry.Lineage && stored.Serial >= entry.Serial:
+		entry.Status = StatusUpToDate
+	default:
+		entry.Status = StatusImport
+	}
+	return nil
+}
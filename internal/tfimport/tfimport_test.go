@@ -0,0 +1,280 @@
+package tfimport
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"github.com/c4po/terrastate/internal/storage/memory"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		path, prefix   string
+		workspace, key string
+	}{
+		{"terraform.tfstate", DefaultWorkspaceKeyPrefix, DefaultWorkspace, "terraform.tfstate"},
+		{"network/terraform.tfstate", DefaultWorkspaceKeyPrefix, DefaultWorkspace, "network/terraform.tfstate"},
+		{"env:/staging/network/terraform.tfstate", DefaultWorkspaceKeyPrefix, "staging", "network/terraform.tfstate"},
+		{"env:/staging/app.tfstate", DefaultWorkspaceKeyPrefix, "staging", "app.tfstate"},
+		// A workspace without a key isn't a workspace state
+		{"env:/staging", DefaultWorkspaceKeyPrefix, DefaultWorkspace, "env:/staging"},
+		{"env:/staging/", DefaultWorkspaceKeyPrefix, DefaultWorkspace, "env:/staging/"},
+		{"workspaces/prod/app.tfstate", "workspaces", "prod", "app.tfstate"},
+		{"env:/prod/app.tfstate", "workspaces", DefaultWorkspace, "env:/prod/app.tfstate"},
+		{"terraform.tfstate.d/prod/terraform.tfstate", DefaultWorkspaceKeyPrefix, "prod", "terraform.tfstate"},
+		{"network/terraform.tfstate.d/prod/terraform.tfstate", DefaultWorkspaceKeyPrefix, "prod", "network/terraform.tfstate"},
+		{"a/b/terraform.tfstate.d/dev/terraform.tfstate", DefaultWorkspaceKeyPrefix, "dev", "a/b/terraform.tfstate"},
+	} {
+		workspace, key := Classify(tc.path, tc.prefix)
+		if workspace != tc.workspace || key != tc.key {
+			t.Errorf("Classify(%q, %q) = %q, %q, want %q, %q", tc.path, tc.prefix, workspace, key, tc.workspace, tc.key)
+		}
+	}
+}
+
+func TestDefaultMapping(t *testing.T) {
+	for _, tc := range []struct {
+		key, id string
+	}{
+		{"terraform.tfstate", DefaultWorkspace},
+		{"network/terraform.tfstate", "network"},
+		{"apps/web.tfstate", "apps-web"},
+		{"apps/web/terraform.tfstate", "apps-web"},
+		{"/app.tfstate", "app"},
+		{"state", "state"},
+	} {
+		workspace, id := DefaultMapping("prod", tc.key)
+		if workspace != "prod" || id != tc.id {
+			t.Errorf("DefaultMapping(prod, %q) = %q, %q, want prod, %q", tc.key, workspace, id, tc.id)
+		}
+	}
+}
+
+func mustParseRule(t *testing.T, value string) Rule {
+	t.Helper()
+	rule, err := ParseRule(value)
+	if err != nil {
+		t.Fatalf("ParseRule(%q): %v", value, err)
+	}
+	return rule
+}
+
+func TestMap(t *testing.T) {
+	rules := []Rule{
+		mustParseRule(t, `^default/teams/(\w+)/(\w+)\.tfstate$=$1/$2`),
+		mustParseRule(t, `^(\w+)/legacy\.tfstate$=archive/${1}-legacy`),
+	}
+	for _, tc := range []struct {
+		workspace, key string
+		ws, id         string
+	}{
+		{DefaultWorkspace, "teams/payments/api.tfstate", "payments", "api"},
+		{"staging", "legacy.tfstate", "archive", "staging-legacy"},
+		// Matching no rule
+		{"staging", "network/terraform.tfstate", "staging", "network"},
+	} {
+		ws, id, err := Map(tc.workspace, tc.key, rules)
+		if err != nil || ws != tc.ws || id != tc.id {
+			t.Errorf("Map(%q, %q) = %q, %q, %v, want %q, %q", tc.workspace, tc.key, ws, id, err, tc.ws, tc.id)
+		}
+	}
+}
+
+func TestMapInvalidTargets(t *testing.T) {
+	for _, tc := range []struct {
+		rule, workspace, key string
+	}{
+		{`.*=$missing`, DefaultWorkspace, "app.tfstate"},
+		{`.*=onlyworkspace`, DefaultWorkspace, "app.tfstate"},
+		{`.*=/app`, DefaultWorkspace, "app.tfstate"},
+		{`.*=ws/`, DefaultWorkspace, "app.tfstate"},
+		{`.*=ws/a/b`, DefaultWorkspace, "app.tfstate"},
+		{`.*=.git/config`, DefaultWorkspace, "app.tfstate"},
+		{`.*=ws/.locks`, DefaultWorkspace, "app.tfstate"},
+		// Mapped by DefaultMapping
+		{`^none$=ws/id`, ".hidden", "app.tfstate"},
+		{`^none$=ws/id`, DefaultWorkspace, ".terraform/terraform.tfstate"},
+	} {
+		rules := []Rule{mustParseRule(t, tc.rule)}
+		if ws, id, err := Map(tc.workspace, tc.key, rules); err == nil {
+			t.Errorf("Map(%q, %q) with %s = %q, %q, want an error", tc.workspace, tc.key, tc.rule, ws, id)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule := mustParseRule(t, `^a=b=$1/c`)
+	if rule.Pattern.String() != "^a=b" || rule.Template != "$1/c" {
+		t.Errorf("ParseRule split into %q and %q, want the template after the last =", rule.Pattern, rule.Template)
+	}
+	for _, value := range []string{"no template", "=ws/id", "[=ws/id"} {
+		if _, err := ParseRule(value); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func state(serial int, lineage string) string {
+	return fmt.Sprintf(`{"version":4,"serial":%d,"lineage":%q}`, serial, lineage)
+}
+
+// writeFiles creates a source directory holding files
+func writeFiles(t *testing.T, files map[string]string) Source {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewDirSource(root)
+}
+
+// scan scans src into dst and returns the entries by path
+func scan(t *testing.T, src Source, dst storage.StateStorage, opts Options) map[string]Entry {
+	t.Helper()
+	entries, err := Scan(context.Background(), src, dst, opts)
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	byPath := make(map[string]Entry)
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+	return byPath
+}
+
+func assertStatus(t *testing.T, entries map[string]Entry, path, status string) {
+	t.Helper()
+	entry, ok := entries[path]
+	if !ok {
+		t.Errorf("%s not found", path)
+		return
+	}
+	if entry.Status != status {
+		t.Errorf("%s has status %q (%s), want %q", path, entry.Status, entry.Reason, status)
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	sum := md5.Sum([]byte(state(1, "l")))
+	src := writeFiles(t, map[string]string{
+		"locked.tfstate":           state(1, "l"),
+		"locked.tfstate.tflock":    `{"ID":"lock"}`,
+		"matching.tfstate":         state(1, "l"),
+		"matching.tfstate-md5":     hex.EncodeToString(sum[:]) + "\n",
+		"mismatch.tfstate":         state(1, "l"),
+		"mismatch.tfstate-md5":     "0123456789abcdef0123456789abcdef",
+		"empty-digest.tfstate":     state(1, "l"),
+		"empty-digest.tfstate-md5": "",
+		"terraform.tfstate.backup": state(1, "l"),
+		"notes.txt":                "not a state",
+	})
+
+	entries := scan(t, src, memory.NewMemoryStorage(), Options{})
+	if len(entries) != 4 {
+		t.Errorf("found %d states, want 4: %+v", len(entries), entries)
+	}
+	assertStatus(t, entries, "locked.tfstate", StatusLocked)
+	assertStatus(t, entries, "matching.tfstate", StatusImport)
+	assertStatus(t, entries, "mismatch.tfstate", StatusDigestMismatch)
+	assertStatus(t, entries, "empty-digest.tfstate", StatusImport)
+}
+
+func TestStoredStates(t *testing.T) {
+	src := writeFiles(t, map[string]string{
+		"new.tfstate":      state(1, "l"),
+		"newer.tfstate":    state(3, "l"),
+		"same.tfstate":     state(2, "l"),
+		"older.tfstate":    state(1, "l"),
+		"other.tfstate":    state(5, "other"),
+		"unparsed.tfstate": state(1, "l"),
+	})
+	dst := memory.NewMemoryStorage()
+	for id, content := range map[string]string{
+		"newer":    state(2, "l"),
+		"same":     state(2, "l"),
+		"older":    state(2, "l"),
+		"other":    state(1, "l"),
+		"unparsed": "not json",
+	} {
+		if err := dst.PutState(context.Background(), &models.State{Workspace: DefaultWorkspace, ID: id, State: []byte(content)}); err != nil {
+			t.Fatalf("PutState: %v", err)
+		}
+	}
+
+	entries := scan(t, src, dst, Options{})
+	assertStatus(t, entries, "new.tfstate", StatusImport)
+	assertStatus(t, entries, "newer.tfstate", StatusImport)
+	assertStatus(t, entries, "same.tfstate", StatusUpToDate)
+	assertStatus(t, entries, "older.tfstate", StatusUpToDate)
+	assertStatus(t, entries, "other.tfstate", StatusConflict)
+	assertStatus(t, entries, "unparsed.tfstate", StatusConflict)
+
+	// Overwriting only replaces states of another lineage
+	entries = scan(t, src, dst, Options{Overwrite: true})
+	assertStatus(t, entries, "other.tfstate", StatusImport)
+	assertStatus(t, entries, "unparsed.tfstate", StatusImport)
+	assertStatus(t, entries, "older.tfstate", StatusUpToDate)
+}
+
+func TestScanAndImport(t *testing.T) {
+	src := writeFiles(t, map[string]string{
+		"network/terraform.tfstate":                     state(1, "net"),
+		"env:/staging/network/terraform.tfstate":        state(2, "net-staging"),
+		"app/terraform.tfstate.d/dev/terraform.tfstate": state(3, "app-dev"),
+		// Also maps to staging/network
+		"staging/network.tfstate": state(1, "dup"),
+	})
+	rules := []Rule{mustParseRule(t, `^default/staging/network\.tfstate$=staging/network`)}
+	dst := memory.NewMemoryStorage()
+
+	entries, err := Scan(context.Background(), src, dst, Options{Rules: rules})
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	byPath := make(map[string]Entry)
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+	for path, want := range map[string]string{
+		"network/terraform.tfstate":                     "default/network",
+		"env:/staging/network/terraform.tfstate":        "staging/network",
+		"app/terraform.tfstate.d/dev/terraform.tfstate": "dev/app",
+		"staging/network.tfstate":                       "staging/network",
+	} {
+		if got := byPath[path].Workspace + "/" + byPath[path].ID; got != want {
+			t.Errorf("%s mapped to %s, want %s", path, got, want)
+		}
+	}
+	// Paths are scanned in order, so the env:/ state is found first
+	assertStatus(t, byPath, "env:/staging/network/terraform.tfstate", StatusImport)
+	assertStatus(t, byPath, "staging/network.tfstate", StatusConflict)
+
+	imported, err := Import(context.Background(), src, dst, entries)
+	if err != nil || imported != 3 {
+		t.Fatalf("Import = %d, %v, want 3 states imported", imported, err)
+	}
+	got, err := dst.GetState(context.Background(), "dev", "app")
+	if err != nil || string(got.State) != state(3, "app-dev") || got.Serial != 3 {
+		t.Errorf("imported dev/app = %v, %v, want the source state byte for byte", got, err)
+	}
+
+	// A second scan finds everything imported
+	for _, entry := range scan(t, src, dst, Options{Rules: rules}) {
+		if entry.Status != StatusUpToDate && entry.Status != StatusConflict {
+			t.Errorf("%s has status %q after the import, want it up to date", entry.Path, entry.Status)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/c4po/terrastate/internal/models"
+	"github.com/c4po/terrastate/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracedStorage wraps a StateStorage and records a span for every call, as a
+// child of the span in the context of the call
+type TracedStorage struct {
+	storage.StateStorage
+
+	backend string
+}
+
+// NewTracedStorage wraps inner, tagging its spans with backend
+func NewTracedStorage(inner storage.StateStorage, backend string) *TracedStorage {
+	return &TracedStorage{StateStorage: inner, backend: backend}
+}
+
+// Unwrap returns the wrapped storage
+func (s *TracedStorage) Unwrap() storage.StateStorage {
+	return s.StateStorage
+}
+
+// start begins the span of a call to method about workspace and id, either of
+// which may be empty
+func (s *TracedStorage) start(ctx context.Context, method, workspace, id string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{BackendKey.String(s.backend)}
+	if workspace != "" {
+		attrs = append(attrs, WorkspaceKey.String(workspace))
+	}
+	if id != "" {
+		attrs = append(attrs, StateIDKey.String(id))
+	}
+	return tracer().Start(ctx, "storage."+method,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// end finishes span, marking it failed if err points at a broken backend.
+// Missing states, held locks and conflicts are expected outcomes and are
+// only recorded as an attribute.
+func end(span trace.Span, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, storage.ErrNotFound),
+		errors.Is(err, storage.ErrLocked),
+		errors.Is(err, storage.ErrConflict),
+		errors.Is(err, storage.ErrNotModified),
+		errors.Is(err, storage.ErrNotSupported):
+		span.SetAttributes(attribute.String("terrastate.result", err.Error()))
+	default:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *TracedStorage) GetState(ctx context.Context, workspace, id string) (*models.State, error) {
+	ctx, span := s.start(ctx, "GetState", workspace, id)
+	state, err := s.StateStorage.GetState(ctx, workspace, id)
+	if err == nil {
+		span.SetAttributes(attribute.Int("terrastate.state_size", len(state.State)))
+	}
+	end(span, err)
+	return state, err
+}
+
+// GetStateReader streams the state if the backend can and otherwise reads it
+// whole with GetState
+func (s *TracedStorage) GetStateReader(ctx context.Context, workspace, id string) (*models.State, io.ReadCloser, error) {
+	reader, ok := s.StateStorage.(storage.StreamReader)
+	if !ok {
+		state, err := s.GetState(ctx, workspace, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return state, storage.TakeBody(state), nil
+	}
+	ctx, span := s.start(ctx, "GetStateReader", workspace, id)
+	state, body, err := reader.GetStateReader(ctx, workspace, id)
+	end(span, err)
+	return state, body, err
+}
+
+func (s *TracedStorage) PutState(ctx context.Context, state *models.State) error {
+	ctx, span := s.start(ctx, "PutState", state.Workspace, state.ID)
+	span.SetAttributes(attribute.Int("terrastate.state_size", len(state.State)))
+	err := s.StateStorage.PutState(ctx, state)
+	end(span, err)
+	return err
+}
+
+// PutStateFrom streams the state if the backend can and otherwise reads it
+// whole and writes it with PutState
+func (s *TracedStorage) PutStateFrom(ctx context.Context, state *models.State, body io.Reader) error {
+	writer, ok := s.StateStorage.(storage.StreamWriter)
+	if !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("failed to read state: %w", err)
+		}
+		state.State = data
+		return s.PutState(ctx, state)
+	}
+	ctx, span := s.start(ctx, "PutStateFrom", state.Workspace, state.ID)
+	counter := &storage.CountingReader{R: body}
+	err := writer.PutStateFrom(ctx, state, counter)
+	span.SetAttributes(attribute.Int64("terrastate.state_size", counter.N))
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) DeleteState(ctx context.Context, workspace, id string) error {
+	ctx, span := s.start(ctx, "DeleteState", workspace, id)
+	err := s.StateStorage.DeleteState(ctx, workspace, id)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) ListStates(ctx context.Context, workspace string) ([]models.State, error) {
+	ctx, span := s.start(ctx, "ListStates", workspace, "")
+	states, err := s.StateStorage.ListStates(ctx, workspace)
+	end(span, err)
+	return states, err
+}
+
+func (s *TracedStorage) ListWorkspaces(ctx context.Context) ([]string, error) {
+	ctx, span := s.start(ctx, "ListWorkspaces", "", "")
+	workspaces, err := s.StateStorage.ListWorkspaces(ctx)
+	end(span, err)
+	return workspaces, err
+}
+
+func (s *TracedStorage) Lock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	ctx, span := s.start(ctx, "Lock", workspace, id)
+	err := s.StateStorage.Lock(ctx, workspace, id, lock)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) Unlock(ctx context.Context, workspace, id string) error {
+	ctx, span := s.start(ctx, "Unlock", workspace, id)
+	err := s.StateStorage.Unlock(ctx, workspace, id)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) UnlockIfMatch(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	ctx, span := s.start(ctx, "UnlockIfMatch", workspace, id)
+	err := s.StateStorage.UnlockIfMatch(ctx, workspace, id, lock)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) GetLock(ctx context.Context, workspace, id string) (*models.StateLock, error) {
+	ctx, span := s.start(ctx, "GetLock", workspace, id)
+	lock, err := s.StateStorage.GetLock(ctx, workspace, id)
+	end(span, err)
+	return lock, err
+}
+
+func (s *TracedStorage) ListLocks(ctx context.Context, workspace string) ([]models.StateLock, error) {
+	ctx, span := s.start(ctx, "ListLocks", workspace, "")
+	locks, err := s.StateStorage.ListLocks(ctx, workspace)
+	end(span, err)
+	return locks, err
+}
+
+func (s *TracedStorage) RenewLock(ctx context.Context, workspace, id string, lock *models.StateLock) error {
+	ctx, span := s.start(ctx, "RenewLock", workspace, id)
+	err := s.StateStorage.RenewLock(ctx, workspace, id, lock)
+	end(span, err)
+	return err
+}
+
+func (s *TracedStorage) GetWorkspaceMeta(ctx context.Context, workspace string) (*models.WorkspaceMeta, error) {
+	ctx, span := s.start(ctx, "GetWorkspaceMeta", workspace, "")
+	meta, err := s.StateStorage.GetWorkspaceMeta(ctx, workspace)
+	end(span, err)
+	return meta, err
+}
+
+func (s *TracedStorage) PutWorkspaceMeta(ctx context.Context, meta *models.WorkspaceMeta) error {
+	ctx, span := s.start(ctx, "PutWorkspaceMeta", meta.Workspace, "")
+	err := s.StateStorage.PutWorkspaceMeta(ctx, meta)
+	end(span, err)
+	return err
+}
+
+// PutStateIfMatch makes the write conditional if the backend supports it and
+// writes unconditionally otherwise
+func (s *TracedStorage) PutStateIfMatch(ctx context.Context, state *models.State, revision string) error {
+	writer, ok := s.StateStorage.(storage.ConditionalWriter)
+	if !ok {
+		return s.PutState(ctx, state)
+	}
+	ctx, span := s.start(ctx, "PutStateIfMatch", state.Workspace, state.ID)
+	span.SetAttributes(attribute.Int("terrastate.state_size", len(state.State)))
+	err := writer.PutStateIfMatch(ctx, state, revision)
+	end(span, err)
+	return err
+}
+
+// GetStateIfNoneMatch uses the conditional read of the backend if it has one
+// and otherwise always returns the state
+func (s *TracedStorage) GetStateIfNoneMatch(ctx context.Context, workspace, id, revision string) (*models.State, error) {
+	reader, ok := s.StateStorage.(storage.ConditionalReader)
+	if !ok {
+		return s.GetState(ctx, workspace, id)
+	}
+	ctx, span := s.start(ctx, "GetStateIfNoneMatch", workspace, id)
+	state, err := reader.GetStateIfNoneMatch(ctx, workspace, id, revision)
+	end(span, err)
+	return state, err
+}
+
+func (s *TracedStorage) ListStateVersions(ctx context.Context, workspace, id string) ([]models.StateVersion, error) {
+	history, ok := s.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	ctx, span := s.start(ctx, "ListStateVersions", workspace, id)
+	versions, err := history.ListStateVersions(ctx, workspace, id)
+	end(span, err)
+	return versions, err
+}
+
+func (s *TracedStorage) GetStateVersion(ctx context.Context, workspace, id, version string) (*models.State, error) {
+	history, ok := s.StateStorage.(storage.StateHistory)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	ctx, span := s.start(ctx, "GetStateVersion", workspace, id)
+	span.SetAttributes(attribute.String("terrastate.version", version))
+	state, err := history.GetStateVersion(ctx, workspace, id, version)
+	end(span, err)
+	return state, err
+}
+
+// Close closes the wrapped storage if it can be closed
+func (s *TracedStorage) Close() error {
+	if closer, ok := s.StateStorage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package tracing records OpenTelemetry spans for HTTP requests and storage
+// calls and exports them over OTLP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/c4po/terrastate"
+
+// Span attributes naming the state a request or storage call is about
+const (
+	WorkspaceKey = attribute.Key("terrastate.workspace")
+	StateIDKey   = attribute.Key("terrastate.state_id")
+	BackendKey   = attribute.Key("terrastate.backend")
+)
+
+// Config selects where spans are exported and how many are kept
+type Config struct {
+	ServiceVersion string
+	// Endpoint is the OTLP URL spans are sent to. If empty, it is read by the
+	// exporter from the standard OTEL_EXPORTER_OTLP_* environment variables,
+	// as are the headers and TLS settings.
+	Endpoint string
+	// Protocol is the OTLP protocol, grpc or http/protobuf
+	Protocol string
+	// SampleRatio is the share of new traces recorded, from 0 to 1. Traces
+	// started by a caller follow the caller's sampling decision.
+	SampleRatio float64
+}
+
+// Setup installs the W3C trace context propagator and a tracer provider
+// exporting over OTLP. The returned function flushes the spans still
+// buffered and stops the exporter.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var client otlptrace.Client
+	switch cfg.Protocol {
+	case "", "grpc":
+		var opts []otlptracegrpc.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.Endpoint))
+		}
+		client = otlptracegrpc.NewClient(opts...)
+	case "http/protobuf":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		client = otlptracehttp.NewClient(opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected grpc or http/protobuf", cfg.Protocol)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid sample ratio %v, expected a value from 0 to 1", cfg.SampleRatio)
+	}
+
+	exporter, err := otlptrace.New(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("terrastate"),
+		semconv.ServiceVersion(cfg.ServiceVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Middleware starts a span for every request, continuing the trace given in
+// the traceparent header. Spans are named after the route template and carry
+// the workspace and state ID of the request.
+func Middleware(next http.Handler) http.Handler {
+	annotated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if route := routeTemplate(r); route != "" {
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		vars := mux.Vars(r)
+		if workspace := vars["workspace"]; workspace != "" {
+			span.SetAttributes(WorkspaceKey.String(workspace))
+		}
+		if id := vars["id"]; id != "" {
+			span.SetAttributes(StateIDKey.String(id))
+		}
+		next.ServeHTTP(w, r)
+	})
+	return otelhttp.NewHandler(annotated, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if route := routeTemplate(r); route != "" {
+				return r.Method + " " + route
+			}
+			return r.Method
+		}),
+	)
+}
+
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
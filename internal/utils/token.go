@@ -3,6 +3,7 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 )
 
 func GenerateToken() (string, error) {
@@ -22,3 +23,13 @@ func GenerateCode() (string, error) {
 	}
 	return base64.URLEncoding.EncodeToString(b), nil
 }
+
+// GenerateRequestID returns a random ID for a request that didn't bring one
+func GenerateRequestID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}